@@ -0,0 +1,264 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Package analyzer reports common misuses of godbc in the code calling it:
+// Rows that are never closed, Rows returned by QueryRow used without
+// checking for nil, which QueryRow returns when there is no row, and
+// statements built by concatenating or formatting values rather than
+// passing them as arguments.
+//
+// It runs with go vet, through the godbcvet command:
+//
+//	go install github.com/couchbase/godbc/analyzer/cmd/godbcvet@latest
+//	go vet -vettool=$(which godbcvet) ./...
+package analyzer // import "github.com/couchbase/godbc/analyzer"
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+const godbcPath = "github.com/couchbase/godbc"
+
+var Analyzer = &analysis.Analyzer{
+	Name:     "godbc",
+	Doc:      "report unclosed Rows, unchecked QueryRow results and statements built from values",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+// Methods and functions of godbc and its drivers taking a statement.
+var statementFuncs = map[string]bool{
+	"Query":           true,
+	"QueryContext":    true,
+	"QueryRow":        true,
+	"QueryRaw":        true,
+	"Exec":            true,
+	"ExecContext":     true,
+	"ExecRaw":         true,
+	"Prepare":         true,
+	"PrepareContext":  true,
+	"ExecChunked":     true,
+	"PrepareAndQuery": true,
+	"PrepareAndExec":  true,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	inspect := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+	nodes := []ast.Node{(*ast.CallExpr)(nil), (*ast.FuncDecl)(nil), (*ast.FuncLit)(nil)}
+	inspect.Preorder(nodes, func(n ast.Node) {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			checkStatement(pass, n)
+		case *ast.FuncDecl:
+			if n.Body != nil {
+				checkBody(pass, n.Body)
+			}
+		case *ast.FuncLit:
+			checkBody(pass, n.Body)
+		}
+	})
+	return nil, nil
+}
+
+// The godbc function or method called, nil if call is not to one.
+func godbcFunc(pass *analysis.Pass, call *ast.CallExpr) *types.Func {
+	var id *ast.Ident
+	switch fun := call.Fun.(type) {
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	case *ast.Ident:
+		id = fun
+	default:
+		return nil
+	}
+	fn, ok := pass.TypesInfo.Uses[id].(*types.Func)
+	if !ok || fn.Pkg() == nil || !isGodbcPackage(fn.Pkg().Path()) {
+		return nil
+	}
+	return fn
+}
+
+// godbc and the drivers under it, such as n1ql.
+func isGodbcPackage(path string) bool {
+	return path == godbcPath || strings.HasPrefix(path, godbcPath+"/")
+}
+
+// Whether t is the interface Row or Rows of godbc.
+func isGodbcType(t types.Type, name string) bool {
+	named, ok := t.(*types.Named)
+	return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == godbcPath && named.Obj().Name() == name
+}
+
+// Report a statement built from values, with + or fmt.Sprintf.
+func checkStatement(pass *analysis.Pass, call *ast.CallExpr) {
+	fn := godbcFunc(pass, call)
+	if fn == nil || !statementFuncs[fn.Name()] {
+		return
+	}
+	sig := fn.Type().(*types.Signature)
+	for i := 0; i < sig.Params().Len() && i < len(call.Args); i++ {
+		if basic, ok := sig.Params().At(i).Type().(*types.Basic); !ok || basic.Kind() != types.String {
+			continue
+		}
+		if builtFromValues(pass, call.Args[i]) {
+			pass.Reportf(call.Args[i].Pos(), "statement of %s built from values: pass them as arguments", fn.Name())
+		}
+		return
+	}
+}
+
+func builtFromValues(pass *analysis.Pass, e ast.Expr) bool {
+	if pass.TypesInfo.Types[e].Value != nil {
+		return false // a constant
+	}
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return builtFromValues(pass, e.X)
+	case *ast.BinaryExpr:
+		return e.Op == token.ADD
+	case *ast.CallExpr:
+		if sel, ok := e.Fun.(*ast.SelectorExpr); ok {
+			fn, ok := pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+			return ok && fn.Pkg() != nil && fn.Pkg().Path() == "fmt" && fn.Name() == "Sprintf"
+		}
+	}
+	return false
+}
+
+// Report the Rows of body that are never closed, and the Rows of QueryRow
+// used without checking for nil.
+func checkBody(pass *analysis.Pass, body *ast.BlockStmt) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false // checked on its own
+		case *ast.ExprStmt:
+			if call, ok := n.X.(*ast.CallExpr); ok && returnsRows(pass, call) {
+				pass.Reportf(call.Pos(), "Rows discarded without being closed")
+			}
+		case *ast.AssignStmt:
+			checkAssign(pass, body, n)
+		case *ast.SelectorExpr:
+			if call, ok := n.X.(*ast.CallExpr); ok && isQueryRow(pass, call) {
+				pass.Reportf(n.Sel.Pos(), "QueryRow returns nil when there is no row: check it before calling %s", n.Sel.Name)
+			}
+		}
+		return true
+	})
+}
+
+func returnsRows(pass *analysis.Pass, call *ast.CallExpr) bool {
+	if godbcFunc(pass, call) == nil {
+		return false
+	}
+	switch t := pass.TypesInfo.Types[call].Type.(type) {
+	case *types.Tuple:
+		return t.Len() > 0 && isGodbcType(t.At(0).Type(), "Rows")
+	default:
+		return t != nil && isGodbcType(t, "Rows")
+	}
+}
+
+func isQueryRow(pass *analysis.Pass, call *ast.CallExpr) bool {
+	fn := godbcFunc(pass, call)
+	return fn != nil && fn.Name() == "QueryRow" && isGodbcType(pass.TypesInfo.Types[call].Type, "Row")
+}
+
+// Check the variable a call returning Rows, or the Row of QueryRow, is
+// assigned to.
+func checkAssign(pass *analysis.Pass, body *ast.BlockStmt, assign *ast.AssignStmt) {
+	if len(assign.Rhs) != 1 || len(assign.Lhs) == 0 {
+		return
+	}
+	call, ok := assign.Rhs[0].(*ast.CallExpr)
+	if !ok {
+		return
+	}
+	id, ok := assign.Lhs[0].(*ast.Ident)
+	if !ok {
+		return
+	}
+	switch {
+	case returnsRows(pass, call):
+		if id.Name == "_" {
+			pass.Reportf(call.Pos(), "Rows discarded without being closed")
+			return
+		}
+		v, ok := pass.TypesInfo.ObjectOf(id).(*types.Var)
+		if ok && !closedOrEscaping(pass, body, v) {
+			pass.Reportf(id.Pos(), "%s is never closed", id.Name)
+		}
+	case isQueryRow(pass, call):
+		v, ok := pass.TypesInfo.ObjectOf(id).(*types.Var)
+		if ok && !comparedToNil(pass, body, v) {
+			pass.Reportf(id.Pos(), "QueryRow returns nil when there is no row: check %s before using it", id.Name)
+		}
+	}
+}
+
+// Whether body closes v, or hands it over to other code that may: returns
+// it, passes it to a function, stores it.
+func closedOrEscaping(pass *analysis.Pass, body *ast.BlockStmt, v *types.Var) bool {
+	found := false
+	var stack []ast.Node
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		if found {
+			return false
+		}
+		if id, ok := n.(*ast.Ident); ok && pass.TypesInfo.Uses[id] == v {
+			found = escapes(stack)
+		}
+		stack = append(stack, n)
+		return true
+	})
+	return found
+}
+
+// Whether the use of a Rows variable under the given nodes closes it or
+// hands it over.
+func escapes(stack []ast.Node) bool {
+	parent := stack[len(stack)-1]
+	sel, ok := parent.(*ast.SelectorExpr)
+	if !ok {
+		// returned, passed, assigned or captured
+		_, compared := parent.(*ast.BinaryExpr)
+		return !compared
+	}
+	return sel.Sel.Name == "Close"
+}
+
+// Whether body compares v to nil.
+func comparedToNil(pass *analysis.Pass, body *ast.BlockStmt, v *types.Var) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		cmp, ok := n.(*ast.BinaryExpr)
+		if !ok || found || (cmp.Op != token.EQL && cmp.Op != token.NEQ) {
+			return !found
+		}
+		for _, operands := range [][2]ast.Expr{{cmp.X, cmp.Y}, {cmp.Y, cmp.X}} {
+			id, ok := operands[0].(*ast.Ident)
+			if ok && pass.TypesInfo.Uses[id] == v && pass.TypesInfo.Types[operands[1]].IsNil() {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,64 @@
+package a
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/couchbase/godbc"
+)
+
+func closed(db godbc.DB) error {
+	rows, err := db.Query("SELECT 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return nil
+}
+
+func unclosed(db godbc.DB) {
+	rows, err := db.Query("SELECT 1") // want `rows is never closed`
+	if err != nil || rows == nil {
+		return
+	}
+	for rows.Next() {
+	}
+}
+
+func returned(ctx context.Context, db godbc.DB) (godbc.Rows, error) {
+	rows, err := db.QueryContext(ctx, "SELECT 1")
+	return rows, err
+}
+
+func discarded(db godbc.DB) {
+	db.Query("SELECT 1")        // want `Rows discarded without being closed`
+	_, _ = db.Query("SELECT 1") // want `Rows discarded without being closed`
+}
+
+func closedInClosure(db godbc.DB) {
+	rows, _ := db.Query("SELECT 1")
+	func() {
+		rows.Close()
+	}()
+}
+
+func queryRow(db godbc.DB) (n int) {
+	db.QueryRow("SELECT COUNT(*) FROM default").Scan(&n) // want `QueryRow returns nil when there is no row: check it before calling Scan`
+	row := db.QueryRow("SELECT COUNT(*) FROM default")   // want `QueryRow returns nil when there is no row: check row before using it`
+	row.Scan(&n)
+	if row := db.QueryRow("SELECT COUNT(*) FROM default"); row != nil {
+		row.Scan(&n)
+	}
+	return n
+}
+
+const keyspace = "default"
+
+func statements(ctx context.Context, db godbc.DB, id, name string) {
+	db.Exec("DELETE FROM "+keyspace+" WHERE id = ?", id)
+	db.Exec("DELETE FROM default WHERE id = '" + id + "'")                   // want `statement of Exec built from values: pass them as arguments`
+	db.ExecContext(ctx, fmt.Sprintf("UPDATE default SET name = '%s'", name)) // want `statement of ExecContext built from values: pass them as arguments`
+	db.ExecContext(ctx, "UPDATE default SET name = ? WHERE id = ?", name, "k"+id)
+}
@@ -0,0 +1,25 @@
+package godbc
+
+import "context"
+
+type DB interface {
+	Exec(query string, args ...interface{}) (Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error)
+	Query(query string, args ...interface{}) (Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error)
+	QueryRow(query string, args ...interface{}) Row
+}
+
+type Result interface {
+	RowsAffected() (int64, error)
+}
+
+type Row interface {
+	Scan(dest ...interface{}) error
+}
+
+type Rows interface {
+	Close() error
+	Next() bool
+	Scan(dest ...interface{}) error
+}
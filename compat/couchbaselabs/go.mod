@@ -0,0 +1,7 @@
+module github.com/couchbaselabs/godbc
+
+go 1.13
+
+require github.com/couchbase/godbc v0.0.0-00010101000000-000000000000
+
+replace github.com/couchbase/godbc => ../..
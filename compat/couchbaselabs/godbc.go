@@ -0,0 +1,37 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Package godbc keeps code importing the old github.com/couchbaselabs/godbc
+// path working. Its types are aliases of the github.com/couchbase/godbc
+// ones, so values can be passed freely between code using either path.
+//
+// Deprecated: import github.com/couchbase/godbc instead.
+package godbc
+
+import "github.com/couchbase/godbc"
+
+type (
+	DB       = godbc.DB
+	DbSource = godbc.DbSource
+	DBStats  = godbc.DBStats
+	Result   = godbc.Result
+	Row      = godbc.Row
+	Rows     = godbc.Rows
+	Stmt     = godbc.Stmt
+	Tx       = godbc.Tx
+)
+
+// See godbc.ErrRow.
+func ErrRow(err error) Row {
+	return godbc.ErrRow(err)
+}
+
+// See godbc.ErrNoRows. The same error, so errors.Is matches it whichever
+// path it is compared with.
+var ErrNoRows = godbc.ErrNoRows
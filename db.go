@@ -7,15 +7,23 @@
 //  either express or implied. See the License for the specific language governing permissions
 //  and limitations under the License.
 
-package godbc
+package godbc // import "github.com/couchbase/godbc"
+
+import (
+	"context"
+)
 
 type DB interface {
 	Begin() (Tx, error)
 	Close() error
 	Exec(query string, args ...interface{}) (Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (Result, error)
 	Ping() error
+	PingContext(ctx context.Context) error
 	Prepare(query string) (Stmt, error)
+	PrepareContext(ctx context.Context, query string) (Stmt, error)
 	Query(query string, args ...interface{}) (Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (Rows, error)
 	QueryRow(query string, args ...interface{}) Row
 	SetMaxIdleConns(n int)
 	SetMaxOpenConns(n int)
@@ -0,0 +1,358 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Package drivertest checks that an implementation of the godbc interfaces
+// behaves the way their callers expect: rows that can be iterated, scanned
+// and closed in any order, statements that can be reused, contexts that are
+// honoured, transactions that end once.
+//
+// A driver runs the suite from one of its tests, against a live cluster or
+// a fake one, giving it the statements to use in its own dialect:
+//
+//	func TestConformance(t *testing.T) {
+//		db := openTestDB(t)
+//		defer db.Close()
+//		drivertest.TestDB(t, db, drivertest.Config{...})
+//	}
+package drivertest // import "github.com/couchbase/godbc/drivertest"
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+// Statements the suite runs, and what they are expected to return.
+type Config struct {
+
+	// Query returning the rows of Want, in this order, with the given
+	// columns. Values are compared as Scan renders them into a *string.
+	Query   string
+	Columns []string
+	Want    [][]string
+
+	// Statement returning the value of its only positional parameter as its
+	// only column, EchoArg rendering as EchoWant.
+	Echo     string
+	EchoArg  interface{}
+	EchoWant string
+
+	// Statement whose Result reports RowsAffected rows. Not tested if empty.
+	Exec         string
+	RowsAffected int64
+
+	// Statement run in the transactions tested. Transactions are not tested
+	// if it is empty.
+	TxExec string
+}
+
+// How long the calls of QueryRow may take in all before they are deemed to
+// be waiting for a connection that is never released.
+const releaseTimeout = 10 * time.Second
+
+// Run the suite against db, which is left open.
+func TestDB(t *testing.T, db godbc.DB, cfg Config) {
+	if cfg.Query == "" || len(cfg.Want) == 0 || cfg.Echo == "" {
+		t.Fatal("drivertest: Query, Want and Echo are required")
+	}
+	t.Run("Ping", func(t *testing.T) { testPing(t, db) })
+	t.Run("Rows", func(t *testing.T) { testRows(t, db, cfg) })
+	t.Run("EarlyClose", func(t *testing.T) { testEarlyClose(t, db, cfg) })
+	t.Run("QueryRow", func(t *testing.T) { testQueryRow(t, db, cfg) })
+	t.Run("QueryRowRelease", func(t *testing.T) { testQueryRowRelease(t, db, cfg) })
+	t.Run("Stmt", func(t *testing.T) { testStmt(t, db, cfg) })
+	t.Run("Context", func(t *testing.T) { testContext(t, db, cfg) })
+	t.Run("Exec", func(t *testing.T) {
+		if cfg.Exec == "" {
+			t.Skip("no Exec statement")
+		}
+		testExec(t, db, cfg)
+	})
+	t.Run("Tx", func(t *testing.T) {
+		if cfg.TxExec == "" {
+			t.Skip("no TxExec statement")
+		}
+		testTx(t, db, cfg)
+	})
+	t.Run("Stats", func(t *testing.T) {
+		stats := db.Stats()
+		if stats == nil || stats.OpenConnections() < 0 {
+			t.Errorf("Expected stats, got %v", stats)
+		}
+	})
+}
+
+func testPing(t *testing.T, db godbc.DB) {
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if err := db.PingContext(context.Background()); err != nil {
+		t.Errorf("PingContext: %v", err)
+	}
+}
+
+func testRows(t *testing.T, db godbc.DB, cfg Config) {
+	rows, err := db.Query(cfg.Query)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil || !reflect.DeepEqual(columns, cfg.Columns) {
+		t.Errorf("Expected columns %v, got %v, %v", cfg.Columns, columns, err)
+	}
+	var dummy string
+	if err := rows.Scan(&dummy); err == nil {
+		t.Error("Scan before Next must fail")
+	}
+
+	var got [][]string
+	for rows.Next() {
+		row, err := scanStrings(rows, len(cfg.Columns))
+		if err != nil {
+			t.Fatalf("Scan row %d: %v", len(got), err)
+		}
+		got = append(got, row)
+		tooMany := make([]interface{}, len(cfg.Columns)+1)
+		for i := range tooMany {
+			tooMany[i] = new(string)
+		}
+		if err := rows.Scan(tooMany...); err == nil {
+			t.Error("Scan into more destinations than columns must fail")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Errorf("Err after the last row: %v", err)
+	}
+	if !reflect.DeepEqual(got, cfg.Want) {
+		t.Errorf("Expected rows %v, got %v", cfg.Want, got)
+	}
+	if rows.Next() {
+		t.Error("Next after the last row must return false")
+	}
+	if err := rows.Scan(&dummy); err == nil {
+		t.Error("Scan after the last row must fail")
+	}
+
+	if err := rows.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := rows.Close(); err != nil {
+		t.Errorf("Second Close: %v", err)
+	}
+	if rows.Next() {
+		t.Error("Next after Close must return false")
+	}
+}
+
+func testEarlyClose(t *testing.T, db godbc.DB, cfg Config) {
+	rows, err := db.Query(cfg.Query)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("Expected a row, got %v", rows.Err())
+	}
+	if err := rows.Close(); err != nil {
+		t.Errorf("Close before the last row: %v", err)
+	}
+	if rows.Next() {
+		t.Error("Next after Close must return false")
+	}
+
+	// the connection is still usable
+	rows, err = db.Query(cfg.Query)
+	if err != nil {
+		t.Fatalf("Query after an early Close: %v", err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Close(); err != nil || n != len(cfg.Want) {
+		t.Errorf("Expected %d rows after an early Close, got %d, %v", len(cfg.Want), n, err)
+	}
+}
+
+func testQueryRow(t *testing.T, db godbc.DB, cfg Config) {
+	row := db.QueryRow(cfg.Query)
+	if row == nil {
+		t.Fatal("QueryRow returned no row")
+	}
+	got, err := scanStrings(row, len(cfg.Columns))
+	if err != nil || !reflect.DeepEqual(got, cfg.Want[0]) {
+		t.Errorf("Expected the first row %v, got %v, %v", cfg.Want[0], got, err)
+	}
+}
+
+// Scanning the row of QueryRow releases what its query holds: with a single
+// connection, each call would otherwise wait for the previous one forever.
+// The limit on open connections is lifted afterwards.
+func testQueryRowRelease(t *testing.T, db godbc.DB, cfg Config) {
+	db.SetMaxOpenConns(1)
+	defer db.SetMaxOpenConns(0)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			row := db.QueryRow(cfg.Query)
+			if row == nil {
+				done <- errors.New("QueryRow returned no row")
+				return
+			}
+			if _, err := scanStrings(row, len(cfg.Columns)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("QueryRow: %v", err)
+		}
+	case <-time.After(releaseTimeout):
+		t.Fatal("QueryRow calls exhausted the connection")
+	}
+}
+
+func testStmt(t *testing.T, db godbc.DB, cfg Config) {
+	stmt, err := db.Prepare(cfg.Echo)
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	// a statement is executed as many times as needed
+	for i := 0; i < 2; i++ {
+		rows, err := stmt.Query(cfg.EchoArg)
+		if err != nil {
+			t.Fatalf("Query %d: %v", i, err)
+		}
+		var got []string
+		for rows.Next() {
+			row, err := scanStrings(rows, 1)
+			if err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+			got = append(got, row[0])
+		}
+		if err := rows.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if len(got) != 1 || got[0] != cfg.EchoWant {
+			t.Errorf("Expected [%s], got %v", cfg.EchoWant, got)
+		}
+	}
+
+	row := stmt.QueryRow(cfg.EchoArg)
+	if row == nil {
+		t.Fatal("QueryRow returned no row")
+	}
+	got, err := scanStrings(row, 1)
+	if err != nil || got[0] != cfg.EchoWant {
+		t.Errorf("Expected %s, got %v, %v", cfg.EchoWant, got, err)
+	}
+
+	if err := stmt.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if rows, err := stmt.Query(cfg.EchoArg); err == nil {
+		rows.Close()
+		t.Error("Query on a closed statement must fail")
+	}
+}
+
+func testContext(t *testing.T, db godbc.DB, cfg Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := db.PingContext(ctx); err == nil {
+		t.Error("PingContext with a canceled context must fail")
+	}
+	if rows, err := db.QueryContext(ctx, cfg.Query); err == nil {
+		rows.Close()
+		t.Error("QueryContext with a canceled context must fail")
+	}
+	if _, err := db.PrepareContext(ctx, cfg.Echo); err == nil {
+		t.Error("PrepareContext with a canceled context must fail")
+	}
+	if cfg.Exec != "" {
+		if _, err := db.ExecContext(ctx, cfg.Exec); err == nil {
+			t.Error("ExecContext with a canceled context must fail")
+		}
+	}
+
+	stmt, err := db.Prepare(cfg.Echo)
+	if err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+	defer stmt.Close()
+	if rows, err := stmt.QueryContext(ctx, cfg.EchoArg); err == nil {
+		rows.Close()
+		t.Error("Stmt.QueryContext with a canceled context must fail")
+	}
+}
+
+func testExec(t *testing.T, db godbc.DB, cfg Config) {
+	res, err := db.Exec(cfg.Exec)
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != cfg.RowsAffected {
+		t.Errorf("Expected %d rows affected, got %d, %v", cfg.RowsAffected, n, err)
+	}
+	if rows := res.Rows(); rows != nil {
+		rows.Close()
+	}
+}
+
+func testTx(t *testing.T, db godbc.DB, cfg Config) {
+	for _, commit := range []bool{true, false} {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Begin: %v", err)
+		}
+		if _, err := tx.Exec(cfg.TxExec); err != nil {
+			tx.Rollback()
+			t.Fatalf("Exec in a transaction: %v", err)
+		}
+		end, name := tx.Rollback, "Rollback"
+		if commit {
+			end, name = tx.Commit, "Commit"
+		}
+		if err := end(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := tx.Commit(); err == nil {
+			t.Errorf("Commit after %s must fail", name)
+		}
+		if err := tx.Rollback(); err == nil {
+			t.Errorf("Rollback after %s must fail", name)
+		}
+	}
+}
+
+// Scan the n columns of the current row as strings.
+func scanStrings(row godbc.Row, n int) ([]string, error) {
+	values := make([]string, n)
+	dest := make([]interface{}, n)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
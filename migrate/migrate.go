@@ -0,0 +1,332 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+// Package migrate applies the migrations of a schema, such as the creation
+// of scopes, collections and indexes or the backfill of documents, in order
+// and once.
+//
+// The version of the schema and the migrations applied are tracked in a
+// document, which also locks the schema while migrations are applied, so
+// that only one of several instances of an application starting together
+// applies them. The document is only changed from the version last read,
+// as told by its CAS, so that of two runners changing it at once one fails.
+//
+//	migrations, err := migrate.ReadDir("migrations")
+//	...
+//	m := &migrate.Migrator{DB: db, Keyspace: "app._system.migrations"}
+//	applied, err := m.Up(ctx, migrations)
+//
+// Statements of DDL cannot run in transactions, so a migration is not
+// atomic: one failing midway is left partly applied, and is applied again
+// from its first statement by the next Up. Statements are best written to
+// be run more than once, e.g. with IF NOT EXISTS.
+package migrate // import "github.com/couchbase/godbc/migrate"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+// Returned by Up when another runner holds the lock.
+var ErrLocked = errors.New("migrate: Migrations locked")
+
+// Returned by Up when an applied migration was changed since.
+var ErrChecksum = errors.New("migrate: Applied migration changed")
+
+// Applies migrations to the database of DB.
+type Migrator struct {
+	DB godbc.DB
+
+	// Keyspace of the document tracking the version, e.g.
+	// "app._default._default", and the key of the document, "migrations"
+	// if empty.
+	Keyspace   string
+	DocumentID string
+
+	// Name of this runner in the lock, the host name and the process ID
+	// if empty.
+	Owner string
+
+	// How long the lock is held without progress before other runners
+	// may take it over, 15 minutes if zero. The lock is renewed as each
+	// migration is applied.
+	LockTimeout time.Duration
+
+	// Report the migrations to apply without applying them, nor taking
+	// the lock.
+	DryRun bool
+
+	// Where the statements applied, or to apply in dry run mode, are
+	// written. Nil for nowhere.
+	Log io.Writer
+}
+
+// A migration applied to the database, as recorded in the version document.
+type Applied struct {
+	Version   int64     `json:"version"`
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+type lock struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// The version document.
+type state struct {
+	Version    int64     `json:"version"`
+	Migrations []Applied `json:"migrations"`
+	Lock       *lock     `json:"lock,omitempty"`
+}
+
+// The lock expired and was taken over by another runner.
+var errLockLost = fmt.Errorf("%w by another runner", ErrLocked)
+
+// Another runner changed the version document since it was read.
+var errConflict = fmt.Errorf("%w: Version changed by another runner", ErrLocked)
+
+func (st *state) lockedBy(owner string) bool {
+	return st.Lock != nil && st.Lock.Owner == owner
+}
+
+func (m *Migrator) documentID() string {
+	if m.DocumentID == "" {
+		return "migrations"
+	}
+	return m.DocumentID
+}
+
+func (m *Migrator) owner() string {
+	if m.Owner != "" {
+		return m.Owner
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+func (m *Migrator) lockTimeout() time.Duration {
+	if m.LockTimeout <= 0 {
+		return 15 * time.Minute
+	}
+	return m.LockTimeout
+}
+
+func (m *Migrator) logf(format string, args ...interface{}) {
+	if m.Log != nil {
+		fmt.Fprintf(m.Log, format, args...)
+	}
+}
+
+// The version of the database, the highest of the migrations applied, or
+// zero if none was.
+func (m *Migrator) Version(ctx context.Context) (int64, error) {
+	st, _, err := m.read(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return st.Version, nil
+}
+
+// The migrations applied to the database, in the order they were.
+func (m *Migrator) Applied(ctx context.Context) ([]Applied, error) {
+	st, _, err := m.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st.Migrations, nil
+}
+
+// Apply the migrations of a version above the one of the database, in the
+// order of their versions, and return them. The migrations already applied
+// must be unchanged: their checksum is verified, when it is known.
+func (m *Migrator) Up(ctx context.Context, migrations []Migration) ([]Migration, error) {
+	st, _, err := m.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingMigrations(st, migrations)
+	if err != nil {
+		return nil, err
+	}
+	if m.DryRun {
+		for _, mig := range pending {
+			m.logf("-- %d %s (dry run)\n", mig.Version, mig.Name)
+			for _, stmt := range mig.Statements {
+				m.logf("%s;\n", stmt)
+			}
+		}
+		return pending, nil
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	owner := m.owner()
+	if err := m.update(ctx, func(st *state) error {
+		if st.Lock != nil && st.Lock.Owner != owner && time.Now().Before(st.Lock.Expires) {
+			return fmt.Errorf("%w by %s until %s", ErrLocked, st.Lock.Owner, st.Lock.Expires.Format(time.RFC3339))
+		}
+		st.Lock = &lock{Owner: owner, Expires: time.Now().Add(m.lockTimeout())}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	defer m.update(context.Background(), func(st *state) error {
+		if !st.lockedBy(owner) {
+			return errLockLost
+		}
+		st.Lock = nil
+		return nil
+	})
+
+	// the migrations may have been applied by the previous owner of the lock
+	st, _, err = m.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pending, err = pendingMigrations(st, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, mig := range pending {
+		m.logf("-- %d %s\n", mig.Version, mig.Name)
+		for i, stmt := range mig.Statements {
+			m.logf("%s;\n", stmt)
+			if _, err := m.DB.ExecContext(ctx, stmt); err != nil {
+				return applied, fmt.Errorf("migrate: Migration %d %s failed at statement %d: %w", mig.Version, mig.Name, i+1, err)
+			}
+		}
+		err := m.update(ctx, func(st *state) error {
+			if !st.lockedBy(owner) {
+				return errLockLost
+			}
+			st.Version = mig.Version
+			st.Migrations = append(st.Migrations, Applied{Version: mig.Version, Name: mig.Name,
+				Checksum: mig.Checksum, AppliedAt: time.Now().UTC()})
+			st.Lock.Expires = time.Now().Add(m.lockTimeout())
+			return nil
+		})
+		if err != nil {
+			return applied, fmt.Errorf("migrate: Migration %d %s applied but not recorded: %w", mig.Version, mig.Name, err)
+		}
+		applied = append(applied, mig)
+	}
+	return applied, nil
+}
+
+// The migrations to apply to a database in the given state, checking the
+// ones applied.
+func pendingMigrations(st *state, migrations []Migration) ([]Migration, error) {
+	applied := make(map[int64]Applied, len(st.Migrations))
+	for _, a := range st.Migrations {
+		applied[a.Version] = a
+	}
+
+	var pending []Migration
+	last := int64(-1)
+	for _, mig := range migrations {
+		if mig.Version <= last {
+			return nil, fmt.Errorf("migrate: Migration %d %s is out of order", mig.Version, mig.Name)
+		}
+		last = mig.Version
+		if a, ok := applied[mig.Version]; ok {
+			if a.Checksum != "" && mig.Checksum != "" && a.Checksum != mig.Checksum {
+				return nil, fmt.Errorf("%w: %d %s", ErrChecksum, mig.Version, mig.Name)
+			}
+			continue
+		}
+		if mig.Version <= st.Version {
+			return nil, fmt.Errorf("migrate: Migration %d %s is older than the version %d of the database", mig.Version, mig.Name, st.Version)
+		}
+		pending = append(pending, mig)
+	}
+	return pending, nil
+}
+
+// Read the version document, along with its CAS. A missing document is
+// the state of a database without migrations, and has no CAS.
+func (m *Migrator) read(ctx context.Context) (*state, string, error) {
+	rows, err := m.DB.QueryContext(ctx, "SELECT TOSTRING(META(m).cas) AS cas, m AS doc FROM "+m.Keyspace+" AS m USE KEYS ?", m.documentID())
+	if err != nil {
+		return nil, "", fmt.Errorf("migrate: Cannot read the version: %w", err)
+	}
+	defer rows.Close()
+
+	st := &state{}
+	var cas string
+	if rows.Next() {
+		var doc string
+		if err := rows.Scan(&cas, &doc); err != nil {
+			return nil, "", fmt.Errorf("migrate: Cannot read the version: %w", err)
+		}
+		if err := json.Unmarshal([]byte(doc), st); err != nil {
+			return nil, "", fmt.Errorf("migrate: Invalid version document: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("migrate: Cannot read the version: %w", err)
+	}
+	return st, cas, nil
+}
+
+// Change the version document from the version read: it is inserted if it
+// was missing, or else updated only if its CAS is unchanged, so that
+// concurrent changes conflict rather than overwrite each other.
+func (m *Migrator) update(ctx context.Context, change func(*state) error) error {
+	st, cas, err := m.read(ctx)
+	if err != nil {
+		return err
+	}
+	if err := change(st); err != nil {
+		return err
+	}
+
+	var res godbc.Result
+	if cas == "" {
+		var doc []byte
+		if doc, err = json.Marshal(st); err == nil {
+			res, err = m.DB.ExecContext(ctx, "INSERT INTO "+m.Keyspace+" (KEY, VALUE) VALUES (?, ?)", m.documentID(), doc)
+		}
+	} else {
+		var migrations, lock []byte
+		if migrations, err = json.Marshal(st.Migrations); err == nil {
+			lock, err = json.Marshal(st.Lock)
+		}
+		if err == nil {
+			res, err = m.DB.ExecContext(ctx, "UPDATE "+m.Keyspace+" AS m USE KEYS ? "+
+				"SET m.`version` = ?, m.`migrations` = ?, m.`lock` = ? WHERE TOSTRING(META(m).cas) = ?",
+				m.documentID(), st.Version, migrations, lock, cas)
+		}
+	}
+	if err != nil {
+		// an insert of a document created meanwhile fails, as does an
+		// update of one changed between its read and its write
+		if _, now, rerr := m.read(ctx); rerr == nil && now != cas {
+			return errConflict
+		}
+		return fmt.Errorf("migrate: Cannot update the version: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("migrate: Cannot update the version: %w", err)
+	} else if n == 0 {
+		return errConflict
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/godbc"
+	"github.com/couchbase/godbc/n1ql"
+)
+
+// A database holding the version document, running the other statements
+// by recording them.
+type fakeDB struct {
+	doc    []byte
+	cas    int
+	execs  []string
+	failOn string
+
+	// called before the version document is written
+	beforeWrite func()
+}
+
+type fakeResult struct {
+	n int64
+}
+
+func (fakeResult) LastInsertId() (int64, error)     { return 0, nil }
+func (res fakeResult) RowsAffected() (int64, error) { return res.n, nil }
+func (fakeResult) Rows() godbc.Rows                 { return nil }
+
+type fakeRows struct {
+	values [][]string
+	cur    int
+}
+
+func (rows *fakeRows) Close() error               { return nil }
+func (rows *fakeRows) Columns() ([]string, error) { return []string{"cas", "doc"}, nil }
+func (rows *fakeRows) Err() error                 { return nil }
+func (rows *fakeRows) Next() bool {
+	rows.cur++
+	return rows.cur <= len(rows.values)
+}
+func (rows *fakeRows) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		*d.(*string) = rows.values[rows.cur-1][i]
+	}
+	return nil
+}
+
+// The JSON of an argument, as the query service would take it.
+func jsonArg(arg interface{}) []byte {
+	if b, ok := arg.([]byte); ok {
+		return b
+	}
+	b, _ := json.Marshal(arg)
+	return b
+}
+
+func (db *fakeDB) Begin() (godbc.Tx, error) { return nil, errors.New("not supported") }
+func (db *fakeDB) Close() error             { return nil }
+func (db *fakeDB) Exec(query string, args ...interface{}) (godbc.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+func (db *fakeDB) ExecContext(ctx context.Context, query string, args ...interface{}) (godbc.Result, error) {
+	if len(args) > 0 && args[0] == "migrations" {
+		return db.write(query, args)
+	}
+	if db.failOn != "" && strings.Contains(query, db.failOn) {
+		return nil, errors.New("failed")
+	}
+	db.execs = append(db.execs, query)
+	return fakeResult{n: 1}, nil
+}
+
+// Insert or update the version document, as the statements of update do.
+func (db *fakeDB) write(query string, args []interface{}) (godbc.Result, error) {
+	if db.beforeWrite != nil {
+		db.beforeWrite()
+	}
+	switch {
+	case strings.HasPrefix(query, "INSERT"):
+		if db.doc != nil {
+			return nil, errors.New("Duplicate Key: migrations")
+		}
+		db.doc = jsonArg(args[1])
+	case strings.HasPrefix(query, "UPDATE"):
+		if db.doc == nil || args[4] != strconv.Itoa(db.cas) {
+			return fakeResult{}, nil
+		}
+		doc := map[string]json.RawMessage{}
+		json.Unmarshal(db.doc, &doc)
+		doc["version"], doc["migrations"], doc["lock"] = jsonArg(args[1]), jsonArg(args[2]), jsonArg(args[3])
+		db.doc, _ = json.Marshal(doc)
+	default:
+		return nil, errors.New("unexpected statement " + query)
+	}
+	db.cas++
+	return fakeResult{n: 1}, nil
+}
+
+func (db *fakeDB) Ping() error                              { return nil }
+func (db *fakeDB) PingContext(ctx context.Context) error    { return nil }
+func (db *fakeDB) Prepare(query string) (godbc.Stmt, error) { return nil, errors.New("not supported") }
+func (db *fakeDB) PrepareContext(ctx context.Context, query string) (godbc.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (db *fakeDB) Query(query string, args ...interface{}) (godbc.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+func (db *fakeDB) QueryContext(ctx context.Context, query string, args ...interface{}) (godbc.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if db.doc == nil {
+		return &fakeRows{}, nil
+	}
+	return &fakeRows{values: [][]string{{strconv.Itoa(db.cas), string(db.doc)}}}, nil
+}
+func (db *fakeDB) QueryRow(query string, args ...interface{}) godbc.Row { return nil }
+func (db *fakeDB) SetMaxIdleConns(n int)                                {}
+func (db *fakeDB) SetMaxOpenConns(n int)                                {}
+func (db *fakeDB) Stats() godbc.DBStats                                 { return nil }
+
+func (db *fakeDB) state(t *testing.T) *state {
+	st := &state{}
+	if err := json.Unmarshal(db.doc, st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestSplit(t *testing.T) {
+	script := `-- the orders
+CREATE COLLECTION app.s.orders IF NOT EXISTS;
+/* ; */ CREATE INDEX ix ON app.s.orders(` + "`a;b`" + `);
+
+UPDATE app.s.orders SET note = "x;\"y" WHERE note = 'a;b' -- trailing ;
+`
+	want := []string{
+		"CREATE COLLECTION app.s.orders IF NOT EXISTS",
+		"CREATE INDEX ix ON app.s.orders(`a;b`)",
+		`UPDATE app.s.orders SET note = "x;\"y" WHERE note = 'a;b'`,
+	}
+	if got := Split(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, source := range map[string]string{
+		"0010_index.n1ql":  "CREATE INDEX ix ON app(a);",
+		"0002_scope.sql":   "CREATE SCOPE app.s; CREATE COLLECTION app.s.c;",
+		"README.md":        "not a migration",
+		"0003_notes.n1ql~": "backup",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrations, err := ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 2 || migrations[0].Name != "scope" ||
+		len(migrations[0].Statements) != 2 || migrations[1].Version != 10 || migrations[1].Checksum == "" {
+		t.Errorf("Unexpected migrations %+v", migrations)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "10_again.n1ql"), nil, 0644)
+	if _, err := ReadDir(dir); err == nil {
+		t.Error("Expected two migrations of the same version to fail")
+	}
+}
+
+func TestUp(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{
+		New(1, "scope", "CREATE SCOPE app.s"),
+		New(2, "orders", "CREATE COLLECTION app.s.orders; CREATE INDEX ix ON app.s.orders(a)"),
+	}
+	db := &fakeDB{}
+	var log bytes.Buffer
+	m := &Migrator{DB: db, Keyspace: "app._default._default", Owner: "me", DryRun: true, Log: &log}
+
+	// dry run
+	pending, err := m.Up(ctx, migrations)
+	if err != nil || len(pending) != 2 || len(db.execs) != 0 || db.doc != nil {
+		t.Fatalf("Expected a dry run of 2 migrations, got %d, %v, %q", len(pending), err, db.execs)
+	}
+	if !strings.Contains(log.String(), "CREATE INDEX ix ON app.s.orders(a);") {
+		t.Errorf("Expected the statements to be logged, got %s", log.String())
+	}
+
+	m.DryRun = false
+	applied, err := m.Up(ctx, migrations[:1])
+	if err != nil || len(applied) != 1 || len(db.execs) != 1 {
+		t.Fatalf("Expected 1 migration applied, got %d, %v", len(applied), err)
+	}
+	applied, err = m.Up(ctx, migrations)
+	if err != nil || len(applied) != 1 || applied[0].Version != 2 || len(db.execs) != 3 {
+		t.Fatalf("Expected migration 2 applied, got %+v, %v", applied, err)
+	}
+	if st := db.state(t); st.Version != 2 || len(st.Migrations) != 2 || st.Lock != nil {
+		t.Errorf("Unexpected version document %s", db.doc)
+	}
+	if v, err := m.Version(ctx); v != 2 || err != nil {
+		t.Errorf("Expected version 2, got %d, %v", v, err)
+	}
+	if applied, err := m.Up(ctx, migrations); err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing to apply, got %d, %v", len(applied), err)
+	}
+
+	// changed after it was applied
+	changed := append([]Migration{New(1, "scope", "CREATE SCOPE app.t")}, migrations[1:]...)
+	if _, err := m.Up(ctx, changed); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected ErrChecksum, got %v", err)
+	}
+
+	// locked by another runner, until its lock expires
+	migrations = append(migrations, New(3, "backfill", "UPDATE app.s.orders SET b = a"))
+	other := &Migrator{DB: db, Keyspace: m.Keyspace, Owner: "other"}
+	st := db.state(t)
+	st.Lock = &lock{Owner: "other", Expires: time.Now().Add(time.Minute)}
+	db.doc, _ = json.Marshal(st)
+	if _, err := m.Up(ctx, migrations); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+	st.Lock.Expires = time.Now().Add(-time.Second)
+	db.doc, _ = json.Marshal(st)
+	if applied, err := m.Up(ctx, migrations); err != nil || len(applied) != 1 {
+		t.Errorf("Expected the expired lock to be taken over, got %d, %v", len(applied), err)
+	}
+
+	// a failed migration is not recorded, and the lock is released
+	migrations = append(migrations, New(4, "broken", "UPDATE app.s.orders SET c = oops"))
+	db.failOn = "oops"
+	if _, err := other.Up(ctx, migrations); err == nil || !strings.Contains(err.Error(), "Migration 4 broken failed at statement 1") {
+		t.Errorf("Expected migration 4 to fail, got %v", err)
+	}
+	if st := db.state(t); st.Version != 3 || st.Lock != nil {
+		t.Errorf("Unexpected version document %s", db.doc)
+	}
+}
+
+func TestUpConflict(t *testing.T) {
+	ctx := context.Background()
+	migrations := []Migration{New(1, "scope", "CREATE SCOPE app.s")}
+
+	// another runner takes the lock between the read and the write
+	for _, created := range []bool{false, true} {
+		db := &fakeDB{}
+		if created {
+			db.doc = []byte(`{"version":0,"migrations":null}`)
+		}
+		db.beforeWrite = func() {
+			db.beforeWrite = nil
+			db.doc = []byte(`{"version":0,"migrations":null,"lock":{"owner":"other","expires":"2100-01-01T00:00:00Z"}}`)
+			db.cas++
+		}
+		m := &Migrator{DB: db, Keyspace: "app._default._default", Owner: "me"}
+		if _, err := m.Up(ctx, migrations); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked, got %v", err)
+		}
+		if len(db.execs) != 0 {
+			t.Errorf("Expected nothing applied, got %q", db.execs)
+		}
+		if st := db.state(t); st.Lock == nil || st.Lock.Owner != "other" {
+			t.Errorf("Expected the lock of the other runner kept, got %s", db.doc)
+		}
+	}
+}
+
+// A query service running the statements of a Migrator on db, prepared or not.
+func newFakeQueryService(db *fakeDB) *httptest.Server {
+	var lock sync.Mutex
+	prepared := map[string]string{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/query/service" {
+			http.NotFound(w, r)
+			return
+		}
+		r.ParseForm()
+		lock.Lock()
+		defer lock.Unlock()
+
+		statement := r.PostForm.Get("statement")
+		if name := r.PostForm.Get("prepared"); name != "" {
+			var n string
+			json.Unmarshal([]byte(name), &n)
+			statement = prepared[n]
+		}
+		if strings.HasPrefix(statement, "PREPARE ") {
+			statement = strings.TrimPrefix(statement, "PREPARE ")
+			if strings.HasPrefix(statement, "`") {
+				statement = statement[strings.Index(statement, " FROM ")+len(" FROM "):]
+			}
+			name := fmt.Sprintf("p%d", len(prepared))
+			prepared[name] = statement
+			fmt.Fprintf(w, `{"results":[{"name":%q}],"status":"success"}`, name)
+			return
+		}
+		var args []interface{}
+		json.Unmarshal([]byte(r.PostForm.Get("args")), &args)
+
+		switch {
+		case strings.HasPrefix(statement, "SELECT RAW 1"):
+			w.Write([]byte(`{"results":[1],"status":"success"}`))
+		case strings.HasPrefix(statement, "SELECT"):
+			rows, _ := db.Query(statement, args...)
+			results := []map[string]interface{}{}
+			for rows.Next() {
+				var cas, doc string
+				rows.Scan(&cas, &doc)
+				results = append(results, map[string]interface{}{"cas": cas, "doc": json.RawMessage(doc)})
+			}
+			body, _ := json.Marshal(results)
+			fmt.Fprintf(w, `{"signature":{"cas":"string","doc":"json"},"results":%s,"status":"success"}`, body)
+		default:
+			res, err := db.Exec(statement, args...)
+			if err != nil {
+				fmt.Fprintf(w, `{"errors":[{"code":12009,"msg":%q}],"status":"fatal"}`, err.Error())
+				return
+			}
+			n, _ := res.RowsAffected()
+			fmt.Fprintf(w, `{"results":[],"metrics":{"mutationCount":%d},"status":"success"}`, n)
+		}
+	}))
+}
+
+func TestUpN1QL(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeDB{}
+	srv := newFakeQueryService(fake)
+	defer srv.Close()
+	db, err := n1ql.Open(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := []Migration{
+		New(1, "scope", "CREATE SCOPE app.s"),
+		New(2, "orders", "CREATE COLLECTION app.s.orders"),
+	}
+	m := &Migrator{DB: db, Keyspace: "app._default._default", Owner: "me"}
+	applied, err := m.Up(ctx, migrations)
+	if err != nil || len(applied) != 2 {
+		t.Fatalf("Expected 2 migrations applied, got %d, %v", len(applied), err)
+	}
+	if st := fake.state(t); st.Version != 2 || len(st.Migrations) != 2 || st.Lock != nil {
+		t.Errorf("Unexpected version document %s", fake.doc)
+	}
+	if len(fake.execs) != 2 || fake.execs[1] != "CREATE COLLECTION app.s.orders" {
+		t.Errorf("Unexpected statements %q", fake.execs)
+	}
+
+	// the lock of another runner is not overwritten
+	fake.beforeWrite = func() {
+		fake.beforeWrite = nil
+		fake.doc = []byte(`{"version":2,"migrations":null,"lock":{"owner":"other","expires":"2100-01-01T00:00:00Z"}}`)
+		fake.cas++
+	}
+	migrations = append(migrations, New(3, "backfill", "UPDATE app.s.orders SET b = a"))
+	if _, err := m.Up(ctx, migrations); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+	if st := fake.state(t); st.Lock == nil || st.Lock.Owner != "other" || len(fake.execs) != 2 {
+		t.Errorf("Expected the lock of the other runner kept, got %s", fake.doc)
+	}
+}
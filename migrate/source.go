@@ -0,0 +1,136 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A step of the schema, applied once and in the order of its version.
+type Migration struct {
+	Version    int64
+	Name       string
+	Statements []string
+
+	// of the source the statements were read from, to detect migrations
+	// edited after they were applied
+	Checksum string
+}
+
+// Make a migration of the statements of source, separated by semicolons.
+func New(version int64, name string, source string) Migration {
+	sum := sha256.Sum256([]byte(source))
+	return Migration{
+		Version:    version,
+		Name:       name,
+		Statements: Split(source),
+		Checksum:   hex.EncodeToString(sum[:]),
+	}
+}
+
+var fileName = regexp.MustCompile(`^([0-9]+)_(.+)\.(?:n1ql|sql)$`)
+
+// Read the migrations of the files of dir named VERSION_NAME.n1ql or
+// VERSION_NAME.sql, e.g. 0003_orders_by_date.n1ql, sorted by version.
+// Other files are ignored.
+func ReadDir(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+
+	var migrations []Migration
+	seen := make(map[int64]string)
+	for _, f := range files {
+		m := fileName.FindStringSubmatch(f.Name())
+		if f.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: Invalid version of %s: %w", f.Name(), err)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrate: %s and %s have the same version", other, f.Name())
+		}
+		seen[version] = f.Name()
+
+		source, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %w", err)
+		}
+		migrations = append(migrations, New(version, m[2], string(source)))
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Split a script into its statements, at the semicolons outside of string
+// literals, quoted identifiers and comments. Comments are dropped, and so
+// are empty statements.
+func Split(script string) []string {
+	var statements []string
+	var stmt strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(stmt.String()); s != "" {
+			statements = append(statements, s)
+		}
+		stmt.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == ';':
+			flush()
+		case c == '"' || c == '\'' || c == '`':
+			// up to the closing quote, skipping escaped ones
+			j := i + 1
+			for ; j < len(script) && script[j] != c; j++ {
+				if script[j] == '\\' && c != '`' {
+					j++
+				}
+			}
+			if j >= len(script) {
+				j = len(script) - 1
+			}
+			stmt.WriteString(script[i : j+1])
+			i = j
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			stmt.WriteByte(' ')
+			i += end
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script) - i - 2
+			}
+			stmt.WriteByte(' ')
+			i += end + 3
+		default:
+			stmt.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
@@ -0,0 +1,207 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Request running on a query node, as listed by its admin API.
+type ActiveRequest struct {
+	RequestID       string
+	ClientContextID string
+	Node            string // the query node running it, as QueryNodes lists it
+	Statement       string
+	PreparedName    string // for the requests executing a prepared statement
+	State           string // e.g. "running"
+	Users           string
+	RemoteAddr      string
+	UserAgent       string
+
+	// When the request was received, and the time it ran for until it was
+	// listed, executing its statement for ExecutionTime of it.
+	RequestTime   time.Time
+	ElapsedTime   time.Duration
+	ExecutionTime time.Duration
+
+	// The number of items each phase of the execution processed so far,
+	// e.g. "fetch" or "indexScan".
+	PhaseCounts map[string]int64
+
+	// The request exactly as listed by the server.
+	Raw json.RawMessage
+}
+
+// The request as listed by the admin API.
+type activeRequestJSON struct {
+	RequestID       string           `json:"requestId"`
+	ClientContextID string           `json:"clientContextID"`
+	Statement       string           `json:"statement"`
+	PreparedName    string           `json:"preparedName"`
+	State           string           `json:"state"`
+	Users           string           `json:"users"`
+	RemoteAddr      string           `json:"remoteAddr"`
+	UserAgent       string           `json:"userAgent"`
+	RequestTime     string           `json:"requestTime"`
+	ElapsedTime     string           `json:"elapsedTime"`
+	ExecutionTime   string           `json:"executionTime"`
+	PhaseCounts     map[string]int64 `json:"phaseCounts"`
+}
+
+// The request, listed by node, as raw.
+func (r *activeRequestJSON) request(node string, raw json.RawMessage) ActiveRequest {
+	request := ActiveRequest{
+		RequestID:       r.RequestID,
+		ClientContextID: r.ClientContextID,
+		Node:            node,
+		Statement:       r.Statement,
+		PreparedName:    r.PreparedName,
+		State:           r.State,
+		Users:           r.Users,
+		RemoteAddr:      r.RemoteAddr,
+		UserAgent:       r.UserAgent,
+		PhaseCounts:     r.PhaseCounts,
+		Raw:             raw,
+	}
+	for _, layout := range requestTimeLayouts {
+		if t, err := time.Parse(layout, r.RequestTime); err == nil {
+			request.RequestTime = t
+			break
+		}
+	}
+	request.ElapsedTime, _ = time.ParseDuration(r.ElapsedTime)
+	request.ExecutionTime, _ = time.ParseDuration(r.ExecutionTime)
+	return request
+}
+
+// Layouts of the request times, the first one being the one of the query
+// service.
+var requestTimeLayouts = []string{"2006-01-02 15:04:05.999999999 -0700 MST", time.RFC3339Nano}
+
+// List the requests running on the query nodes of the connection.
+func (db *n1qlDB) ActiveRequests(ctx context.Context) ([]ActiveRequest, error) {
+	if db.conn == nil {
+		return nil, errorNoConnection
+	}
+	var requests []ActiveRequest
+	for _, queryAPI := range db.conn.queryNodes() {
+		listed, err := db.conn.activeRequests(ctx, queryAPI)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, listed...)
+	}
+	return requests, nil
+}
+
+// Cancel the request with the given ID on the query node running it. Fails
+// if no node of the connection runs it, e.g. because it ended.
+func (db *n1qlDB) CancelRequest(ctx context.Context, requestID string) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	var lastErr error
+	for _, queryAPI := range db.conn.queryNodes() {
+		found, err := db.conn.cancelRequest(ctx, queryAPI, requestID)
+		if found {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf("N1QL: No active request %s", requestID)
+}
+
+// The query endpoints of the connection.
+func (conn *n1qlConn) queryNodes() []string {
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	return append([]string(nil), conn.queryAPIs...)
+}
+
+// The requests running on the node of queryAPI.
+func (conn *n1qlConn) activeRequests(ctx context.Context, queryAPI string) ([]ActiveRequest, error) {
+	resp, err := conn.adminRequest(ctx, "GET", queryAPI, "/admin/active_requests")
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("N1QL: Failed to list the active requests of %s: %w", stripurl(queryAPI), responseError(resp))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("N1QL: Failed to read response body from server. Error %w", err)
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(body, &raws); err != nil {
+		return nil, fmt.Errorf("N1QL: Failed to parse response. Error %w", err)
+	}
+	requests := make([]ActiveRequest, 0, len(raws))
+	for _, raw := range raws {
+		var r activeRequestJSON
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to parse response. Error %w", err)
+		}
+		requests = append(requests, r.request(stripurl(queryAPI), raw))
+	}
+	return requests, nil
+}
+
+// Cancel the request with the given ID on the node of queryAPI, telling
+// whether the node was running it.
+func (conn *n1qlConn) cancelRequest(ctx context.Context, queryAPI, requestID string) (bool, error) {
+	resp, err := conn.adminRequest(ctx, "DELETE", queryAPI, "/admin/active_requests/"+requestID)
+	if err != nil {
+		return false, err
+	}
+	defer drainAndClose(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("N1QL: Failed to cancel request %s on %s: %w", requestID, stripurl(queryAPI), responseError(resp))
+}
+
+// Send a request to the admin API of the node of queryAPI.
+func (conn *n1qlConn) adminRequest(ctx context.Context, method, queryAPI, path string) (*http.Response, error) {
+	u, err := url.Parse(queryAPI)
+	if err != nil {
+		return nil, fmt.Errorf("N1QL: Failed to parse URL. Error %w", err)
+	}
+	u.Path = path
+	u.RawPath = ""
+	u.RawQuery = ""
+	request, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating HTTP request: %w", err)
+	}
+	setCBUserAgent(request)
+	if err := conn.creds.setAuth(request); err != nil {
+		return nil, err
+	}
+	resp, err := conn.httpClient().Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("N1QL: Query node %s not responding: %w", stripurl(queryAPI), err)
+	}
+	return resp, nil
+}
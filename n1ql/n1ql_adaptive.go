@@ -0,0 +1,269 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// How many requests a connection has in flight to each query node, when the
+// limit adapts to the load of the node rather than being set once with
+// SetMaxInFlight. The limit of a node is cut by Backoff when the node
+// reports being overloaded: its request queue is full, it is unavailable or
+// a request timed out. It then grows by about one for every limit requests
+// answered no slower than Tolerance times the lowest latency of the node in
+// the last minute, so that it settles close to what the node sustains.
+type AdaptiveConcurrency struct {
+	// Limit of each node to start with, 16 if zero.
+	Initial int
+
+	// Bounds of the limits, 1 and 512 if zero.
+	Min int
+	Max int
+
+	// Factor the limit is multiplied by when the node is overloaded,
+	// between 0 and 1, 0.5 if zero.
+	Backoff float64
+
+	// How much slower than the lowest latency of the node requests can be
+	// answered for the limit to still grow, 2 if zero.
+	Tolerance float64
+}
+
+var adaptiveConcurrency *AdaptiveConcurrency
+
+// Adapt the number of requests each connection opened with Open from now
+// on has in flight to each query node, see AdaptiveConcurrency. Pass nil to
+// stop adapting it. The limits apply on top of the one of SetMaxInFlight.
+func SetAdaptiveConcurrency(cfg *AdaptiveConcurrency) {
+	adaptiveConcurrency = cfg
+}
+
+// How long the lowest latency of a node is remembered.
+const latencyBaselineTTL = time.Minute
+
+// The adaptive limits of the query nodes of a connection.
+type nodeLimiters struct {
+	cfg   AdaptiveConcurrency
+	lock  sync.Mutex
+	nodes map[string]*nodeLimiter
+}
+
+type nodeLimiter struct {
+	limit   float64
+	active  int
+	waiting []chan struct{}
+
+	// lowest latency lately, and when it was seen
+	baseline   time.Duration
+	baselineAt time.Time
+
+	// requests sent before the last decrease do not decrease it again
+	decreasedAt time.Time
+}
+
+// nil, which admits everything, if cfg is
+func newNodeLimiters(cfg *AdaptiveConcurrency) *nodeLimiters {
+	if cfg == nil {
+		return nil
+	}
+	l := &nodeLimiters{cfg: *cfg, nodes: make(map[string]*nodeLimiter)}
+	if l.cfg.Min <= 0 {
+		l.cfg.Min = 1
+	}
+	if l.cfg.Max <= 0 {
+		l.cfg.Max = 512
+	}
+	if l.cfg.Max < l.cfg.Min {
+		l.cfg.Max = l.cfg.Min
+	}
+	if l.cfg.Initial <= 0 {
+		l.cfg.Initial = 16
+	}
+	if l.cfg.Backoff <= 0 || l.cfg.Backoff >= 1 {
+		l.cfg.Backoff = 0.5
+	}
+	if l.cfg.Tolerance <= 0 {
+		l.cfg.Tolerance = 2
+	}
+	return l
+}
+
+// under lock
+func (l *nodeLimiters) node(queryAPI string) *nodeLimiter {
+	n, ok := l.nodes[queryAPI]
+	if !ok {
+		n = &nodeLimiter{limit: l.clamp(float64(l.cfg.Initial))}
+		l.nodes[queryAPI] = n
+	}
+	return n
+}
+
+func (l *nodeLimiters) clamp(limit float64) float64 {
+	if limit < float64(l.cfg.Min) {
+		return float64(l.cfg.Min)
+	}
+	if limit > float64(l.cfg.Max) {
+		return float64(l.cfg.Max)
+	}
+	return limit
+}
+
+func (n *nodeLimiter) full() bool {
+	return n.active >= int(n.limit)
+}
+
+// Whether the node has as many requests in flight as its limit allows.
+func (l *nodeLimiters) full(queryAPI string) bool {
+	if l == nil {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.node(queryAPI).full()
+}
+
+// Wait for a slot on the node, until ctx is done.
+func (l *nodeLimiters) acquire(ctx context.Context, queryAPI string) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	n := l.node(queryAPI)
+	if !n.full() && len(n.waiting) == 0 {
+		n.active++
+		l.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	n.waiting = append(n.waiting, ready)
+	l.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		select {
+		case <-ready:
+			// granted meanwhile: hand the slot over
+			n.active--
+			l.admit(n)
+		default:
+			for i, w := range n.waiting {
+				if w == ready {
+					n.waiting = append(n.waiting[:i], n.waiting[i+1:]...)
+					break
+				}
+			}
+		}
+		return fmt.Errorf("N1QL: Request aborted while waiting for query node %s: %w", stripurl(queryAPI), ctx.Err())
+	}
+}
+
+// Give the slot back, to the next waiting request if the limit allows.
+func (l *nodeLimiters) release(queryAPI string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	n := l.node(queryAPI)
+	n.active--
+	l.admit(n)
+}
+
+// under lock
+func (l *nodeLimiters) admit(n *nodeLimiter) {
+	for len(n.waiting) > 0 && !n.full() {
+		n.active++
+		close(n.waiting[0])
+		n.waiting = n.waiting[1:]
+	}
+}
+
+// Adapt the limit of the node to the outcome of a request sent at sent:
+// cut it if err tells the node is overloaded, grow it if the request
+// succeeded about as fast as the node can answer.
+func (l *nodeLimiters) done(queryAPI string, sent time.Time, err error) {
+	if l == nil || queryAPI == "" {
+		return
+	}
+	now := time.Now()
+	latency := now.Sub(sent)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	n := l.node(queryAPI)
+	switch {
+	case overloaded(err):
+		if sent.Before(n.decreasedAt) {
+			return // already accounted for
+		}
+		n.limit = l.clamp(n.limit * l.cfg.Backoff)
+		n.decreasedAt = now
+	case err == nil:
+		if n.baselineAt.IsZero() || latency < n.baseline || now.Sub(n.baselineAt) > latencyBaselineTTL {
+			n.baseline, n.baselineAt = latency, now
+		}
+		if float64(latency) <= float64(n.baseline)*l.cfg.Tolerance {
+			n.limit = l.clamp(n.limit + 1/n.limit)
+			l.admit(n)
+		}
+	}
+}
+
+// Whether err tells the query node is over its capacity.
+func overloaded(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrServiceUnavailable)
+}
+
+// The current limit of each query node the connection sent requests to.
+func (l *nodeLimiters) limits() map[string]int {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limits := make(map[string]int, len(l.nodes))
+	for queryAPI, n := range l.nodes {
+		limits[stripurl(queryAPI)] = int(n.limit)
+	}
+	return limits
+}
+
+// The node to send a request to instead of the one selected, if that one
+// has as many requests in flight as its adaptive limit allows and another
+// one has not.
+func (conn *n1qlConn) avoidFullNode(selectedNode int, queryAPI string) (int, string) {
+	if conn.nodeLimiters == nil || !conn.nodeLimiters.full(queryAPI) {
+		return selectedNode, queryAPI
+	}
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	for i, other := range conn.queryAPIs {
+		if i != selectedNode && !conn.nodeLimiters.full(other) {
+			return i, other
+		}
+	}
+	return selectedNode, queryAPI
+}
+
+// Adapt the limit of the node of a response to the outcome of its request.
+func (conn *n1qlConn) adaptLimit(body io.ReadCloser, err error) {
+	if rb, ok := body.(*responseBody); ok {
+		conn.nodeLimiters.done(rb.node, rb.sent, err)
+	}
+}
@@ -0,0 +1,83 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+
+	"github.com/couchbase/godbc"
+)
+
+// Send the statement run with Query or Exec in a single request, with its
+// arguments as parameters, rather than preparing it first, for one-off
+// statements whose plan would not be used again. Given to With, it applies
+// to all the statements of the handle.
+//
+//	rows, err := db.Query("SELECT * FROM orders WHERE id = ?", n1ql.AdHoc(true), id)
+func AdHoc(adHoc bool) QueryOption {
+	return func(opts *queryOptions) {
+		opts.adHoc = adHoc
+	}
+}
+
+// What Query and Exec run a statement with: the statement itself if the
+// request is ad-hoc, or else its prepared statement.
+type statementRunner interface {
+	QueryContext(ctx context.Context, args ...interface{}) (godbc.Rows, error)
+	ExecContext(ctx context.Context, args ...interface{}) (godbc.Result, error)
+}
+
+func (db *n1qlDB) statement(ctx context.Context, query string, args []interface{}) (statementRunner, error) {
+	if db.conn == nil {
+		return nil, errorNoConnection
+	}
+	opts, _ := splitQueryOptions(withDefaultOptions(db.defaults, args))
+	if opts != nil && opts.adHoc {
+		return &adHocStmt{db: db, query: query}, nil
+	}
+	stmt, err := db.cachedPrepare(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// A statement sent as is.
+type adHocStmt struct {
+	db    *n1qlDB
+	query string
+}
+
+func (s *adHocStmt) QueryContext(ctx context.Context, args ...interface{}) (godbc.Rows, error) {
+	query, opts := s.request(args)
+	return s.db.conn.performQuery(ctx, query, nil, opts)
+}
+
+func (s *adHocStmt) ExecContext(ctx context.Context, args ...interface{}) (godbc.Result, error) {
+	query, opts := s.request(args)
+	return s.db.conn.performExec(ctx, query, nil, opts)
+}
+
+// The statement, its ? placeholders numbered, and the options of the
+// request, carrying the positional arguments.
+func (s *adHocStmt) request(args []interface{}) (string, *queryOptions) {
+	opts, args := splitQueryOptions(withDefaultOptions(s.db.defaults, args))
+	query := s.query
+	if len(args) > 0 {
+		query, _ = prepareQuery(query)
+		list, err := s.db.conn.encodeArgs(args)
+		if err != nil {
+			opts.err = err
+		} else {
+			opts.setParam("args", list)
+		}
+	}
+	return query, opts
+}
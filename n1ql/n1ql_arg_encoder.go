@@ -0,0 +1,87 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"fmt"
+)
+
+// Encodes the arguments of the requests of a connection, see
+// Options.ArgEncoder, e.g. to send dates or binary values in an extended
+// JSON form. JSONArgs is the default.
+type ArgEncoder interface {
+	// The value of the args parameter for positional arguments, of which
+	// there is at least one.
+	EncodeArgs(args []interface{}) (string, error)
+
+	// The value of a named parameter.
+	EncodeArg(arg interface{}) (string, error)
+}
+
+// Encodes arguments as JSON. Strings are sent as JSON strings and []byte as
+// the JSON they hold; maps, slices, arrays and structs, and the values
+// implementing json.Marshaler, are marshaled to JSON. Times are sent as set
+// with SetTimeArgsAsEpochMillis.
+var JSONArgs ArgEncoder = jsonArgs{}
+
+type jsonArgs struct{}
+
+func (jsonArgs) EncodeArgs(args []interface{}) (string, error) {
+	return buildPositionalArgList(args)
+}
+
+func (jsonArgs) EncodeArg(arg interface{}) (string, error) {
+	return encodeArg(arg)
+}
+
+// Encoder of the arguments of the connections opened from now on, see
+// Options.ArgEncoder.
+var argEncoder = JSONArgs
+
+// Encode the arguments of the connections opened from now on with encoder,
+// JSONArgs if nil, see Options.ArgEncoder.
+func SetArgEncoder(encoder ArgEncoder) {
+	if encoder == nil {
+		encoder = JSONArgs
+	}
+	argEncoder = encoder
+}
+
+// The encoder of the arguments of the connection.
+func (conn *n1qlConn) encoder() ArgEncoder {
+	if conn.argEncoder == nil {
+		return JSONArgs
+	}
+	return conn.argEncoder
+}
+
+// The value of the args parameter, "" if there are no arguments.
+func (conn *n1qlConn) encodeArgs(args []interface{}) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	return conn.encoder().EncodeArgs(args)
+}
+
+// Set the parameters of the named arguments of the request, encoded by the
+// encoder of the connection.
+func (conn *n1qlConn) bindNamed(opts *queryOptions) error {
+	if opts == nil {
+		return nil
+	}
+	for key, value := range opts.named {
+		encoded, err := conn.encoder().EncodeArg(value)
+		if err != nil {
+			return fmt.Errorf("N1QL: Cannot encode argument %s: %w", key, err)
+		}
+		opts.setParam(key, encoded)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package n1ql
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends times as {"$date": millis}, the other arguments as JSON.
+type extendedJSON struct{}
+
+func (e extendedJSON) EncodeArgs(args []interface{}) (string, error) {
+	encoded := make([]string, len(args))
+	for i, arg := range args {
+		s, err := e.EncodeArg(arg)
+		if err != nil {
+			return "", err
+		}
+		encoded[i] = s
+	}
+	return "[" + strings.Join(encoded, ",") + "]", nil
+}
+
+func (extendedJSON) EncodeArg(arg interface{}) (string, error) {
+	if t, ok := arg.(time.Time); ok {
+		return `{"$date":` + strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) + `}`, nil
+	}
+	return JSONArgs.EncodeArg(arg)
+}
+
+func TestArgEncoder(t *testing.T) {
+	forms := make(chan string, 10)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		if statement := r.PostForm.Get("statement"); statement != "" {
+			forms <- statement
+		}
+		forms <- r.PostForm.Get("args") + " " + r.PostForm.Get("$at")
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.argEncoder = extendedJSON{}
+
+	at := time.Unix(1500000000, 0).UTC()
+	stmt, err := conn.Prepare("UPDATE default SET a = ?, at = $at")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+	if _, err := stmt.Exec("x", Named("at", at)); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if f := <-forms; f != `["x"] {"$date":1500000000000}` {
+		t.Errorf("Expected the arguments from the encoder of the connection, got %s", f)
+	}
+
+	conn.argEncoder = nil
+	if _, err := stmt.Exec(at, Named("at", "now")); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if f := <-forms; f != `["2017-07-14T02:40:00Z"] "now"` {
+		t.Errorf("Expected JSON arguments, got %s", f)
+	}
+
+	// the statements run without preparing them send their arguments as
+	// parameters too, rather than in their text
+	conn.argEncoder = extendedJSON{}
+	if _, err := conn.Exec("UPDATE default SET a = ?, b = ?, at = ?", `x" OR "1"="1`, map[string]int{"c": 1}, at); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if f := <-forms; f != "UPDATE default SET a = $1, b = $2, at = $3" {
+		t.Errorf("Expected the statement with numbered parameters, got %s", f)
+	}
+	if f := <-forms; f != `["x\" OR \"1\"=\"1",{"c":1},{"$date":1500000000000}] ` {
+		t.Errorf("Expected the arguments from the encoder of the connection, got %s", f)
+	}
+}
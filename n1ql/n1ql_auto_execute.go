@@ -0,0 +1,77 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/couchbase/godbc"
+)
+
+func (db *n1qlDB) PrepareAndQuery(query string, args ...interface{}) (N1qlStmt, godbc.Rows, error) {
+	stmt, statement, opts, err := db.autoExecute(query, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := db.conn.performQuery(context.Background(), statement, nil, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	trackStmt(stmt)
+	return stmt, rows, nil
+}
+
+func (db *n1qlDB) PrepareAndExec(query string, args ...interface{}) (N1qlStmt, godbc.Result, error) {
+	stmt, statement, opts, err := db.autoExecute(query, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := db.conn.performExec(context.Background(), statement, nil, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	trackStmt(stmt)
+	return stmt, res, nil
+}
+
+// The statement preparing query under a name of its own and running it
+// with args, with auto_execute, and the statement to run it again by name.
+func (db *n1qlDB) autoExecute(query string, args []interface{}) (*n1qlStmt, string, *queryOptions, error) {
+	if db.conn == nil {
+		return nil, "", nil, errorNoConnection
+	}
+	name := db.conn.nextPreparedName()
+	if name == "" {
+		var err error
+		if name, err = newUUID(); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	opts, args := splitQueryOptions(withDefaultOptions(db.defaults, args))
+	if opts == nil {
+		opts = &queryOptions{}
+	}
+	query, argCount := prepareQuery(query)
+	if len(args) > 0 {
+		list, err := db.conn.encodeArgs(args)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		opts.setParam("args", list)
+	}
+	opts.setParam("auto_execute", "true")
+
+	// the plan is not returned: the name stands for it
+	stmt := &n1qlStmt{conn: db.conn, prepared: strconv.Quote(name), argCount: argCount,
+		maxArgs: highestPositional(query), keyspaces: statementKeyspaces(query), name: name,
+		planName: name, defaults: db.defaults, statement: query}
+	return stmt, "PREPARE " + quoteIdentifier(name) + " FROM " + query, opts, nil
+}
@@ -0,0 +1,369 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errClusterUnauthorized = errors.New("Unauthorized")
+
+// Kinds of BootstrapError, to test with errors.Is.
+var (
+	ErrUnreachable    = errors.New("N1QL: Endpoint unreachable")
+	ErrTLSHandshake   = errors.New("N1QL: TLS handshake failed")
+	ErrUnauthorized   = errors.New("N1QL: Unauthorized")
+	ErrNoQueryService = errors.New("N1QL: No query service")
+)
+
+// Error returned by Open when it cannot reach the cluster or its query
+// nodes. errors.Is matches its Kind, which is ErrUnreachable,
+// ErrTLSHandshake, ErrNoQueryService or ErrUnauthorized, which also
+// matches ErrAuth, and it unwraps to the error that caused it, if any.
+// Invalid arguments to Open are reported with plain errors.
+type BootstrapError struct {
+	Kind     error
+	Endpoint string // stripped of its credentials
+
+	msg   string
+	cause error
+}
+
+func (e *BootstrapError) Error() string {
+	return e.msg
+}
+
+func (e *BootstrapError) Unwrap() error {
+	return e.cause
+}
+
+func (e *BootstrapError) Is(target error) bool {
+	return target == e.Kind || target == ErrAuth && e.Kind == ErrUnauthorized
+}
+
+// The message must not carry the credentials in the URLs
+func newBootstrapError(kind error, endpoint string, cause error, msg string) *BootstrapError {
+	return &BootstrapError{Kind: kind, Endpoint: stripurl(endpoint), msg: msg, cause: cause}
+}
+
+// The kind of a failed request to the cluster or a query node
+func bootstrapErrorKind(err error) error {
+	var hostErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, errClusterUnauthorized):
+		return ErrUnauthorized
+	case errors.As(err, &hostErr), errors.As(err, &authorityErr), errors.As(err, &certErr),
+		errors.As(err, &recordErr), strings.Contains(err.Error(), "tls: "):
+		return ErrTLSHandshake
+	}
+	return ErrUnreachable
+}
+
+// Subset of /pools/default/nodeServices used to discover the query nodes.
+type poolServices struct {
+	Rev      int            `json:"rev"`
+	NodesExt []nodeServices `json:"nodesExt"`
+}
+
+type nodeServices struct {
+	Services       map[string]int                `json:"services"`
+	Hostname       string                        `json:"hostname"`
+	ThisNode       bool                          `json:"thisNode"`
+	AlternateNames map[string]nodeAlternateNames `json:"alternateAddresses"`
+}
+
+type nodeAlternateNames struct {
+	Hostname string         `json:"hostname"`
+	Ports    map[string]int `json:"ports"`
+}
+
+// Talks to the cluster manager REST API, to find the nodes running the
+// query and analytics services.
+type bootstrapClient struct {
+	baseURL   *url.URL
+	client    *http.Client
+	userAgent string
+	creds     *credentials
+	timeouts  bootstrapTimeouts
+}
+
+// Check that name is a cluster manager endpoint we are allowed to use.
+func connectCluster(name string, userAgent string, client *http.Client, creds *credentials, timeouts bootstrapTimeouts) (*bootstrapClient, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("N1QL: Failed to parse URL. Error %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("N1QL: Unsupported URL scheme %q", u.Scheme)
+	}
+
+	bc := &bootstrapClient{client: client, userAgent: userAgent, creds: creds, timeouts: timeouts}
+	u.Path = ""
+	bc.baseURL = u
+
+	var pools map[string]interface{}
+	if err := bc.get("/pools", &pools, bc.timeouts.connect); err != nil {
+		return nil, err
+	}
+	if _, ok := pools["implementationVersion"]; !ok {
+		return nil, fmt.Errorf("N1QL: %s is not a cluster manager endpoint", u)
+	}
+	return bc, nil
+}
+
+func (bc *bootstrapClient) getPoolServices(pool string) (poolServices, error) {
+	var ps poolServices
+	err := bc.get("/pools/"+pool+"/nodeServices", &ps, bc.timeouts.discovery)
+	return ps, err
+}
+
+// GET path and decode the response into v, all within timeout if it is set.
+func (bc *bootstrapClient) get(path string, v interface{}, timeout time.Duration) error {
+	u := *bc.baseURL
+	u.Path = path
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("Error creating HTTP request: %w", err)
+	}
+	setCBUserAgent(request)
+	if bc.userAgent != "" {
+		request.Header.Set("User-Agent", bc.userAgent)
+	}
+	if err := bc.creds.setAuth(request); err != nil {
+		return err
+	}
+
+	resp, err := bc.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("HTTP client request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("N1QL: %w access to %s", errClusterUnauthorized, u.String())
+	}
+	if resp.StatusCode != http.StatusOK {
+		bod, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP error %v getting %s: %s", resp.Status, u.String(), bod)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("N1QL: Failed to parse response: %w", err)
+	}
+	return nil
+}
+
+// Map couchbase:// and couchbases:// connection strings to the cluster
+// manager endpoint they stand for.
+func clusterURL(name string) string {
+	scheme := ""
+	port := ""
+	if strings.HasPrefix(name, "couchbase://") {
+		scheme, port = "http://", "8091"
+	} else if strings.HasPrefix(name, "couchbases://") {
+		scheme, port = "https://", "18091"
+	} else {
+		return name
+	}
+
+	u, err := url.Parse(name)
+	if err != nil {
+		return name
+	}
+	u.Scheme = strings.TrimSuffix(scheme, "://")
+	if u.Port() == "" {
+		host := u.Hostname()
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u.Host = host + ":" + port
+	}
+	return u.String()
+}
+
+// Build the TLS configuration for the given CA and client certificates.
+// The private key may be encrypted with the legacy PEM encryption.
+func clientTLSConfig(caFile, certFile, keyFile string, passphrase []byte) (*tls.Config, error) {
+	cfg := &tls.Config{ClientSessionCache: tlsSessionCache()}
+
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("N1QL: No certificates found in CA file %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" && keyFile != "" {
+		certPEM, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to read certificate file: %w", err)
+		}
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to read key file: %w", err)
+		}
+		if len(passphrase) > 0 {
+			keyPEM, err = decryptPrivateKey(keyPEM, passphrase)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func decryptPrivateKey(keyPEM []byte, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("N1QL: No private key found in key file")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("N1QL: Encrypted PKCS#8 private keys are not supported")
+	}
+	if !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("N1QL: Failed to decrypt private key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+// Version of the driver, as recorded in the build.
+func driverVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == "github.com/couchbase/godbc" && bi.Main.Version != "" {
+			return bi.Main.Version
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/couchbase/godbc" {
+				return dep.Version
+			}
+		}
+	}
+	return "devel"
+}
+
+// Outcome of the ping of a query node at Open, in strict open mode.
+type NodeReadiness struct {
+	Endpoint string
+	Latency  time.Duration
+	Err      error // nil if the node answered
+}
+
+func (n NodeReadiness) Ready() bool {
+	return n.Err == nil
+}
+
+func (n NodeReadiness) String() string {
+	if n.Err != nil {
+		return fmt.Sprintf("%s: %v", n.Endpoint, n.Err)
+	}
+	return fmt.Sprintf("%s: ready in %v", n.Endpoint, n.Latency)
+}
+
+// Ping all the query nodes at once, within the handshake timeout.
+func pingNodes(conn *n1qlConn, userAgent string) []NodeReadiness {
+	readiness := make([]NodeReadiness, len(conn.queryAPIs))
+	var wg sync.WaitGroup
+	for i, queryAPI := range conn.queryAPIs {
+		wg.Add(1)
+		go func(i int, queryAPI string) {
+			defer wg.Done()
+			readiness[i] = pingNode(conn, queryAPI, userAgent)
+		}(i, queryAPI)
+	}
+	wg.Wait()
+	return readiness
+}
+
+func pingNode(conn *n1qlConn, queryAPI string, userAgent string) NodeReadiness {
+	n := NodeReadiness{Endpoint: stripurl(queryAPI)}
+
+	txParams := map[string]string{"txid": "", "tximplicit": ""}
+	request, err := conn.prepareRequest(conn.pingStatement(), queryAPI, nil, txParams)
+	if err != nil {
+		n.Err = err
+		return n
+	}
+	if userAgent != "" {
+		request.Header.Set("User-Agent", userAgent)
+	}
+	if conn.handshakeTimeout > 0 {
+		ctx, cancel := context.WithTimeout(request.Context(), conn.handshakeTimeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+	}
+
+	start := time.Now()
+	resp, err := conn.httpClient().Do(request)
+	n.Latency = time.Since(start)
+	if err != nil {
+		n.Err = err
+		return n
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		n.Err = fmt.Errorf("HTTP status %v", resp.Status)
+	}
+	return n
+}
+
+// Fail unless enough of the pinged nodes are ready.
+func checkReadiness(readiness []NodeReadiness, required int) error {
+	ready := 0
+	summary := make([]string, 0, len(readiness))
+	for _, n := range readiness {
+		if n.Ready() {
+			ready++
+		}
+		summary = append(summary, n.String())
+	}
+	if ready < required {
+		return newBootstrapError(ErrUnreachable, "", nil, fmt.Sprintf("N1QL: %d of %d query nodes ready, %d required: %s",
+			ready, len(readiness), required, strings.Join(summary, "; ")))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// How long the driver waits for a query node to cancel a request whose
+// context is done.
+var ServerCancelTimeout = 5 * time.Second
+
+// Cancel the request of body on the node executing it once ctx is done, if
+// its response has not been received by then: the query service does not
+// stop executing a request when its connection is closed. Requests are
+// canceled through the admin API of the node, as their request ID tells,
+// so this is only done once the response has started.
+func (conn *n1qlConn) cancelOnDone(ctx context.Context, body io.ReadCloser, requestID string) {
+	rb, ok := body.(*responseBody)
+	if !ok || requestID == "" || ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-rb.done:
+		}
+		if ctx.Err() != nil && !rb.received() {
+			ctx, cancel := context.WithTimeout(context.Background(), ServerCancelTimeout)
+			defer cancel()
+			if _, err := conn.cancelRequest(ctx, rb.node, requestID); err != nil {
+				logger.Printf("%v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,200 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/godbc"
+)
+
+// User defined function, as listed in system:functions. Bucket and Scope
+// are empty for global functions.
+type Function struct {
+	Name       string
+	Namespace  string
+	Bucket     string
+	Scope      string
+	Language   string // "inline" or "javascript"
+	Parameters []string
+}
+
+// Sequence, as listed in system:sequences.
+type Sequence struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Bucket    string `json:"bucket"`
+	Scope     string `json:"scope"`
+	Path      string `json:"path"`
+	Increment int64  `json:"increment"`
+	Min       int64  `json:"min"`
+	Max       int64  `json:"max"`
+	Cache     int64  `json:"cache"`
+	Cycle     bool   `json:"cycle"`
+}
+
+// List the functions of the scope, or the global functions if bucket and
+// scope are empty.
+func (db *n1qlDB) Functions(ctx context.Context, bucket, scope string) ([]Function, error) {
+	query := "SELECT RAW f FROM system:functions AS f WHERE f.identity.`type` = \"global\""
+	var args []interface{}
+	if bucket != "" || scope != "" {
+		query = "SELECT RAW f FROM system:functions AS f " +
+			"WHERE f.identity.`bucket` = $1 AND f.identity.`scope` = $2"
+		args = []interface{}{bucket, scope}
+	}
+	var entries []struct {
+		Definition struct {
+			Language   string   `json:"#language"`
+			Parameters []string `json:"parameters"`
+		} `json:"definition"`
+		Identity struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			Bucket    string `json:"bucket"`
+			Scope     string `json:"scope"`
+		} `json:"identity"`
+	}
+	if err := db.catalogQuery(ctx, query+" ORDER BY f.identity.name", args, &entries); err != nil {
+		return nil, err
+	}
+	functions := make([]Function, 0, len(entries))
+	for _, e := range entries {
+		functions = append(functions, Function{
+			Name:       e.Identity.Name,
+			Namespace:  e.Identity.Namespace,
+			Bucket:     e.Identity.Bucket,
+			Scope:      e.Identity.Scope,
+			Language:   e.Definition.Language,
+			Parameters: e.Definition.Parameters,
+		})
+	}
+	return functions, nil
+}
+
+// Execute the function of the scope, or the global function if bucket and
+// scope are empty, with the given arguments. Query options may be mixed
+// with them.
+func (db *n1qlDB) ExecuteFunction(ctx context.Context, bucket, scope, name string, args ...interface{}) (godbc.Rows, error) {
+	if db.conn == nil {
+		return nil, errorNoConnection
+	}
+	path, err := catalogPath(bucket, scope, name)
+	if err != nil {
+		return nil, err
+	}
+	opts, args := splitQueryOptions(withDefaultOptions(db.defaults, args))
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	values, err := buildPostData("EXECUTE FUNCTION "+path+"("+placeholders+")", args, db.conn.encoder(), db.conn.queryParams(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return db.conn.performQuery(ctx, "", &values, opts)
+}
+
+// List the sequences of the scope.
+func (db *n1qlDB) Sequences(ctx context.Context, bucket, scope string) ([]Sequence, error) {
+	var sequences []Sequence
+	err := db.catalogQuery(ctx, "SELECT RAW s FROM system:sequences AS s "+
+		"WHERE s.`bucket` = $1 AND s.`scope` = $2 ORDER BY s.name", []interface{}{bucket, scope}, &sequences)
+	return sequences, err
+}
+
+// Advance the sequence and return its new value.
+func (db *n1qlDB) NextSequenceValue(ctx context.Context, bucket, scope, name string) (int64, error) {
+	return db.sequenceValue(ctx, "NEXTVAL", bucket, scope, name)
+}
+
+// Return the value the sequence last returned to this connection, without
+// advancing it.
+func (db *n1qlDB) PrevSequenceValue(ctx context.Context, bucket, scope, name string) (int64, error) {
+	return db.sequenceValue(ctx, "PREVVAL", bucket, scope, name)
+}
+
+func (db *n1qlDB) sequenceValue(ctx context.Context, op, bucket, scope, name string) (int64, error) {
+	if bucket == "" || scope == "" {
+		return 0, fmt.Errorf("N1QL: Sequences belong to a bucket and a scope")
+	}
+	path, err := catalogPath(bucket, scope, name)
+	if err != nil {
+		return 0, err
+	}
+	var values []int64
+	if err := db.catalogQuery(ctx, "SELECT RAW "+op+" FOR "+path, nil, &values); err != nil {
+		return 0, err
+	}
+	if len(values) != 1 {
+		return 0, fmt.Errorf("N1QL: No value returned for sequence %s", path)
+	}
+	return values[0], nil
+}
+
+// The escaped path of a scoped object, or of a global one if bucket and
+// scope are empty.
+func catalogPath(bucket, scope, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("N1QL: Name not specified")
+	}
+	if bucket == "" && scope == "" {
+		return quoteIdentifier(name), nil
+	}
+	if bucket == "" || scope == "" {
+		return "", fmt.Errorf("N1QL: Both bucket and scope must be specified")
+	}
+	return quoteIdentifier(bucket) + "." + quoteIdentifier(scope) + "." + quoteIdentifier(name), nil
+}
+
+// Escape an identifier, doubling the back quotes it contains.
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Run a catalog statement, not prepared, and decode its results, keeping
+// the precision of integers.
+func (db *n1qlDB) catalogQuery(ctx context.Context, query string, args []interface{}, results interface{}) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	opts, _ := splitQueryOptions(withDefaultOptions(db.defaults, nil))
+	values, err := buildPostData(query, args, db.conn.encoder(), db.conn.queryParams(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := db.conn.doClientRequest(ctx, "", &values, opts)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var response struct {
+		Results json.RawMessage `json:"results"`
+		Errors  interface{}     `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("N1QL: Failed to decode result %w", err)
+	}
+	if response.Errors != nil {
+		return executionError(response.Errors)
+	}
+	if len(response.Results) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(response.Results, results); err != nil {
+		return fmt.Errorf("N1QL: Failed to decode result %w", err)
+	}
+	return nil
+}
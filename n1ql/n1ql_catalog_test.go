@@ -0,0 +1,121 @@
+package n1ql
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatalogHelpers(t *testing.T) {
+	var statements, args []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		statements = append(statements, statement)
+		args = append(args, r.PostForm.Get("args"))
+		switch {
+		case strings.Contains(statement, "system:functions"):
+			w.Write([]byte(`{"results":[{"definition":{"#language":"inline","parameters":["a","b"],"expression":"a + b"},` +
+				`"identity":{"bucket":"travel","name":"add","namespace":"default","scope":"inv","type":"scope"}}],"status":"success"}`))
+		case strings.HasPrefix(statement, "EXECUTE FUNCTION"):
+			w.Write([]byte(`{"signature":{"*":"*"},"results":[3],"status":"success"}`))
+		case strings.Contains(statement, "system:sequences"):
+			w.Write([]byte(`{"results":[{"bucket":"travel","cache":50,"cycle":false,"increment":1,` +
+				`"max":9223372036854775807,"min":-9223372036854775808,"name":"ids","namespace":"default",` +
+				`"path":"default:travel.inv.ids","scope":"inv"}],"status":"success"}`))
+		case strings.Contains(statement, "NEXTVAL"):
+			w.Write([]byte(`{"results":[9007199254740993],"status":"success"}`))
+		default:
+			w.Write([]byte(`{"errors":[{"code":12029,"msg":"Sequence not found"}],"status":"fatal"}`))
+		}
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+	ctx := context.Background()
+
+	functions, err := db.Functions(ctx, "travel", "inv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(functions) != 1 || functions[0].Name != "add" || functions[0].Language != "inline" ||
+		len(functions[0].Parameters) != 2 || args[0] != `["travel","inv"]` {
+		t.Errorf("Unexpected functions %+v for args %s", functions, args[0])
+	}
+
+	rows, err := db.ExecuteFunction(ctx, "travel", "inv", "add", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if statements[1] != "EXECUTE FUNCTION `travel`.`inv`.`add`(?, ?)" || args[1] != "[1,2]" {
+		t.Errorf("Unexpected statement %s with args %s", statements[1], args[1])
+	}
+
+	sequences, err := db.Sequences(ctx, "travel", "inv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sequences) != 1 || sequences[0].Name != "ids" || sequences[0].Max != 9223372036854775807 || sequences[0].Cache != 50 {
+		t.Errorf("Unexpected sequences %+v", sequences)
+	}
+
+	// integers keep their precision
+	next, err := db.NextSequenceValue(ctx, "travel", "inv", "ids")
+	if err != nil || next != 9007199254740993 {
+		t.Errorf("Expected 9007199254740993, got %d, %v", next, err)
+	}
+	if statements[3] != "SELECT RAW NEXTVAL FOR `travel`.`inv`.`ids`" {
+		t.Errorf("Unexpected statement %s", statements[3])
+	}
+
+	if _, err := db.PrevSequenceValue(ctx, "travel", "inv", "n`o"); err == nil || !strings.Contains(err.Error(), "Sequence not found") {
+		t.Errorf("Expected the server error, got %v", err)
+	}
+	if statements[4] != "SELECT RAW PREVVAL FOR `travel`.`inv`.`n``o`" {
+		t.Errorf("Expected the name to be escaped, got %s", statements[4])
+	}
+}
+
+func TestCompletedRequests(t *testing.T) {
+	var statement, args string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement, args = r.PostForm.Get("statement"), r.PostForm.Get("args")
+		w.Write([]byte(`{"results":[{"requestId":"r1","clientContextID":"c1","node":"10.0.0.1:8091",` +
+			`"statement":"SELECT * FROM orders","state":"completed","requestTime":"2026-10-16 12:00:00 +0000 UTC",` +
+			`"elapsedTime":"6.5s","executionTime":"6.4s","resultCount":3,"resultSize":120,"errorCount":0}],` +
+			`"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	since := time.Date(2026, 10, 16, 11, 0, 0, 0, time.UTC)
+	requests, err := db.CompletedRequests(context.Background(), CompletedRequestsFilter{
+		MinElapsedTime: 5 * time.Second, Statement: "SELECT % FROM orders%", Since: since, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "SELECT RAW r FROM system:completed_requests AS r WHERE STR_TO_DURATION(r.elapsedTime) >= $1 " +
+		"AND r.statement LIKE $2 AND STR_TO_MILLIS(r.requestTime) >= $3 " +
+		"ORDER BY STR_TO_MILLIS(r.requestTime) DESC LIMIT 10"
+	if statement != expected || args != `[5000000000,"SELECT % FROM orders%",1792148400000]` {
+		t.Errorf("Unexpected statement %s with args %s", statement, args)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %+v", requests)
+	}
+	r := requests[0]
+	if r.RequestID != "r1" || r.Node != "10.0.0.1:8091" || r.ElapsedTime != 6500*time.Millisecond ||
+		r.ResultCount != 3 || r.ResultSize != 120 || !r.RequestTime.Equal(since.Add(time.Hour)) {
+		t.Errorf("Unexpected request %+v", r)
+	}
+
+	if _, err := db.CompletedRequests(context.Background(), CompletedRequestsFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if statement != "SELECT RAW r FROM system:completed_requests AS r ORDER BY STR_TO_MILLIS(r.requestTime) DESC" {
+		t.Errorf("Unexpected statement %s", statement)
+	}
+}
@@ -0,0 +1,191 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values accepted by a query parameter
+type cbqKind int
+
+const (
+	cbqString cbqKind = iota
+	cbqBool
+	cbqInt
+	cbqDuration
+	cbqJSON
+	cbqArray
+	cbqCreds
+)
+
+// Query parameters that can be set from the cbq shell, by REST name
+var cbqParams = map[string]cbqKind{
+	"args":              cbqArray,
+	"atrcollection":     cbqString,
+	"auto_execute":      cbqBool,
+	"client_context_id": cbqString,
+	"controls":          cbqBool,
+	"creds":             cbqCreds,
+	"durability_level":  cbqString,
+	"encoded_plan":      cbqString,
+	"kvtimeout":         cbqDuration,
+	"max_parallelism":   cbqInt,
+	"memory_quota":      cbqInt,
+	"metrics":           cbqBool,
+	"namespace":         cbqString,
+	"numatrs":           cbqInt,
+	"pipeline_batch":    cbqInt,
+	"pipeline_cap":      cbqInt,
+	"preserve_expiry":   cbqBool,
+	"pretty":            cbqBool,
+	"profile":           cbqString,
+	"query_context":     cbqString,
+	"readonly":          cbqBool,
+	"scan_cap":          cbqInt,
+	"scan_consistency":  cbqString,
+	"scan_vector":       cbqJSON,
+	"scan_vectors":      cbqJSON,
+	"scan_wait":         cbqDuration,
+	"signature":         cbqBool,
+	"timeout":           cbqDuration,
+	"txid":              cbqString,
+	"tximplicit":        cbqBool,
+	"txtimeout":         cbqDuration,
+	"use_cbo":           cbqBool,
+	"use_fts":           cbqBool,
+	"use_replica":       cbqString,
+}
+
+// Map a parameter set in the cbq shell, as in \SET -timeout "10s", to the
+// name and value of the REST parameter it stands for. Query parameters are
+// prefixed with -, named parameters with -$ or -@, and credentials are
+// given as -creds user:pass[,user:pass...]. The value is validated against
+// the type of the parameter. Shell parameters, without a prefix, are not
+// query parameters and are rejected.
+func CbqParam(name string, value string) (string, string, error) {
+	key, err := cbqRestName(name)
+	if err != nil {
+		return "", "", err
+	}
+	value = strings.TrimSpace(value)
+
+	// named parameters take any JSON value
+	if strings.HasPrefix(key, "$") {
+		if !json.Valid([]byte(value)) {
+			return "", "", fmt.Errorf("N1QL: Value of %s is not valid JSON: %s", name, value)
+		}
+		return key, value, nil
+	}
+
+	switch cbqParams[key] {
+	case cbqString:
+		value = unquote(value)
+	case cbqBool:
+		b, err := strconv.ParseBool(unquote(value))
+		if err != nil {
+			return "", "", fmt.Errorf("N1QL: Value of %s must be a boolean: %s", name, value)
+		}
+		value = strconv.FormatBool(b)
+	case cbqInt:
+		value = unquote(value)
+		if _, err := strconv.Atoi(value); err != nil {
+			return "", "", fmt.Errorf("N1QL: Value of %s must be an integer: %s", name, value)
+		}
+	case cbqDuration:
+		value = unquote(value)
+		if _, err := time.ParseDuration(value); err != nil {
+			return "", "", fmt.Errorf("N1QL: Value of %s must be a duration: %s", name, value)
+		}
+	case cbqJSON:
+		if !json.Valid([]byte(value)) {
+			return "", "", fmt.Errorf("N1QL: Value of %s is not valid JSON: %s", name, value)
+		}
+	case cbqArray:
+		var args []interface{}
+		if err := json.Unmarshal([]byte(value), &args); err != nil {
+			return "", "", fmt.Errorf("N1QL: Value of %s must be a JSON array: %s", name, value)
+		}
+	case cbqCreds:
+		creds, err := cbqCredentials(unquote(value))
+		if err != nil {
+			return "", "", err
+		}
+		value = creds
+	}
+	return key, value, nil
+}
+
+// Set a query parameter for all requests, from its cbq shell name and value.
+func SetCbqParam(name string, value string) error {
+	key, value, err := CbqParam(name, value)
+	if err != nil {
+		return err
+	}
+	return SetQueryParams(key, value)
+}
+
+// Unset a query parameter set with SetCbqParam.
+func UnsetCbqParam(name string) error {
+	key, err := cbqRestName(name)
+	if err != nil {
+		return err
+	}
+	return UnsetQueryParams(key)
+}
+
+func cbqRestName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	switch {
+	case strings.HasPrefix(name, "-$") || strings.HasPrefix(name, "-@"):
+		if len(name) == 2 {
+			return "", fmt.Errorf("N1QL: Named parameter without a name")
+		}
+		return "$" + name[2:], nil
+	case strings.HasPrefix(name, "-"):
+		key := strings.ToLower(name[1:])
+		if _, ok := cbqParams[key]; !ok {
+			return "", fmt.Errorf("N1QL: Unknown query parameter %s", name)
+		}
+		return key, nil
+	}
+	return "", fmt.Errorf("N1QL: %s is a shell parameter, not a query parameter", name)
+}
+
+// Convert user:pass[,user:pass...] to the creds REST parameter
+func cbqCredentials(value string) (string, error) {
+	type cred struct {
+		User string `json:"user"`
+		Pass string `json:"pass"`
+	}
+	var creds []cred
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, ":")
+		if i <= 0 {
+			return "", fmt.Errorf("N1QL: Credentials must be given as user:pass")
+		}
+		creds = append(creds, cred{User: strings.TrimSpace(pair[:i]), Pass: pair[i+1:]})
+	}
+	b, err := json.Marshal(creds)
+	return string(b), err
+}
+
+// Strip the double quotes around a JSON string value
+func unquote(value string) string {
+	var s string
+	if strings.HasPrefix(value, `"`) && json.Unmarshal([]byte(value), &s) == nil {
+		return s
+	}
+	return value
+}
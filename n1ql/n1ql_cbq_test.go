@@ -0,0 +1,64 @@
+package n1ql
+
+import (
+	"testing"
+)
+
+func TestCbqParam(t *testing.T) {
+	cases := []struct {
+		name, value string
+		key, rest   string
+	}{
+		{"-timeout", `"10s"`, "timeout", "10s"},
+		{"-READONLY", "TRUE", "readonly", "true"},
+		{"-max_parallelism", "4", "max_parallelism", "4"},
+		{"-scan_consistency", "request_plus", "scan_consistency", "request_plus"},
+		{"-$r", "9.5", "$r", "9.5"},
+		{"-@city", `"Paris"`, "$city", `"Paris"`},
+		{"-args", `[1, "a"]`, "args", `[1, "a"]`},
+		{"-creds", "Administrator:p@ss:w,local:pw", "creds",
+			`[{"user":"Administrator","pass":"p@ss:w"},{"user":"local","pass":"pw"}]`},
+	}
+	for _, c := range cases {
+		key, rest, err := CbqParam(c.name, c.value)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", c.name, err)
+			continue
+		}
+		if key != c.key || rest != c.rest {
+			t.Errorf("Expected %s=%s for %s, got %s=%s", c.key, c.rest, c.name, key, rest)
+		}
+	}
+
+	invalid := [][2]string{
+		{"histfile", "x"},
+		{"-no_such_param", "1"},
+		{"-timeout", "ten"},
+		{"-readonly", "maybe"},
+		{"-scan_cap", "1.5"},
+		{"-args", `{"a":1}`},
+		{"-$", "1"},
+		{"-$r", "not json"},
+		{"-creds", "Administrator"},
+	}
+	for _, c := range invalid {
+		if _, _, err := CbqParam(c[0], c[1]); err == nil {
+			t.Errorf("Expected an error for %s %s", c[0], c[1])
+		}
+	}
+}
+
+func TestSetCbqParam(t *testing.T) {
+	if err := SetCbqParam("-txtimeout", `"30s"`); err != nil {
+		t.Fatal(err)
+	}
+	if QueryParams["txtimeout"] != "30s" || TxTimeout != "30s" {
+		t.Errorf("Unexpected txtimeout %q, %q", QueryParams["txtimeout"], TxTimeout)
+	}
+	if err := UnsetCbqParam("-txtimeout"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := QueryParams["txtimeout"]; ok || TxTimeout != "" {
+		t.Error("Expected txtimeout to be unset")
+	}
+}
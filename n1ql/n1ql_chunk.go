@@ -0,0 +1,145 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+// How ExecChunked splits a mutation.
+type ChunkOptions struct {
+	// Most documents mutated by each chunk. 1000 if zero.
+	Size int
+
+	// Times a chunk failing with a temporary error, RetryRequest or
+	// RetryIdempotent, is run again before giving up. 5 if zero, none if
+	// negative. A chunk that timed out is run again with half as many
+	// documents, and the chunks after it grow back to Size, twice as large
+	// as the previous one each time.
+	MaxRetries int
+
+	// Wait before the first retry of a chunk, doubled for each of the next
+	// ones up to MaxBackoff. 100ms and 10s if zero.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Wait between chunks, to leave room for the other requests.
+	Pause time.Duration
+
+	// Called after each chunk.
+	Progress func(p ChunkProgress)
+}
+
+// Where a chunked mutation is at.
+type ChunkProgress struct {
+	Chunks   int   // run so far
+	Affected int64 // documents mutated so far
+	Size     int   // of the last chunk
+	Retries  int   // of all chunks
+}
+
+// Run a DELETE or UPDATE in chunks of a bounded number of documents, each
+// in its own request, until a chunk mutates fewer documents than it could,
+// so that bulk cleanups stay within the memory quota of the query service
+// and the limits of transactions. The statement must not have a LIMIT or a
+// RETURNING clause: the limit of each chunk is appended to it, bound to the
+// $chunk_limit parameter so that all the chunks run the same prepared
+// statement. The WHERE clause of an UPDATE must exclude the documents it already updated, or it
+// never ends. Returns the number of documents mutated, also on error.
+//
+//	n, err := n1ql.ExecChunked(ctx, db, "DELETE FROM logs WHERE ts < ?",
+//		n1ql.ChunkOptions{Size: 5000}, cutoff)
+func ExecChunked(ctx context.Context, db godbc.DB, statement string, opts ChunkOptions, args ...interface{}) (int64, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = 1000
+	}
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 5
+	}
+	minBackoff, maxBackoff := opts.MinBackoff, opts.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = 100 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+
+	target := size
+	statement += " LIMIT $chunk_limit"
+
+	var p ChunkProgress
+	for {
+		var n int64
+		for retries := 0; ; retries++ {
+			res, err := db.ExecContext(ctx, statement, append(args[:len(args):len(args)], Named("chunk_limit", size))...)
+			if err == nil {
+				n, err = res.RowsAffected()
+			}
+			if err == nil {
+				break
+			}
+			class := RetryClassOf(err)
+			if retries >= maxRetries || (class != RetryRequest && class != RetryIdempotent) {
+				return p.Affected, fmt.Errorf("N1QL: Chunk %d failed: %w", p.Chunks+1, err)
+			}
+			if class == RetryIdempotent && size > 1 {
+				size /= 2
+			}
+			p.Retries++
+			backoff := minBackoff << uint(retries)
+			if backoff > maxBackoff || backoff <= 0 {
+				backoff = maxBackoff
+			}
+			if err := sleepContext(ctx, backoff); err != nil {
+				return p.Affected, err
+			}
+		}
+
+		p.Chunks++
+		p.Affected += n
+		p.Size = size
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+		if n < int64(size) {
+			return p.Affected, nil
+		}
+		if size < target {
+			// the chunk that timed out may have been an exception
+			if size *= 2; size > target {
+				size = target
+			}
+		}
+		if err := sleepContext(ctx, opts.Pause); err != nil {
+			return p.Affected, err
+		}
+	}
+}
+
+// Wait for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,79 @@
+package n1ql
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecChunked(t *testing.T) {
+	var lock sync.Mutex
+	var docs int
+	var failures []string
+	var limits, prepares []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		lock.Lock()
+		defer lock.Unlock()
+		if statement := r.PostForm.Get("statement"); strings.HasPrefix(statement, "PREPARE") {
+			prepares = append(prepares, statement)
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		limit := r.PostForm.Get("$chunk_limit")
+		limits = append(limits, limit)
+		if len(failures) > 0 {
+			w.Write([]byte(failures[0]))
+			failures = failures[1:]
+			return
+		}
+		n, _ := strconv.Atoi(limit)
+		if n > docs {
+			n = docs
+		}
+		docs -= n
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":` + strconv.Itoa(n) + `},"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.preparedCache = newStmtCache(1)
+	db := &n1qlDB{conn: conn}
+	opts := ChunkOptions{Size: 3, MinBackoff: time.Millisecond}
+
+	docs = 7
+	var progress []ChunkProgress
+	opts.Progress = func(p ChunkProgress) { progress = append(progress, p) }
+	n, err := ExecChunked(context.Background(), db, "DELETE FROM default WHERE a > ?", opts, 1)
+	if err != nil || n != 7 {
+		t.Fatalf("Expected 7 documents deleted, got %d, %v", n, err)
+	}
+	if len(progress) != 3 || progress[2] != (ChunkProgress{Chunks: 3, Affected: 7, Size: 3}) {
+		t.Errorf("Unexpected progress %+v", progress)
+	}
+	if len(prepares) != 1 || prepares[0] != "PREPARE DELETE FROM default WHERE a > $1 LIMIT $chunk_limit" {
+		t.Errorf("Expected the chunks to share a prepared statement, got %q", prepares)
+	}
+
+	// timeouts halve the chunks, which grow back once they succeed
+	docs, limits, opts.Progress = 5, nil, nil
+	failures = []string{`{"errors":[{"code":1080,"msg":"Timeout 1s exceeded"}],"status":"timeout"}`}
+	n, err = ExecChunked(context.Background(), db, "DELETE FROM default WHERE a > ?", opts, 1)
+	if err != nil || n != 5 {
+		t.Fatalf("Expected 5 documents deleted, got %d, %v", n, err)
+	}
+	if strings.Join(limits, ",") != "3,1,2,3" {
+		t.Errorf("Unexpected limits %v", limits)
+	}
+
+	// other errors end it
+	docs, limits = 5, nil
+	failures = []string{`{"results":[],"metrics":{"mutationCount":3},"status":"success"}`,
+		`{"errors":[{"code":3000,"msg":"syntax error"}],"status":"fatal"}`}
+	n, err = ExecChunked(context.Background(), db, "DELETE FROM default WHERE a > ?", opts, 1)
+	if err == nil || n != 3 || len(limits) != 2 {
+		t.Errorf("Expected the second chunk to fail, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"errors"
+	"io"
+	"net/url"
+)
+
+// Send the request with id as its client_context_id, which the query
+// service logs and keeps in system:active_requests and
+// system:completed_requests, e.g. to follow a request of the application
+// through the cluster. Requests sent without one are given a random UUID.
+// Unlike IdempotencyKey, it does not let the driver send mutations again.
+//
+//	rows, err := db.Query(statement, n1ql.ClientContextID(traceID))
+func ClientContextID(id string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("client_context_id", id)
+	}
+}
+
+// Give the request a client context ID unless it has one, id if it is not
+// empty, so that it keeps the same when it is sent to another node. The ID
+// of the request is returned.
+func setClientContextID(postData url.Values, id string) string {
+	if given := postData.Get("client_context_id"); given != "" {
+		return given
+	}
+	if id == "" {
+		var err error
+		if id, err = newUUID(); err != nil {
+			return ""
+		}
+	}
+	postData.Set("client_context_id", id)
+	return id
+}
+
+// The client context ID the request of body was sent with.
+func clientContextIDOf(body io.ReadCloser) string {
+	if rb, ok := body.(*responseBody); ok {
+		return rb.clientContextID
+	}
+	return ""
+}
+
+// The client context ID of the request that failed with err, "" if it is
+// not known, e.g. because no query node answered.
+func ClientContextIDOf(err error) string {
+	var qerr *Error
+	if errors.As(err, &qerr) {
+		return qerr.ClientContextID
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.ClientContextID
+	}
+	return ""
+}
+
+// Set the client context ID of the request that failed with err, if it is
+// an error reported by the server.
+func withClientContextID(err error, id string) error {
+	if id == "" {
+		return err
+	}
+	var qerr *Error
+	if errors.As(err, &qerr) && qerr.ClientContextID == "" {
+		qerr.ClientContextID = id
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.ClientContextID == "" {
+		statusErr.ClientContextID = id
+	}
+	return err
+}
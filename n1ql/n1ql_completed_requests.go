@@ -0,0 +1,112 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request that ended, as listed in system:completed_requests, which only
+// keeps the ones the query service is set to, by default those that ran
+// for more than a second.
+type CompletedRequest struct {
+	// The request as it was running. Its Node is the node that ran it, as
+	// the query service names it.
+	ActiveRequest
+
+	ResultCount int64
+	ResultSize  int64 // bytes of the results
+	ErrorCount  int64
+}
+
+// Which completed requests CompletedRequests lists. The zero value of each
+// field does not filter.
+type CompletedRequestsFilter struct {
+	// The requests that ran for at least this long.
+	MinElapsedTime time.Duration
+
+	// The requests whose statement matches this LIKE pattern, e.g.
+	// "SELECT % FROM orders%".
+	Statement string
+
+	// The requests received from Since, and before Until.
+	Since time.Time
+	Until time.Time
+
+	// The most recent requests, up to this many.
+	Limit int
+}
+
+type completedRequestJSON struct {
+	activeRequestJSON
+	Node        string `json:"node"`
+	ResultCount int64  `json:"resultCount"`
+	ResultSize  int64  `json:"resultSize"`
+	ErrorCount  int64  `json:"errorCount"`
+}
+
+// List the requests of system:completed_requests matching filter, the most
+// recent first, e.g. for a dashboard of the slow queries:
+//
+//	slow, err := db.CompletedRequests(ctx, n1ql.CompletedRequestsFilter{
+//		MinElapsedTime: 5 * time.Second, Since: time.Now().Add(-time.Hour)})
+func (db *n1qlDB) CompletedRequests(ctx context.Context, filter CompletedRequestsFilter) ([]CompletedRequest, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.MinElapsedTime > 0 {
+		where("STR_TO_DURATION(r.elapsedTime) >= $%d", int64(filter.MinElapsedTime))
+	}
+	if filter.Statement != "" {
+		where("r.statement LIKE $%d", filter.Statement)
+	}
+	if !filter.Since.IsZero() {
+		where("STR_TO_MILLIS(r.requestTime) >= $%d", filter.Since.UnixNano()/int64(time.Millisecond))
+	}
+	if !filter.Until.IsZero() {
+		where("STR_TO_MILLIS(r.requestTime) < $%d", filter.Until.UnixNano()/int64(time.Millisecond))
+	}
+
+	query := "SELECT RAW r FROM system:completed_requests AS r"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY STR_TO_MILLIS(r.requestTime) DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	var raws []json.RawMessage
+	if err := db.catalogQuery(ctx, query, args, &raws); err != nil {
+		return nil, err
+	}
+	requests := make([]CompletedRequest, 0, len(raws))
+	for _, raw := range raws {
+		var r completedRequestJSON
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return nil, fmt.Errorf("N1QL: Failed to decode result %w", err)
+		}
+		requests = append(requests, CompletedRequest{
+			ActiveRequest: r.request(r.Node, raw),
+			ResultCount:   r.ResultCount,
+			ResultSize:    r.ResultSize,
+			ErrorCount:    r.ErrorCount,
+		})
+	}
+	return requests, nil
+}
@@ -0,0 +1,155 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// A scan consistency applied by default to the statements on the keyspaces
+// matching pattern.
+type keyspaceConsistency struct {
+	pattern     string
+	consistency string
+}
+
+// Rules in the order they were set. Replaced, never modified, so that
+// readers can use the slice they got without holding the lock.
+var keyspaceConsistencies []keyspaceConsistency
+var keyspaceConsistenciesLock sync.RWMutex
+
+// Strength of the scan consistencies a rule may set.
+var consistencyRank = map[string]int{
+	"not_bounded":  1,
+	"request_plus": 2,
+}
+
+// Run the statements on the keyspaces matching pattern with the given scan
+// consistency, "not_bounded" or "request_plus", unless the request, its
+// handle or the connection set one. Patterns are matched as by path.Match
+// against the path of the keyspaces the statement names after FROM, JOIN,
+// UPDATE and INTO, as bucket.scope.collection, or bucket alone, without the
+// default namespace and the back quotes. Names relative to the query_context
+// of the request are resolved first.
+//
+//	n1ql.SetKeyspaceConsistency("orders.*", "request_plus")
+//
+// When the statement names keyspaces of different consistencies,
+// request_plus wins. Setting a pattern again replaces its consistency.
+func SetKeyspaceConsistency(pattern string, consistency string) error {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return fmt.Errorf("N1QL: Invalid keyspace pattern %q", pattern)
+	}
+	if consistencyRank[consistency] == 0 {
+		return fmt.Errorf("N1QL: Invalid scan consistency %q for keyspace %s", consistency, pattern)
+	}
+
+	keyspaceConsistenciesLock.Lock()
+	defer keyspaceConsistenciesLock.Unlock()
+	rules := make([]keyspaceConsistency, 0, len(keyspaceConsistencies)+1)
+	replaced := false
+	for _, rule := range keyspaceConsistencies {
+		if rule.pattern == pattern {
+			rule.consistency = consistency
+			replaced = true
+		}
+		rules = append(rules, rule)
+	}
+	if !replaced {
+		rules = append(rules, keyspaceConsistency{pattern: pattern, consistency: consistency})
+	}
+	keyspaceConsistencies = rules
+	return nil
+}
+
+// Stop applying a scan consistency to the keyspaces matching pattern.
+func UnsetKeyspaceConsistency(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("N1QL: Keyspace pattern not specified")
+	}
+
+	keyspaceConsistenciesLock.Lock()
+	defer keyspaceConsistenciesLock.Unlock()
+	rules := make([]keyspaceConsistency, 0, len(keyspaceConsistencies))
+	for _, rule := range keyspaceConsistencies {
+		if rule.pattern != pattern {
+			rules = append(rules, rule)
+		}
+	}
+	keyspaceConsistencies = rules
+	return nil
+}
+
+var stringLiteral = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`)
+
+var keyspaceRef = regexp.MustCompile("(?i)\\b(?:FROM|JOIN|UPDATE|INTO)\\s+(" +
+	"(?:(?:`[^`]+`|[a-z_][a-z0-9_]*):)?" +
+	"(?:`[^`]+`|[a-z_][a-z0-9_]*)" +
+	"(?:\\s*\\.\\s*(?:`[^`]+`|[a-z_][a-z0-9_]*)){0,2})")
+
+// The keyspaces the statement names, as written in it.
+func statementKeyspaces(statement string) []string {
+	statement = stringLiteral.ReplaceAllString(statement, `""`)
+	var keyspaces []string
+	for _, m := range keyspaceRef.FindAllStringSubmatch(statement, -1) {
+		keyspaces = append(keyspaces, m[1])
+	}
+	return keyspaces
+}
+
+// The path the rules are matched against of a keyspace named in a statement
+// run in the given query_context.
+func keyspacePath(keyspace string, queryContext string) string {
+	unquote := func(s string) string {
+		s = strings.Replace(s, "`", "", -1)
+		s = strings.Replace(s, " ", "", -1)
+		return strings.TrimPrefix(s, "default:")
+	}
+	keyspace = unquote(keyspace)
+	if queryContext != "" && !strings.ContainsAny(keyspace, ":.") {
+		return unquote(queryContext) + "." + keyspace
+	}
+	return keyspace
+}
+
+// Set the scan consistency of the request from the rules matching the
+// keyspaces of its statement, unless it has one.
+func applyKeyspaceConsistency(v *url.Values, keyspaces []string) {
+	if len(keyspaces) == 0 || v.Get("scan_consistency") != "" {
+		return
+	}
+	keyspaceConsistenciesLock.RLock()
+	rules := keyspaceConsistencies
+	keyspaceConsistenciesLock.RUnlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	consistency := ""
+	for _, keyspace := range keyspaces {
+		p := keyspacePath(keyspace, v.Get("query_context"))
+		for _, rule := range rules {
+			if ok, _ := path.Match(rule.pattern, p); ok {
+				if consistencyRank[rule.consistency] > consistencyRank[consistency] {
+					consistency = rule.consistency
+				}
+				break
+			}
+		}
+	}
+	if consistency != "" {
+		v.Set("scan_consistency", consistency)
+	}
+}
@@ -0,0 +1,97 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Credentials given in the userinfo of a data source name. They are kept
+// apart from the URLs, so that no URL the driver logs or puts in an error
+// carries them. They are held by pointer, which fmt prints as an address
+// when dumping the structures holding them, and print masked themselves.
+type credentials struct {
+	user     string
+	password string
+
+	// asked for the credentials of each request if there are none above
+	authenticator Authenticator
+}
+
+// Source of the credentials of the requests, asked for them before each
+// request so that it can rotate them. The Authenticator of cbauth, which
+// services co-located with the cluster use, satisfies it:
+//
+//	n1ql.SetAuthenticator(cbauth.Default)
+type Authenticator interface {
+	GetHTTPServiceAuth(hostport string) (user string, password string, err error)
+}
+
+var authenticator Authenticator
+
+// Authenticate the requests of the connections opened from now on with the
+// credentials given by a, unless their data source name has some. They take
+// precedence over the ones given to SetUsernamePassword. Pass nil to stop.
+func SetAuthenticator(a Authenticator) {
+	authenticator = a
+}
+
+func (c *credentials) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.user + ":xxxxx"
+}
+
+func (c *credentials) GoString() string {
+	return c.String()
+}
+
+// Authenticate the request with the credentials, or with the ones given to
+// SetUsernamePassword if the data source name had none. Empty credentials,
+// given by options, send none.
+func (c *credentials) setAuth(request *http.Request) error {
+	switch {
+	case c == nil:
+		if hasUsernamePassword() {
+			request.SetBasicAuth(username, password)
+		}
+	case c.user != "" || c.password != "":
+		request.SetBasicAuth(c.user, c.password)
+	case c.authenticator != nil:
+		user, password, err := c.authenticator.GetHTTPServiceAuth(request.URL.Host)
+		if err != nil {
+			return fmt.Errorf("N1QL: Failed to get the credentials for %s: %w", request.URL.Host, err)
+		}
+		request.SetBasicAuth(user, password)
+	}
+	return nil
+}
+
+// Take the userinfo out of a data source name. Characters that have a
+// meaning in URLs, such as @, :, / or %, must be percent-encoded in the user
+// name and password, as url.UserPassword does; they are decoded here.
+func splitCredentials(name string) (string, *credentials, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		// the error would show the password
+		return "", nil, fmt.Errorf("N1QL: Invalid data source name: " +
+			"special characters in the user name and password must be percent-encoded")
+	}
+	if u.User == nil {
+		return name, nil, nil
+	}
+	c := &credentials{user: u.User.Username()}
+	c.password, _ = u.User.Password()
+	u.User = nil
+	return u.String(), c, nil
+}
@@ -10,8 +10,10 @@
 package n1ql
 
 import (
+	"context"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/couchbase/godbc"
 )
@@ -20,6 +22,17 @@ type N1qlDB interface {
 	godbc.DB
 	PrepareExtended(query string) (N1qlStmt, error)
 
+	// Prepare the statement and run it with the given arguments in a single
+	// request, with the auto_execute parameter of the query service, rather
+	// than a PREPARE followed by an EXECUTE. Returns the prepared statement,
+	// to run it again, along with the outcome of the first run. The plan
+	// stays on the query nodes: a statement they no longer know fails
+	// rather than being sent with its plan, and is to be prepared again.
+	//
+	//	stmt, rows, err := db.PrepareAndQuery("SELECT * FROM orders WHERE id = ?", id)
+	PrepareAndQuery(query string, args ...interface{}) (N1qlStmt, godbc.Rows, error)
+	PrepareAndExec(query string, args ...interface{}) (N1qlStmt, godbc.Result, error)
+
 	// Run the query with the given parameters.
 	// Returns the raw streaming input from the body of the RESTful request
 	// to the database. The returned error contains a short description
@@ -37,116 +50,390 @@ type N1qlDB interface {
 	// Note that under some conditions, where the request was actually sent to the
 	// server, both the stream and an error are returned.
 	ExecRaw(query string, args ...interface{}) (io.ReadCloser, error)
+
+	// Return a handle sharing this handle's connection, which applies the
+	// given options to every request it sends. Options passed with the
+	// arguments of a request override them.
+	//
+	//	tenant := db.With(n1ql.QueryContext("default:tenants.acme"), n1ql.ReadOnly(true))
+	With(options ...QueryOption) N1qlDB
+
+	// Execute the mutation, then run the query so that it observes the
+	// mutation's effects (read your own writes). The query waits for the
+	// mutation tokens returned by the mutation, or for all mutations
+	// preceding it if the server returns none.
+	ExecThenQuery(mutation string, mutationArgs []interface{}, query string, args ...interface{}) (N1qlResult, godbc.Rows, error)
+
+	// Outcome of the ping of each query node at Open, in strict open mode.
+	// Nil otherwise.
+	Readiness() []NodeReadiness
+
+	// The query endpoints the connection balances its requests over, in the
+	// order NodeIndex refers to them. Nodes that stopped responding are no
+	// longer listed.
+	QueryNodes() []string
+
+	// The number of requests the connection lets in flight to each query
+	// node it sent requests to, as adapted to their load, keyed as
+	// QueryNodes lists them. Nil unless the connection adapts them, see
+	// AdaptiveConcurrency.
+	NodeConcurrency() map[string]int
+
+	// List the requests running on the query nodes of the connection, as
+	// their admin API does, and cancel one of them on the node running it,
+	// e.g. for management tools.
+	ActiveRequests(ctx context.Context) ([]ActiveRequest, error)
+	CancelRequest(ctx context.Context, requestID string) error
+
+	// List the requests of system:completed_requests matching filter, the
+	// most recent first.
+	CompletedRequests(ctx context.Context, filter CompletedRequestsFilter) ([]CompletedRequest, error)
+
+	// Set or unset a REST API parameter for every request of this handle,
+	// and of the handles sharing its connection, overriding the one set
+	// with SetQueryParams. Safe for concurrent use.
+	SetQueryParam(key string, value string) error
+	UnsetQueryParam(key string) error
+
+	// Set the statement Ping runs for this handle and the handles sharing
+	// its connection. Empty restores N1QL_DEFAULT_STATEMENT.
+	SetPingStatement(statement string) error
+
+	// Same as Begin, with options for the transaction instead of the package
+	// level ones.
+	//
+	//	tx, err := db.BeginWithOptions(n1ql.TxOptions{Timeout: 10 * time.Second,
+	//		DurabilityLevel: "majority"})
+	BeginWithOptions(opts TxOptions) (godbc.Tx, error)
+
+	// Same as BeginWithOptions, opts may be nil, with a context that the
+	// statements of the transaction run with. Once the context is done, the
+	// transaction is rolled back on its query node, unless it is already
+	// committed or rolled back.
+	BeginTx(ctx context.Context, opts *TxOptions) (godbc.Tx, error)
+
+	// Forget the prepared plans cached for Query and Exec of the given
+	// statements, or of all of them if none is given, see
+	// Options.PreparedCacheSize.
+	InvalidatePrepared(statements ...string)
+
+	// Wait until one of the query nodes answers a ping, or until ctx is
+	// done, e.g. after an Open in serverless mode, which does not ping.
+	//
+	//	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	//	defer cancel()
+	//	if err := db.WaitUntilReady(ctx); err != nil {
+	WaitUntilReady(ctx context.Context) error
+
+	// Also send the statements run with Query and QueryContext, and with
+	// Exec and ExecContext if shadow.Writes, by this handle and the ones
+	// sharing its connection to a second cluster, see Shadow. Nil stops.
+	SetShadow(shadow *Shadow) error
+
+	// List and execute the user defined functions of a scope, or the global
+	// ones if bucket and scope are empty.
+	Functions(ctx context.Context, bucket, scope string) ([]Function, error)
+	ExecuteFunction(ctx context.Context, bucket, scope, name string, args ...interface{}) (godbc.Rows, error)
+
+	// List the sequences of a scope, advance one of them, or read the value
+	// it last returned to this connection, for generating IDs.
+	Sequences(ctx context.Context, bucket, scope string) ([]Sequence, error)
+	NextSequenceValue(ctx context.Context, bucket, scope, name string) (int64, error)
+	PrevSequenceValue(ctx context.Context, bucket, scope, name string) (int64, error)
 }
 
 // Implements godbc.DB interface.
 type n1qlDB struct {
-	conn *n1qlConn
+	conn     *n1qlConn
+	defaults []QueryOption
+	derived  bool
 }
 
 var errorNoConnection = errors.New("N1QL connection is already closed.")
 
+// Start a transaction. The statements run through it, and the statements
+// of the handle passed to its Stmt method, belong to it and go to the query
+// node it was started on; the other requests of the handle do not.
 func (db *n1qlDB) Begin() (godbc.Tx, error) {
-	if db.conn == nil || !db.conn.TxService() {
-		return nil, errorNoConnection
-	}
-	return db, nil
-}
-
-func (db *n1qlDB) Commit() error {
-	return errors.New("Transactions are not supported.")
+	return db.begin(context.Background(), nil)
 }
 
-func (db *n1qlDB) Rollback() error {
-	return errors.New("Transactions are not supported.")
+func (db *n1qlDB) BeginWithOptions(opts TxOptions) (godbc.Tx, error) {
+	return db.begin(context.Background(), &opts)
 }
 
-func (db *n1qlDB) Stmt(stmt godbc.Stmt) godbc.Stmt {
-	return stmt
+func (db *n1qlDB) BeginTx(ctx context.Context, opts *TxOptions) (godbc.Tx, error) {
+	return db.begin(ctx, opts)
 }
 
 func (db *n1qlDB) Close() error {
 	if db.conn == nil {
 		return errorNoConnection
 	}
-	err := db.conn.Close()
-	if err != nil {
-		return err
+	if db.derived {
+		// the connection belongs to the parent handle
+		db.conn = nil
+		return nil
 	}
+	// closed even if its prepared statements could not be deleted
+	err := db.conn.Close()
 	db.conn = nil
-	return nil
+	return err
 }
 
 func (db *n1qlDB) Exec(query string, args ...interface{}) (godbc.Result, error) {
-	stmt, err := db.Prepare(query)
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *n1qlDB) ExecContext(ctx context.Context, query string, args ...interface{}) (godbc.Result, error) {
+	stmt, err := db.statement(ctx, query, args)
 	if err != nil {
 		return nil, err
 	}
-	return stmt.Exec(args...)
+	if sh := db.conn.shadowRunner(); sh != nil {
+		if req := sh.start(query, args, true); req != nil {
+			start := time.Now()
+			res, err := stmt.ExecContext(ctx, args...)
+			req.exec(start, res, err)
+			return res, err
+		}
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (db *n1qlDB) ExecThenQuery(mutation string, mutationArgs []interface{}, query string, args ...interface{}) (N1qlResult, godbc.Rows, error) {
+	mutationArgs = append(append([]interface{}{}, mutationArgs...), MutationTokens())
+	res, err := db.Exec(mutation, mutationArgs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := res.(N1qlResult)
+
+	consistency := ScanConsistency("request_plus")
+	if tokens := result.MutationTokens(); len(tokens) > 0 {
+		consistency = AtPlus(tokens)
+	}
+	args = append(append([]interface{}{}, args...), consistency)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return result, nil, err
+	}
+	return result, rows, nil
 }
 
 func (db *n1qlDB) ExecRaw(query string, args ...interface{}) (io.ReadCloser, error) {
 	if db.conn == nil {
 		return nil, errorNoConnection
 	}
-	return db.conn.ExecRaw(query, args...)
+	return db.conn.ExecRaw(query, withDefaultOptions(db.defaults, args)...)
 }
 
 func (db *n1qlDB) Ping() error {
-	_, error := db.QueryRaw(N1QL_DEFAULT_STATEMENT)
-	return error
+	return db.PingContext(context.Background())
+}
+
+func (db *n1qlDB) PingContext(ctx context.Context) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	opts, _ := splitQueryOptions(withDefaultOptions(db.defaults, nil))
+	body, err := db.conn.performQueryRaw(ctx, db.conn.pingStatement(), nil, opts)
+	if body != nil {
+		drainAndClose(body)
+	}
+	return err
 }
 
 func (db *n1qlDB) Prepare(query string) (godbc.Stmt, error) {
-	return db.prepare(query)
+	return db.prepare(context.Background(), query)
+}
+
+func (db *n1qlDB) PrepareContext(ctx context.Context, query string) (godbc.Stmt, error) {
+	return db.prepare(ctx, query)
 }
 
 func (db *n1qlDB) PrepareExtended(query string) (N1qlStmt, error) {
-	return db.prepare(query)
+	return db.prepare(context.Background(), query)
 }
 
-func (db *n1qlDB) prepare(query string) (*n1qlStmt, error) {
+func (db *n1qlDB) prepare(ctx context.Context, query string) (*n1qlStmt, error) {
 	if db.conn == nil {
 		return nil, errorNoConnection
 	}
-	return db.conn.Prepare(query)
+	opts, _ := splitQueryOptions(withDefaultOptions(db.defaults, nil))
+	return db.prepareWith(ctx, db.conn.nextPreparedName(), query, opts)
+}
+
+// Prepare the statement under name, or the one the server gives it if
+// empty, with the options of its request, the defaults of the handle
+// merged with the ones passed along with the arguments: the query context
+// of the plan must be the one it is executed in.
+func (db *n1qlDB) prepareWith(ctx context.Context, name string, query string, opts *queryOptions) (*n1qlStmt, error) {
+	stmt, err := db.conn.prepare(ctx, name, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	stmt.defaults = db.defaults
+	return stmt, nil
+}
+
+func (db *n1qlDB) With(options ...QueryOption) N1qlDB {
+	defaults := make([]QueryOption, 0, len(db.defaults)+len(options))
+	defaults = append(defaults, db.defaults...)
+	defaults = append(defaults, options...)
+	return &n1qlDB{conn: db.conn, defaults: defaults, derived: true}
 }
 
 func (db *n1qlDB) Query(query string, args ...interface{}) (godbc.Rows, error) {
-	stmt, err := db.Prepare(query)
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *n1qlDB) QueryContext(ctx context.Context, query string, args ...interface{}) (godbc.Rows, error) {
+	stmt, err := db.statement(ctx, query, args)
 	if err != nil {
 		return nil, err
 	}
-	return stmt.Query(args...)
+	if sh := db.conn.shadowRunner(); sh != nil {
+		if req := sh.start(query, args, false); req != nil {
+			start := time.Now()
+			rows, err := stmt.QueryContext(ctx, args...)
+			req.query(start, rows, err)
+			return rows, err
+		}
+	}
+	return stmt.QueryContext(ctx, args...)
 }
 
 func (db *n1qlDB) QueryRaw(query string, args ...interface{}) (io.ReadCloser, error) {
 	if db.conn == nil {
 		return nil, errorNoConnection
 	}
-	return db.conn.QueryRaw(query, args...)
+	return db.conn.QueryRaw(query, withDefaultOptions(db.defaults, args)...)
 }
 
 func (db *n1qlDB) QueryRow(query string, args ...interface{}) godbc.Row {
 	rows, err := db.Query(query, args...)
+	return firstRow(rows, err, db.conn != nil && db.conn.noRowsError)
+}
+
+// The row of QueryRow: the first row of rows, or an error.
+// Without rows, it is nil, or fails with godbc.ErrNoRows if noRowsError.
+func firstRow(rows godbc.Rows, err error, noRowsError bool) godbc.Row {
 	if err != nil {
-		return nil
+		return godbc.ErrRow(err)
 	}
 	hasFirst := rows.Next()
 	if !hasFirst {
+		err := rows.Err()
+		rows.Close()
+		if err != nil {
+			return godbc.ErrRow(err)
+		}
+		if noRowsError {
+			return godbc.ErrRow(godbc.ErrNoRows)
+		}
 		return nil
 	}
-	return rows // Row is a subset of Rows.
+	return &n1qlRow{rows: rows}
 }
 
+// The row of QueryRow, which closes its rows once scanned so that they do
+// not keep the response, nor the slots of the request, as database/sql does.
+type n1qlRow struct {
+	rows godbc.Rows
+}
+
+func (row *n1qlRow) Scan(dest ...interface{}) error {
+	err := row.rows.Scan(dest...)
+	closeErr := row.rows.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// The error the rows ended with, if any.
+func (row *n1qlRow) Err() error {
+	return row.rows.Err()
+}
+
+// Bound the idle sockets kept open to each query node. Zero or less keeps
+// none. It cannot be more than the limit set with SetMaxOpenConns.
 func (db *n1qlDB) SetMaxIdleConns(n int) {
-	// Do nothing. We don't keep track of connections.
+	if db.conn != nil {
+		db.conn.setMaxIdleConns(n)
+	}
 }
 
+// Bound the sockets open to each query node, and so the requests it runs
+// at once for this handle and the ones sharing its connection. Zero or
+// less means no limit.
 func (db *n1qlDB) SetMaxOpenConns(n int) {
-	// Do nothing. We don't keep track of connections.
+	if db.conn != nil {
+		db.conn.setMaxOpenConns(n)
+	}
 }
 
 func (db *n1qlDB) Stats() godbc.DBStats {
+	if db.conn == nil {
+		return &n1qlDBStats{}
+	}
+	return db.conn.stats.snapshot()
+}
+
+func (db *n1qlDB) SetQueryParam(key string, value string) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	return db.conn.SetQueryParam(key, value)
+}
+
+func (db *n1qlDB) UnsetQueryParam(key string) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	return db.conn.UnsetQueryParam(key)
+}
+
+func (db *n1qlDB) SetPingStatement(statement string) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	db.conn.setPingStatement(statement)
+	return nil
+}
+
+func (db *n1qlDB) SetShadow(shadow *Shadow) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	db.conn.setShadow(shadow)
 	return nil
 }
+
+func (db *n1qlDB) NodeConcurrency() map[string]int {
+	if db.conn == nil {
+		return nil
+	}
+	return db.conn.nodeLimiters.limits()
+}
+
+func (db *n1qlDB) QueryNodes() []string {
+	if db.conn == nil {
+		return nil
+	}
+	db.conn.lock.RLock()
+	defer db.conn.lock.RUnlock()
+	nodes := make([]string, len(db.conn.queryAPIs))
+	for i, queryAPI := range db.conn.queryAPIs {
+		nodes[i] = stripurl(queryAPI)
+	}
+	return nodes
+}
+
+func (db *n1qlDB) Readiness() []NodeReadiness {
+	if db.conn == nil {
+		return nil
+	}
+	return db.conn.readiness
+}
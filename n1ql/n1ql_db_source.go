@@ -19,6 +19,16 @@ func OpenExtended(dataSourceName string, userAgent string) (N1qlDB, error) {
 	return open(dataSourceName, userAgent)
 }
 
+// Open a handle configured with opts instead of the package level settings,
+// which it neither reads nor changes.
+func OpenWithOptions(dataSourceName string, opts Options) (N1qlDB, error) {
+	n1qlConn, err := OpenN1QLConnectionWithOptions(dataSourceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &n1qlDB{conn: n1qlConn}, nil
+}
+
 func open(dataSourceName string, userAgent string) (*n1qlDB, error) {
 	n1qlConn, err := OpenN1QLConnection(dataSourceName, userAgent)
 	if err != nil {
@@ -0,0 +1,605 @@
+package n1ql
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/godbc"
+	"github.com/couchbase/godbc/drivertest"
+)
+
+func TestExecThenQuery(t *testing.T) {
+	var consistency, vectors string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE"):
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+		case r.PostForm.Get("mutation_token") == "true":
+			w.Write([]byte(`{"results":[],"mutationTokens":{"default":{"12":[7,"2a5c"]}},` +
+				`"metrics":{"mutationCount":1},"status":"success"}`))
+		default:
+			consistency = r.PostForm.Get("scan_consistency")
+			vectors = r.PostForm.Get("scan_vectors")
+			w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1}],"status":"success"}`))
+		}
+	})
+	defer srv.Close()
+
+	db := &n1qlDB{conn: conn}
+	res, rows, err := db.ExecThenQuery("UPDATE default SET a = ?", []interface{}{1}, "SELECT a FROM default")
+	if err != nil {
+		t.Fatal("ExecThenQuery failed.", err.Error())
+	}
+	defer rows.Close()
+
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Errorf("Expected 1 row affected, got %d", n)
+	}
+	if consistency != "at_plus" || vectors != `{"default":{"12":[7,"2a5c"]}}` {
+		t.Errorf("Unexpected consistency %q with scan vectors %q", consistency, vectors)
+	}
+}
+
+func TestDerivedHandle(t *testing.T) {
+	var contexts, readonly []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		contexts = append(contexts, r.PostForm.Get("query_context"))
+		readonly = append(readonly, r.PostForm.Get("readonly"))
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+		} else {
+			w.Write([]byte(`{"signature":{"a":"number"},"results":[],"status":"success"}`))
+		}
+	})
+	defer srv.Close()
+
+	db := &n1qlDB{conn: conn}
+	tenant := db.With(QueryContext("default:tenants.acme"), ReadOnly(true))
+
+	rows, err := tenant.Query("SELECT a FROM orders", QueryContext("default:tenants.other"))
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	rows.Close()
+	rows, err = db.Query("SELECT a FROM orders")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	rows.Close()
+
+	// the statement is prepared in the context it is executed in
+	expected := []string{"default:tenants.other", "default:tenants.other", "", ""}
+	for i, c := range expected {
+		if i >= len(contexts) || contexts[i] != c {
+			t.Fatalf("Expected query contexts %q, got %q", expected, contexts)
+		}
+	}
+	if readonly[0] != "true" || readonly[1] != "true" || readonly[2] != "" {
+		t.Errorf("Unexpected readonly values %q", readonly)
+	}
+
+	if err := tenant.Close(); err != nil || db.conn == nil {
+		t.Error("Closing a derived handle must not close its parent")
+	}
+}
+
+func TestPerDBQueryParams(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"signature":"string","results":["` +
+			r.PostForm.Get("scan_consistency") + r.PostForm.Get("readonly") + `"],"status":"success"}`))
+	}
+	conn1, srv1 := newTestConn(handler)
+	defer srv1.Close()
+	conn2, srv2 := newTestConn(handler)
+	defer srv2.Close()
+	db1, db2 := &n1qlDB{conn: conn1}, &n1qlDB{conn: conn2}
+
+	SetQueryParams("readonly", "true")
+	defer UnsetQueryParams("readonly")
+	db1.SetQueryParam("scan_consistency", "request_plus")
+	db2.SetQueryParam("readonly", "false")
+
+	// concurrent updates and requests do not race
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			db1.SetQueryParam("pretty", "false")
+			db1.UnsetQueryParam("pretty")
+		}()
+		go func() {
+			defer wg.Done()
+			if rows, err := db1.Query("SELECT p"); err == nil {
+				rows.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for db, expected := range map[*n1qlDB]string{db1: "request_plustrue", db2: "false"} {
+		rows, err := db.Query("SELECT p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p string
+		if !rows.Next() || rows.Scan(&p) != nil || p != expected {
+			t.Errorf("Expected parameters %q, got %q", expected, p)
+		}
+		rows.Close()
+	}
+
+	db2.UnsetQueryParam("readonly")
+	rows, _ := db2.Query("SELECT p")
+	var p string
+	if !rows.Next() || rows.Scan(&p) != nil || p != "true" {
+		t.Errorf("Expected the package level parameter once unset, got %q", p)
+	}
+	rows.Close()
+}
+
+func TestConformance(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		switch {
+		case statement == "START TRANSACTION":
+			w.Write([]byte(`{"results":[{"txid":"tx1"}],"status":"success"}`))
+		case strings.HasPrefix(statement, "PREPARE SELECT a, b"):
+			w.Write([]byte(`{"results":[{"name":"query"}],"status":"success"}`))
+		case strings.HasPrefix(statement, "PREPARE SELECT RAW"):
+			w.Write([]byte(`{"results":[{"name":"echo"}],"status":"success"}`))
+		case strings.HasPrefix(statement, "PREPARE"):
+			w.Write([]byte(`{"results":[{"name":"exec"}],"status":"success"}`))
+		case r.PostForm.Get("prepared") == `"query"`:
+			w.Write([]byte(`{"signature":{"a":"number","b":"string"},` +
+				`"results":[{"a":1,"b":"x"},{"a":2,"b":"y"}],"status":"success"}`))
+		case r.PostForm.Get("prepared") == `"echo"`:
+			args := r.PostForm.Get("args")
+			w.Write([]byte(`{"signature":"json","results":[` + args[1:len(args)-1] + `],"status":"success"}`))
+		case r.PostForm.Get("prepared") == `"exec"`:
+			w.Write([]byte(`{"results":[],"metrics":{"mutationCount":3},"status":"success"}`))
+		default:
+			w.Write([]byte(`{"results":[1],"status":"success"}`))
+		}
+	})
+	defer srv.Close()
+
+	drivertest.TestDB(t, &n1qlDB{conn: conn}, drivertest.Config{
+		Query:        "SELECT a, b FROM default ORDER BY a",
+		Columns:      []string{"a", "b"},
+		Want:         [][]string{{"1", "x"}, {"2", "y"}},
+		Echo:         "SELECT RAW ?",
+		EchoArg:      "hello",
+		EchoWant:     "hello",
+		Exec:         "DELETE FROM default WHERE c = 1",
+		RowsAffected: 3,
+		TxExec:       "UPDATE default SET c = 2",
+	})
+}
+
+func TestQueryRowReportsErrors(t *testing.T) {
+	var response string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(response))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	response = `{"errors":[{"code":3000,"msg":"syntax error"}],"status":"fatal"}`
+	var v string
+	if err := db.QueryRow("SELEC 1").Scan(&v); err == nil || !strings.Contains(err.Error(), "syntax error") {
+		t.Errorf("Expected Scan to report the query error, got %v", err)
+	}
+
+	// as is an error reading the first row
+	response = `{"signature":{"a":"number"},"results":[{"a":projection}],"status":"success"}`
+	stmt, err := db.Prepare("SELECT a FROM default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stmt.QueryRow().Scan(&v); err == nil {
+		t.Error("Expected Scan to report the decoding error")
+	}
+
+	response = `{"signature":{"a":"number"},"results":[],"status":"success"}`
+	if row := db.QueryRow("SELECT a FROM default"); row != nil {
+		t.Errorf("Expected no row, got %v", row)
+	}
+}
+
+func TestNoRowsError(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[],"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.noRowsError = true
+	db := &n1qlDB{conn: conn}
+
+	var v int
+	if err := db.QueryRow("SELECT a FROM default").Scan(&v); err != godbc.ErrNoRows {
+		t.Errorf("Expected godbc.ErrNoRows, got %v", err)
+	}
+	stmt, err := db.Prepare("SELECT a FROM default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stmt.QueryRow().Scan(&v); err != godbc.ErrNoRows {
+		t.Errorf("Expected godbc.ErrNoRows from the statement, got %v", err)
+	}
+}
+
+func TestQueryRowReleasesRequest(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		// more rows than are decoded ahead of Next
+		w.Write([]byte(`{"signature":"number","results":[1,2,3,4,5,6,7,8],"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.limiter = newInFlightLimiter(1, time.Second)
+	db := &n1qlDB{conn: conn}
+
+	// a row left open would keep the only slot, and the second request
+	// would wait for it forever
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			var v int
+			if err := db.QueryRow("SELECT RAW a FROM default").Scan(&v); err != nil {
+				done <- err
+				return
+			}
+			if v != 1 {
+				t.Errorf("Expected the first row, got %d", v)
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second QueryRow not to wait for the first one")
+	}
+}
+
+func TestShadow(t *testing.T) {
+	handler := func(results string, statements chan<- string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+				w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+				return
+			}
+			if statements != nil {
+				statements <- r.PostForm.Get("args")
+			}
+			w.Write([]byte(`{"signature":{"a":"number"},"results":` + results +
+				`,"metrics":{"mutationCount":1},"status":"success"}`))
+		}
+	}
+	conn, srv := newTestConn(handler(`[{"a":1},{"a":2}]`, nil))
+	defer srv.Close()
+	statements := make(chan string, 10)
+	shadowConn, shadowSrv := newTestConn(handler(`[{"a":1},{"a":2},{"a":3}]`, statements))
+	defer shadowSrv.Close()
+
+	reports := make(chan ShadowReport, 10)
+	db := &n1qlDB{conn: conn}
+	db.SetShadow(&Shadow{DB: &n1qlDB{conn: shadowConn}, Hook: func(r ShadowReport) { reports <- r }})
+
+	rows, err := db.With(ReadOnly(true)).Query("SELECT a FROM default WHERE a > ?", 0)
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	r := <-reports
+	if r.Statement != "SELECT a FROM default WHERE a > ?" || r.Rows != 2 || r.ShadowRows != 3 || !r.Complete ||
+		r.Err != nil || r.ShadowErr != nil || !r.Mismatch() {
+		t.Errorf("Unexpected report %+v", r)
+	}
+	if args := <-statements; args != "[0]" {
+		t.Errorf("Expected the arguments sent to the shadow, got %s", args)
+	}
+
+	// writes are only shadowed when asked for
+	if _, err := db.Exec("DELETE FROM default"); err != nil {
+		t.Fatal("Exec failed.", err.Error())
+	}
+	db.SetShadow(&Shadow{DB: &n1qlDB{conn: shadowConn}, Writes: true, Hook: func(r ShadowReport) { reports <- r }})
+	if _, err := db.Exec("DELETE FROM default"); err != nil {
+		t.Fatal("Exec failed.", err.Error())
+	}
+	r = <-reports
+	if r.Rows != 1 || r.ShadowRows != 1 || r.Mismatch() {
+		t.Errorf("Unexpected report %+v", r)
+	}
+	if args := <-statements; args != "" {
+		t.Errorf("Expected a single statement on the shadow, got %q", args)
+	}
+	select {
+	case args := <-statements:
+		t.Errorf("Unexpected statement on the shadow %q", args)
+	default:
+	}
+
+	db.SetShadow(nil)
+	rows, err = db.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	rows.Close()
+	select {
+	case r := <-reports:
+		t.Errorf("Unexpected report %+v", r)
+	default:
+	}
+}
+
+func TestPreparedCache(t *testing.T) {
+	var prepares []string
+	var stale bool
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		if strings.HasPrefix(statement, "DELETE FROM system:prepareds") {
+			// the evicted plans, deallocated in the background
+			w.Write([]byte(`{"results":[],"status":"success"}`))
+			return
+		}
+		if strings.HasPrefix(statement, "PREPARE") {
+			prepares = append(prepares, statement)
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		if stale && r.PostForm.Get("prepared") == `"p1"` {
+			stale = false
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":4040,"msg":"No such prepared statement: p1"}],"status":"fatal"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.preparedCache = newStmtCache(2)
+	db := &n1qlDB{conn: conn}
+
+	run := func(db N1qlDB, statement string) {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+	}
+	run(db, "DELETE FROM a")
+	run(db, "DELETE FROM a")
+	run(db, "DELETE FROM b")
+	run(db.With(QueryContext("default:b.s")), "DELETE FROM a")
+	if len(prepares) != 3 {
+		t.Errorf("Expected 3 statements prepared, got %v", prepares)
+	}
+
+	// the least recently used went away
+	prepares = nil
+	run(db, "DELETE FROM a")
+	run(db, "DELETE FROM b")
+	if len(prepares) != 2 {
+		t.Errorf("Expected 2 statements prepared again, got %v", prepares)
+	}
+
+	// as do the statements the node no longer knows
+	prepares, stale = nil, true
+	run(db, "DELETE FROM b")
+	run(db, "DELETE FROM b")
+	if len(prepares) != 1 {
+		t.Errorf("Expected the statement to be prepared again, got %v", prepares)
+	}
+
+	prepares = nil
+	db.InvalidatePrepared("DELETE FROM b")
+	run(db, "DELETE FROM a")
+	run(db, "DELETE FROM b")
+	if len(prepares) != 1 || prepares[0] != "PREPARE DELETE FROM b" {
+		t.Errorf("Expected only the invalidated statement to be prepared again, got %v", prepares)
+	}
+}
+
+func TestPreparedCacheOptions(t *testing.T) {
+	var prepares []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			prepares = append(prepares, r.PostForm.Get("query_context"))
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.preparedCache = newStmtCache(4)
+	db := &n1qlDB{conn: conn}
+
+	for _, args := range [][]interface{}{
+		{QueryContext("default:b.s")},
+		{QueryContext("default:b.s"), ClientContextID("x")},
+		{QueryContext("default:b.t")},
+		nil,
+	} {
+		if _, err := db.Exec("DELETE FROM a", args...); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+	}
+	expected := []string{"default:b.s", "default:b.t", ""}
+	if !reflect.DeepEqual(prepares, expected) {
+		t.Errorf("Expected statements prepared in %q, got %q", expected, prepares)
+	}
+}
+
+func TestPreparedCacheDeallocates(t *testing.T) {
+	var prepared int32
+	deallocated := make(chan string, 10)
+	release := make(chan struct{})
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		switch {
+		case strings.HasPrefix(statement, "PREPARE"):
+			fmt.Fprintf(w, `{"results":[{"name":"p%d"}],"status":"success"}`, atomic.AddInt32(&prepared, 1))
+		case strings.HasPrefix(statement, "DELETE FROM system:prepareds"):
+			deallocated <- r.PostForm.Get("args")
+			<-release
+			w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+		default:
+			w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+		}
+	})
+	defer srv.Close()
+	defer close(release)
+	conn.preparedCache = newStmtCache(1)
+	db := &n1qlDB{conn: conn}
+
+	for _, statement := range []string{"DELETE FROM a", "DELETE FROM b"} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+	}
+	select {
+	case args := <-deallocated:
+		if args != `["p1"]` {
+			t.Errorf("Expected the evicted plan p1 to be deallocated, got %s", args)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The evicted plan was not deallocated")
+	}
+
+	// the cache is not held while the node answers the deallocation
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Exec("DELETE FROM b")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Exec failed.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exec waited for the deallocation")
+	}
+	if n := atomic.LoadInt32(&prepared); n != 2 {
+		t.Errorf("Expected 2 statements prepared, got %d", n)
+	}
+}
+
+func TestAdHoc(t *testing.T) {
+	requests := make(chan string, 10)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		requests <- statement + " " + r.PostForm.Get("args")
+		if strings.HasPrefix(statement, "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1}],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	rows, err := db.Query("SELECT a FROM b WHERE c = ? AND d = ?", AdHoc(true), 1, "x")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	if !rows.Next() {
+		t.Error("Expected a row")
+	}
+	rows.Close()
+	if r := <-requests; r != `SELECT a FROM b WHERE c = $1 AND d = $2 [1,"x"]` {
+		t.Errorf("Unexpected request %s", r)
+	}
+
+	adHoc := db.With(AdHoc(true))
+	if _, err := adHoc.Exec("DELETE FROM b"); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if r := <-requests; r != "DELETE FROM b " {
+		t.Errorf("Unexpected request %s", r)
+	}
+	if _, err := adHoc.Exec("DELETE FROM b", AdHoc(false)); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if r := <-requests; r != "PREPARE DELETE FROM b " {
+		t.Errorf("Expected the statement to be prepared, got %s", r)
+	}
+}
+
+func TestActiveRequests(t *testing.T) {
+	var canceled []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/admin/active_requests":
+			w.Write([]byte(`[{"requestId":"r1","clientContextID":"c1","statement":"SELECT * FROM default",` +
+				`"state":"running","users":"admin","requestTime":"2026-10-16 12:00:00.5 +0000 UTC",` +
+				`"elapsedTime":"1.5s","executionTime":"1.25s","phaseCounts":{"fetch":42}}]`))
+		case r.Method == "DELETE" && r.URL.Path == "/admin/active_requests/r1":
+			canceled = append(canceled, "r1")
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	requests, err := db.ActiveRequests(context.Background())
+	if err != nil {
+		t.Fatal("Failed to list the active requests.", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request, got %+v", requests)
+	}
+	r := requests[0]
+	if r.RequestID != "r1" || r.ClientContextID != "c1" || r.Node != srv.URL || r.State != "running" ||
+		r.ElapsedTime != 1500*time.Millisecond || r.ExecutionTime != 1250*time.Millisecond ||
+		r.PhaseCounts["fetch"] != 42 || !r.RequestTime.Equal(time.Date(2026, 10, 16, 12, 0, 0, 5e8, time.UTC)) {
+		t.Errorf("Unexpected request %+v", r)
+	}
+
+	if err := db.CancelRequest(context.Background(), "r1"); err != nil || len(canceled) != 1 {
+		t.Errorf("Expected the request to be canceled, got %v", err)
+	}
+	if err := db.CancelRequest(context.Background(), "r2"); err == nil {
+		t.Error("Expected no request r2 to be found")
+	}
+}
@@ -0,0 +1,94 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Most nested arrays and objects, and most bytes, of a result row.
+// Updated atomically.
+var maxRowDepth, maxRowSize int64
+
+// Limit the nesting of arrays and objects and the size in bytes of the
+// result rows decoded, for queries on untrusted documents. Rows going over
+// a limit fail Next with a *DecodeLimitError, before they are decoded.
+// Zero, the default, means no limit.
+func SetDecodeLimits(maxDepth int, maxSize int) {
+	atomic.StoreInt64(&maxRowDepth, int64(maxDepth))
+	atomic.StoreInt64(&maxRowSize, int64(maxSize))
+}
+
+// Returned by Next when a row goes over a limit set with SetDecodeLimits.
+type DecodeLimitError struct {
+	Limit string // "depth" or "size"
+	Max   int64
+	Row   int64 // from 1
+}
+
+func (e *DecodeLimitError) Error() string {
+	return fmt.Sprintf("N1QL: Result row %d goes over the %s limit of %d", e.Row, e.Limit, e.Max)
+}
+
+// The limits of the rows of a result set, as set when it was opened.
+type decodeLimits struct {
+	depth int64
+	size  int64
+}
+
+// nil when there are no limits
+func currentDecodeLimits() *decodeLimits {
+	l := &decodeLimits{depth: atomic.LoadInt64(&maxRowDepth), size: atomic.LoadInt64(&maxRowSize)}
+	if l.depth <= 0 && l.size <= 0 {
+		return nil
+	}
+	return l
+}
+
+// Check the JSON of the row-th row against the limits.
+func (l *decodeLimits) check(raw []byte, row int64) error {
+	if l.size > 0 && int64(len(raw)) > l.size {
+		return &DecodeLimitError{Limit: "size", Max: l.size, Row: row}
+	}
+	if l.depth > 0 && jsonDepth(raw) > l.depth {
+		return &DecodeLimitError{Limit: "depth", Max: l.depth, Row: row}
+	}
+	return nil
+}
+
+// The deepest nesting of arrays and objects of a JSON value.
+func jsonDepth(raw []byte) int64 {
+	var depth, deepest int64
+	inString := false
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '[', '{':
+			depth++
+			if depth > deepest {
+				deepest = depth
+			}
+		case ']', '}':
+			depth--
+		}
+	}
+	return deepest
+}
@@ -0,0 +1,85 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variable enabling dev mode for every connection when set to
+// a true value, such as "1" or "true", see Options.DevMode.
+const DevModeEnv = "GODBC_DEV_MODE"
+
+// Whether the connections opened from now on are in dev mode.
+var devMode = false
+
+// Open the connections from now on in dev mode, see Options.DevMode.
+func SetDevMode(enabled bool) {
+	devMode = enabled
+}
+
+// Whether the connection is to be opened in dev mode, by opts or by the
+// environment.
+func (opts *Options) devMode() bool {
+	if opts.DevMode {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(os.Getenv(DevModeEnv))
+	return enabled
+}
+
+// Time limits of the steps of Open in dev mode, where none is set, see
+// SetBootstrapTimeouts: a local cluster answers at once or not at all.
+const (
+	devConnectTimeout   = 2 * time.Second
+	devDiscoveryTimeout = 2 * time.Second
+	devHandshakeTimeout = 5 * time.Second
+)
+
+// Parameters of the requests in dev mode, unless they are set otherwise.
+var devModeParams = map[string]string{
+	"timeout": "30s",
+	"pretty":  "true",
+}
+
+// Time limits of the steps of Open.
+type bootstrapTimeouts struct {
+	connect, discovery, handshake time.Duration
+}
+
+// The time limits set with SetBootstrapTimeouts, or the ones of dev mode
+// for those not set.
+func openTimeouts(dev bool) bootstrapTimeouts {
+	t := bootstrapTimeouts{connect: connectTimeout, discovery: discoveryTimeout, handshake: handshakeTimeout}
+	if dev {
+		if t.connect <= 0 {
+			t.connect = devConnectTimeout
+		}
+		if t.discovery <= 0 {
+			t.discovery = devDiscoveryTimeout
+		}
+		if t.handshake <= 0 {
+			t.handshake = devHandshakeTimeout
+		}
+	}
+	return t
+}
+
+// The error of a request of the connection, along with its statement in
+// dev mode.
+func (conn *n1qlConn) verbose(err error, statement string) error {
+	if err == nil || !conn.devMode || statement == "" {
+		return err
+	}
+	return fmt.Errorf("%w [statement: %s]", err, statement)
+}
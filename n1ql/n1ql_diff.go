@@ -0,0 +1,227 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/couchbase/godbc"
+)
+
+// A row that differs between two result sets.
+type RowDiff struct {
+	Kind string // "removed" if only in a, "added" if only in b, or "changed"
+
+	// Value of the key of the row, for DiffRowsByKey, and its position in
+	// a, or in b if it was added, from 0.
+	Key   interface{}
+	Index int
+
+	// The row in a and in b, by column, nil if it is not in one of them.
+	A, B map[string]interface{}
+
+	// Columns whose values differ, sorted, for changed rows.
+	Columns []string
+}
+
+// Compare two result sets row by row, in order, e.g. the results of the
+// same query on two clusters. Both are read to the end and closed.
+func DiffRows(a, b godbc.Rows) ([]RowDiff, error) {
+	defer a.Close()
+	defer b.Close()
+	ra, rb := newDiffReader(a), newDiffReader(b)
+
+	var diffs []RowDiff
+	for i := 0; ; i++ {
+		rowA, err := ra.next()
+		if err != nil {
+			return nil, err
+		}
+		rowB, err := rb.next()
+		if err != nil {
+			return nil, err
+		}
+		if rowA == nil && rowB == nil {
+			return diffs, nil
+		}
+		if d, ok := diffRow(rowA, rowB); ok {
+			d.Index = i
+			diffs = append(diffs, d)
+		}
+	}
+}
+
+// Compare two result sets matching their rows by the value of column key,
+// or of the field key of the rows when they have a single column, whatever
+// their order. The rows of a are held in memory while b is read. Both are
+// read to the end and closed. Differences are reported in the order of b,
+// followed by the rows removed, in the order of a.
+func DiffRowsByKey(a, b godbc.Rows, key string) ([]RowDiff, error) {
+	defer a.Close()
+	defer b.Close()
+
+	type keyedRow struct {
+		row   map[string]interface{}
+		index int
+		key   interface{}
+		seen  bool
+	}
+	var order []*keyedRow
+	byKey := make(map[string]*keyedRow)
+	ra := newDiffReader(a)
+	for i := 0; ; i++ {
+		row, err := ra.next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		k, id, err := rowKey(row, key)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Row %d of the first result set: %w", i, err)
+		}
+		if _, dup := byKey[id]; dup {
+			return nil, fmt.Errorf("N1QL: Duplicate key %s in the first result set", id)
+		}
+		kr := &keyedRow{row: row, index: i, key: k}
+		byKey[id] = kr
+		order = append(order, kr)
+	}
+
+	var diffs []RowDiff
+	rb := newDiffReader(b)
+	for i := 0; ; i++ {
+		row, err := rb.next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		k, id, err := rowKey(row, key)
+		if err != nil {
+			return nil, fmt.Errorf("N1QL: Row %d of the second result set: %w", i, err)
+		}
+		kr, ok := byKey[id]
+		if !ok || kr.seen {
+			diffs = append(diffs, RowDiff{Kind: "added", Key: k, Index: i, B: row})
+			continue
+		}
+		kr.seen = true
+		if d, ok := diffRow(kr.row, row); ok {
+			d.Key, d.Index = k, kr.index
+			diffs = append(diffs, d)
+		}
+	}
+	for _, kr := range order {
+		if !kr.seen {
+			diffs = append(diffs, RowDiff{Kind: "removed", Key: kr.key, Index: kr.index, A: kr.row})
+		}
+	}
+	return diffs, nil
+}
+
+// The difference between two rows, either of which may be nil, if any.
+func diffRow(a, b map[string]interface{}) (RowDiff, bool) {
+	switch {
+	case b == nil:
+		return RowDiff{Kind: "removed", A: a}, true
+	case a == nil:
+		return RowDiff{Kind: "added", B: b}, true
+	}
+	var columns []string
+	for column, va := range a {
+		if vb, ok := b[column]; !ok || !reflect.DeepEqual(va, vb) {
+			columns = append(columns, column)
+		}
+	}
+	for column := range b {
+		if _, ok := a[column]; !ok {
+			columns = append(columns, column)
+		}
+	}
+	if len(columns) == 0 {
+		return RowDiff{}, false
+	}
+	sort.Strings(columns)
+	return RowDiff{Kind: "changed", A: a, B: b, Columns: columns}, true
+}
+
+// The value of the key of a row, and its JSON, which tells keys apart.
+func rowKey(row map[string]interface{}, key string) (interface{}, string, error) {
+	k, ok := row[key]
+	if !ok && len(row) == 1 {
+		for _, v := range row {
+			if fields, isObject := v.(map[string]interface{}); isObject {
+				k, ok = fields[key]
+			}
+		}
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("No key %s", key)
+	}
+	id, err := json.Marshal(k)
+	if err != nil {
+		return nil, "", err
+	}
+	return k, string(id), nil
+}
+
+// Reads the rows of a result set as maps of their columns.
+type diffReader struct {
+	rows    godbc.Rows
+	columns []string
+	raw     []json.RawMessage
+	dest    []interface{}
+	ended   bool
+}
+
+func newDiffReader(rows godbc.Rows) *diffReader {
+	return &diffReader{rows: rows}
+}
+
+// The next row, nil at the end of the results.
+func (r *diffReader) next() (map[string]interface{}, error) {
+	if r.ended {
+		return nil, nil
+	}
+	if !r.rows.Next() {
+		r.ended = true
+		return nil, r.rows.Err()
+	}
+	if r.columns == nil {
+		columns, err := r.rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		r.columns = columns
+		r.raw = make([]json.RawMessage, len(columns))
+		r.dest = make([]interface{}, len(columns))
+		for i := range r.raw {
+			r.dest[i] = &r.raw[i]
+		}
+	}
+	if err := r.rows.Scan(r.dest...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{}, len(r.columns))
+	for i, column := range r.columns {
+		var v interface{}
+		if err := json.Unmarshal(r.raw[i], &v); err != nil {
+			return nil, err
+		}
+		row[column] = v
+	}
+	return row, nil
+}
@@ -0,0 +1,64 @@
+package n1ql
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDiffRows(t *testing.T) {
+	results := map[string]string{
+		"a": `{"signature":{"id":"string","n":"number"},"results":[` +
+			`{"id":"u1","n":1},{"id":"u2","n":2},{"id":"u3","n":{"x":[1]}}],"status":"success"}`,
+		"b": `{"signature":{"id":"string","n":"number"},"results":[` +
+			`{"n":{"x":[1]},"id":"u3"},{"id":"u1","n":1.5},{"id":"u4","n":4}],"status":"success"}`,
+		"raw": `{"signature":"json","results":[{"id":"u2","n":2},{"id":"u1","n":1}],"status":"success"}`,
+	}
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Write([]byte(results[r.PostForm.Get("statement")]))
+	})
+	defer srv.Close()
+	query := func(name string) N1qlRows {
+		rows, err := conn.Query(name)
+		if err != nil {
+			t.Fatal("Query failed.", err)
+		}
+		return rows.(N1qlRows)
+	}
+
+	diffs, err := DiffRows(query("a"), query("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 {
+		t.Fatalf("Expected every row to differ, got %+v", diffs)
+	}
+	if diffs[0].Kind != "changed" || !reflect.DeepEqual(diffs[0].Columns, []string{"id", "n"}) ||
+		diffs[2].Index != 2 || diffs[2].A["id"] != "u3" || diffs[2].B["id"] != "u4" {
+		t.Errorf("Unexpected differences %+v", diffs)
+	}
+
+	diffs, err = DiffRowsByKey(query("a"), query("b"), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RowDiff{
+		{Kind: "changed", Key: "u1", Index: 0, A: map[string]interface{}{"id": "u1", "n": 1.0},
+			B: map[string]interface{}{"id": "u1", "n": 1.5}, Columns: []string{"n"}},
+		{Kind: "added", Key: "u4", Index: 2, B: map[string]interface{}{"id": "u4", "n": 4.0}},
+		{Kind: "removed", Key: "u2", Index: 1, A: map[string]interface{}{"id": "u2", "n": 2.0}},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, diffs)
+	}
+
+	// rows of a single column are keyed by their field
+	diffs, err = DiffRowsByKey(query("raw"), query("raw"), "id")
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("Expected no differences, got %+v, %v", diffs, err)
+	}
+	if _, err := DiffRowsByKey(query("a"), query("b"), "missing"); err == nil {
+		t.Error("Expected rows without the key to fail")
+	}
+}
@@ -0,0 +1,232 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Categories of the errors of requests, to test with errors.Is, whatever
+// the error code or the message.
+var (
+	ErrAuth               = errors.New("N1QL: Authentication failed")
+	ErrTimeout            = errors.New("N1QL: Request timed out")
+	ErrTxConflict         = errors.New("N1QL: Transaction conflict")
+	ErrServiceUnavailable = errors.New("N1QL: Service unavailable")
+)
+
+// Categories of the query service error codes.
+var errorCategories = map[int]error{
+	1080:  ErrTimeout,            // timeout exceeded
+	1117:  ErrServiceUnavailable, // request queue full
+	1180:  ErrServiceUnavailable, // service shutting down
+	1181:  ErrServiceUnavailable, // service shut down
+	1182:  ErrServiceUnavailable, // service unavailable
+	10000: ErrAuth,               // authentication failed
+	13014: ErrAuth,               // user does not have the privileges
+	12009: ErrTxConflict,         // DML error, CAS mismatch inside a transaction
+}
+
+// An error reported by the query service, from the errors of its response.
+// The fields are the ones of the first error, the one that made the request
+// fail; Errors holds them all. Callers get it with errors.As:
+//
+//	var qerr *n1ql.Error
+//	if errors.As(err, &qerr) && qerr.Code == 12003 {
+//		// the keyspace does not exist
+//	}
+type Error struct {
+	Code    int
+	Message string
+
+	// Whether the query service tells the request can be sent again
+	Retry bool
+
+	// Details some errors come with, such as the cause of a failed
+	// transaction, as sent by the server
+	Reason map[string]interface{}
+
+	// All the errors of the response, the first one included
+	Errors []Error
+
+	// The ID of the request, to find it in the logs of the server and in
+	// system:completed_requests
+	RequestID string
+
+	// The client_context_id the request was sent with, see ClientContextID;
+	// unlike the request ID, it is not part of the message
+	ClientContextID string
+
+	// the error as reported before: its text, and the driver errors it
+	// matches, such as ErrQuotaExceeded
+	err error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("N1QL: Code : %d Message : %s", e.Code, e.Message)
+	if e.err != nil {
+		msg = e.err.Error()
+	}
+	return msg + requestIDSuffix(e.RequestID)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Whether target is the category of the code of the error.
+func (e *Error) Is(target error) bool {
+	category, ok := errorCategories[e.Code]
+	return ok && target == category
+}
+
+// Whether the operation that failed with err may succeed if the application
+// runs it again, e.g. after a backoff: the query service reported a
+// temporary failure, or said the request can be retried, or no query node
+// answered. The whole transaction must be run again when err is a
+// transaction conflict. Failed authentications and requests whose context
+// is done are not retryable.
+//
+//	for attempt := 0; ; attempt++ {
+//		_, err = db.ExecContext(ctx, statement, args...)
+//		if err == nil || !n1ql.Retryable(err) || attempt == 3 {
+//			break
+//		}
+//		time.Sleep(backoff(attempt))
+//	}
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, ErrAuth) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if RetryClassOf(err) != RetryNever {
+		return true
+	}
+	var qerr *Error
+	if errors.As(err, &qerr) {
+		return qerr.Retry || errors.Is(err, ErrTimeout) || errors.Is(err, ErrServiceUnavailable)
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrServiceUnavailable) || errors.Is(err, ErrUnreachable) || errors.As(err, &netErr)
+}
+
+// Error of a request that did not succeed, according to the status of its
+// response, although the server reported no error, e.g. because it was
+// stopped. The rows returned before are still read, as Next reports it once
+// they are all read. A timeout status matches ErrTimeout.
+type StatusError struct {
+	Status          string
+	RequestID       string
+	ClientContextID string
+}
+
+func (e *StatusError) Error() string {
+	return "N1QL: Request ended with status " + e.Status + requestIDSuffix(e.RequestID)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrTimeout && e.Status == "timeout"
+}
+
+// The error of a response with the given status, nil if it succeeded. No
+// status is taken for a success.
+func statusError(status string) error {
+	switch status {
+	case "", "success", "completed":
+		return nil
+	}
+	return &StatusError{Status: status}
+}
+
+// The ID of the request that failed with err, as reported by the server,
+// "" if it is not known, e.g. because no query node answered.
+func RequestIDOf(err error) string {
+	var qerr *Error
+	if errors.As(err, &qerr) {
+		return qerr.RequestID
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RequestID
+	}
+	return ""
+}
+
+// Set the ID of the request that failed with err, if it is an error
+// reported by the server.
+func withRequestID(err error, requestID string) error {
+	if requestID == "" {
+		return err
+	}
+	var qerr *Error
+	if errors.As(err, &qerr) && qerr.RequestID == "" {
+		qerr.RequestID = requestID
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RequestID == "" {
+		statusErr.RequestID = requestID
+	}
+	return err
+}
+
+func requestIDSuffix(requestID string) string {
+	if requestID == "" {
+		return ""
+	}
+	return " (request " + requestID + ")"
+}
+
+// An error of the given category, when there is no server error to tell it.
+type categorized struct {
+	err      error
+	category error
+}
+
+func (e *categorized) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorized) Unwrap() error {
+	return e.err
+}
+
+func (e *categorized) Is(target error) bool {
+	return target == e.category
+}
+
+// The Error of the server errors errs, reported as err, nil if errs holds
+// none.
+func newError(err error, errs interface{}) *Error {
+	list, _ := errs.([]interface{})
+	var all []Error
+	for _, e := range list {
+		if e, ok := e.(map[string]interface{}); ok {
+			all = append(all, errorOf(e))
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	first := all[0]
+	first.Errors = all
+	first.err = err
+	return &first
+}
+
+func errorOf(e map[string]interface{}) Error {
+	code, _ := e["code"].(float64)
+	msg, _ := e["msg"].(string)
+	retry, _ := e["retry"].(bool)
+	reason, _ := e["reason"].(map[string]interface{})
+	return Error{Code: int(code), Message: msg, Retry: retry, Reason: reason}
+}
@@ -0,0 +1,157 @@
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestServerError(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("statement") == "SELECT * FROM missing" {
+			w.Write([]byte(`{"errors":[{"code":12003,"msg":"Keyspace not found in CB datastore: default:missing",` +
+				`"reason":{"keyspace":"missing"}},{"code":4000,"msg":"No index available"}],"status":"fatal"}`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"errors":[{"code":1080,"msg":"Timeout 1s exceeded","retry":true}],"status":"timeout"}`))
+	})
+	defer srv.Close()
+
+	_, err := conn.Exec("SELECT * FROM missing")
+	var qerr *Error
+	if !errors.As(err, &qerr) {
+		t.Fatalf("Expected an Error, got %v", err)
+	}
+	if qerr.Code != 12003 || qerr.Message != "Keyspace not found in CB datastore: default:missing" ||
+		qerr.Retry || qerr.Reason["keyspace"] != "missing" {
+		t.Errorf("Unexpected error %+v", qerr)
+	}
+	if len(qerr.Errors) != 2 || qerr.Errors[1].Code != 4000 {
+		t.Errorf("Expected all the errors of the response, got %+v", qerr.Errors)
+	}
+	if err.Error() != "N1QL: Error executing query Code : 12003 Message : Keyspace not found in CB datastore: default:missing "+
+		"Code : 4000 Message : No index available" {
+		t.Errorf("Unexpected message %q", err.Error())
+	}
+
+	_, err = conn.Exec("UPSERT INTO default VALUES ('k', 1)")
+	if !errors.As(err, &qerr) || qerr.Code != 1080 || !qerr.Retry {
+		t.Errorf("Expected a retryable timeout, got %v", err)
+	}
+	if RetryClassOf(err) != RetryIdempotent {
+		t.Errorf("Expected the retry class to be kept, got %v", RetryClassOf(err))
+	}
+}
+
+func TestErrorCategories(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.PostForm.Get("statement") {
+		case "AUTH":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "DOWN":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "PRIVILEGES":
+			w.Write([]byte(`{"errors":[{"code":13014,"msg":"User does not have credentials"}],"status":"fatal"}`))
+		case "TIMEOUT":
+			w.Write([]byte(`{"errors":[{"code":1080,"msg":"Timeout 1s exceeded"}],"status":"timeout"}`))
+		case "CONFLICT":
+			w.Write([]byte(`{"errors":[{"code":12009,"msg":"DML Error, possible causes include CAS mismatch"}],"status":"fatal"}`))
+		default:
+			w.Write([]byte(`{"errors":[{"code":3000,"msg":"syntax error"}],"status":"fatal"}`))
+		}
+	})
+	defer srv.Close()
+
+	cases := []struct {
+		statement string
+		category  error
+		retryable bool
+	}{
+		{"AUTH", ErrAuth, false},
+		{"PRIVILEGES", ErrAuth, false},
+		{"DOWN", ErrServiceUnavailable, true},
+		{"TIMEOUT", ErrTimeout, true},
+		{"CONFLICT", ErrTxConflict, true},
+		{"SYNTAX", nil, false},
+	}
+	categories := []error{ErrAuth, ErrTimeout, ErrTxConflict, ErrServiceUnavailable}
+	for _, c := range cases {
+		_, err := conn.Exec(c.statement)
+		if err == nil {
+			t.Fatalf("%s: expected an error", c.statement)
+		}
+		for _, category := range categories {
+			if errors.Is(err, category) != (category == c.category) {
+				t.Errorf("%s: errors.Is(%v) is %t", c.statement, category, !(category == c.category))
+			}
+		}
+		if Retryable(err) != c.retryable {
+			t.Errorf("%s: expected Retryable to be %t", c.statement, c.retryable)
+		}
+	}
+
+	if !Retryable(newBootstrapError(ErrUnreachable, "http://localhost:8093", nil, "unreachable")) {
+		t.Error("Expected unreachable nodes to be retryable")
+	}
+	if err := newBootstrapError(ErrUnauthorized, "http://localhost:8091", nil, "unauthorized"); !errors.Is(err, ErrAuth) || Retryable(err) {
+		t.Error("Expected unauthorized bootstraps to be authentication errors")
+	}
+	if Retryable(context.Canceled) || Retryable(nil) {
+		t.Error("Expected canceled requests not to be retryable")
+	}
+}
+
+func TestAuthorizationError(t *testing.T) {
+	const denied = `{"errors":[{"code":13014,"msg":"User does not have credentials to run SELECT queries ` +
+		`on default:travel-sample. Add role query_select on default:travel-sample to allow the statement to be run."}],` +
+		`"status":"fatal"}`
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		if preparing(r) {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(denied))
+	})
+	defer srv.Close()
+	conn.creds = &credentials{user: "app", password: "x"}
+
+	check := func(what string, err error) {
+		var authErr *AuthorizationError
+		if !errors.As(err, &authErr) {
+			t.Fatalf("%s: expected an AuthorizationError, got %v", what, err)
+		}
+		if authErr.User != "app" {
+			t.Errorf("%s: user %q", what, authErr.User)
+		}
+		if len(authErr.Keyspaces) != 1 || authErr.Keyspaces[0] != "`travel-sample`" {
+			t.Errorf("%s: keyspaces %q", what, authErr.Keyspaces)
+		}
+		if len(authErr.Roles) != 1 || authErr.Roles[0] != "query_select on default:travel-sample" {
+			t.Errorf("%s: roles %q", what, authErr.Roles)
+		}
+		var serverErr *Error
+		if !errors.Is(err, ErrAuth) || !errors.As(err, &serverErr) || serverErr.Code != 13014 {
+			t.Errorf("%s: the error of the server is lost: %v", what, err)
+		}
+	}
+
+	_, err := conn.Query("SELECT * FROM `travel-sample` WHERE type = ?", "hotel")
+	check("query", err)
+
+	stmt, err := conn.Prepare("SELECT * FROM `travel-sample` WHERE type = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = stmt.Exec("hotel")
+	check("prepared", err)
+
+	_, err = conn.Exec("SELECT 1")
+	var authErr *AuthorizationError
+	if !errors.As(err, &authErr) || authErr.Keyspaces != nil {
+		t.Errorf("expected no keyspaces, got %v", err)
+	}
+}
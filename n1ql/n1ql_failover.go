@@ -0,0 +1,399 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+// How a failover handle moves between its clusters, see OpenFailover.
+type FailoverOptions struct {
+	// How long the active cluster must fail the requests for being
+	// unreachable, without answering any of them, before the handle fails
+	// over to the next cluster. 30s if zero.
+	Window time.Duration
+
+	// How often the clusters of higher priority than the active one are
+	// pinged. The handle fails back to one of them once it answered every
+	// ping for Window. 10s if zero.
+	CheckInterval time.Duration
+
+	// Called when the handle moves from a cluster to another, with their
+	// positions in the list of the handle.
+	OnSwitch func(from, to int)
+}
+
+// Implements godbc.DB over the handles of a list of clusters, by priority,
+// sending the requests to one of them at a time.
+type failoverDB struct {
+	opts FailoverOptions
+
+	lock         sync.Mutex
+	clusters     []*failoverCluster
+	active       int
+	failingSince time.Time // zero while the active cluster answers
+	switching    bool
+	maxIdle      int
+	maxOpen      int
+	hasMaxIdle   bool
+	hasMaxOpen   bool
+
+	closed chan struct{}
+}
+
+type failoverCluster struct {
+	db           godbc.DB                 // nil until opened
+	open         func() (godbc.DB, error) // nil if given open
+	healthySince time.Time                // zero unless it answers the pings
+}
+
+// Open a handle on the first of a prioritized list of clusters that can be
+// reached, such as a primary cluster and its standby replicated with XDCR.
+// The whole handle fails over to the next cluster once the active one has
+// been unreachable for FailoverOptions.Window, and fails back to a cluster
+// of higher priority once it is healthy again for as long. The requests
+// failing meanwhile report their errors: the handle does not run them
+// again. Transactions and prepared statements stay on the cluster they
+// were begun or prepared on. The clusters are opened with opts, the ones
+// that could not be reached at first when the handle turns to them.
+func OpenFailover(dataSourceNames []string, opts Options, failoverOpts FailoverOptions) (godbc.DB, error) {
+	if len(dataSourceNames) == 0 {
+		return nil, fmt.Errorf("N1QL: No cluster to open")
+	}
+	clusters := make([]*failoverCluster, len(dataSourceNames))
+	for i, dsn := range dataSourceNames {
+		dsn := dsn
+		clusters[i] = &failoverCluster{open: func() (godbc.DB, error) {
+			return OpenWithOptions(dsn, opts)
+		}}
+	}
+
+	var err error
+	for i, c := range clusters {
+		if c.db, err = c.open(); err == nil {
+			return newFailover(clusters, i, failoverOpts), nil
+		}
+		if !clusterDown(err) {
+			break
+		}
+	}
+	for _, c := range clusters {
+		if c.db != nil {
+			c.db.Close()
+		}
+	}
+	return nil, err
+}
+
+// Same as OpenFailover, over handles opened by the caller, the first one
+// active.
+func NewFailover(dbs []godbc.DB, failoverOpts FailoverOptions) godbc.DB {
+	clusters := make([]*failoverCluster, len(dbs))
+	for i, db := range dbs {
+		clusters[i] = &failoverCluster{db: db}
+	}
+	return newFailover(clusters, 0, failoverOpts)
+}
+
+func newFailover(clusters []*failoverCluster, active int, opts FailoverOptions) *failoverDB {
+	if opts.Window <= 0 {
+		opts.Window = 30 * time.Second
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = 10 * time.Second
+	}
+	f := &failoverDB{opts: opts, clusters: clusters, active: active, closed: make(chan struct{})}
+	if len(clusters) > 1 {
+		go f.checkHealth()
+	}
+	return f
+}
+
+// Whether err tells the cluster cannot be reached, rather than that the
+// request failed.
+func clusterDown(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, ErrUnreachable) || errors.Is(err, ErrNoQueryService) ||
+		errors.Is(err, ErrServiceUnavailable) || errors.As(err, &netErr)
+}
+
+// The active cluster and its handle.
+func (f *failoverDB) current() (int, godbc.DB) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.active, f.clusters[f.active].db
+}
+
+// Account for the outcome of a request to cluster i, failing over to the
+// next cluster if the active one has been down for the window.
+func (f *failoverDB) report(i int, err error) {
+	f.lock.Lock()
+	if i != f.active {
+		f.lock.Unlock()
+		return
+	}
+	if !clusterDown(err) {
+		f.failingSince = time.Time{}
+		f.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if f.failingSince.IsZero() {
+		f.failingSince = now
+	}
+	if now.Sub(f.failingSince) < f.opts.Window || f.switching {
+		f.lock.Unlock()
+		return
+	}
+	f.switching = true
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		f.switching = false
+		f.lock.Unlock()
+	}()
+	for k := 1; k < len(f.clusters); k++ {
+		next := (i + k) % len(f.clusters)
+		if f.ensureOpen(next) == nil {
+			f.switchTo(i, next)
+			return
+		}
+	}
+}
+
+// Open cluster i, unless it is.
+func (f *failoverDB) ensureOpen(i int) error {
+	f.lock.Lock()
+	c := f.clusters[i]
+	if c.db != nil || c.open == nil {
+		f.lock.Unlock()
+		return nil
+	}
+	f.lock.Unlock()
+
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	select {
+	case <-f.closed:
+		db.Close()
+		return errorNoConnection
+	default:
+	}
+	if c.db != nil {
+		db.Close()
+		return nil
+	}
+	if f.hasMaxOpen {
+		db.SetMaxOpenConns(f.maxOpen)
+	}
+	if f.hasMaxIdle {
+		db.SetMaxIdleConns(f.maxIdle)
+	}
+	c.db = db
+	return nil
+}
+
+// Switch to cluster to, if cluster from is still the active one.
+func (f *failoverDB) switchTo(from, to int) {
+	f.lock.Lock()
+	if f.active != from || f.clusters[to].db == nil {
+		f.lock.Unlock()
+		return
+	}
+	f.active = to
+	f.failingSince = time.Time{}
+	for _, c := range f.clusters {
+		c.healthySince = time.Time{}
+	}
+	f.lock.Unlock()
+
+	logger.Printf("N1QL: Moving from cluster %d to cluster %d", from, to)
+	if f.opts.OnSwitch != nil {
+		f.opts.OnSwitch(from, to)
+	}
+}
+
+// Ping the clusters of higher priority than the active one every
+// CheckInterval, failing back to the first one healthy for the window.
+func (f *failoverDB) checkHealth() {
+	ticker := time.NewTicker(f.opts.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-ticker.C:
+		}
+		active, _ := f.current()
+		for i := 0; i < active; i++ {
+			if f.healthy(i) {
+				f.switchTo(active, i)
+				break
+			}
+		}
+	}
+}
+
+// Whether cluster i answered the pings for the window.
+func (f *failoverDB) healthy(i int) bool {
+	err := f.ensureOpen(i)
+	f.lock.Lock()
+	db := f.clusters[i].db
+	f.lock.Unlock()
+	if err == nil && db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), f.opts.CheckInterval)
+		err = db.PingContext(ctx)
+		cancel()
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := f.clusters[i]
+	if err != nil || db == nil {
+		c.healthySince = time.Time{}
+		return false
+	}
+	now := time.Now()
+	if c.healthySince.IsZero() {
+		c.healthySince = now
+	}
+	return now.Sub(c.healthySince) >= f.opts.Window
+}
+
+func (f *failoverDB) Begin() (godbc.Tx, error) {
+	i, db := f.current()
+	tx, err := db.Begin()
+	f.report(i, err)
+	return tx, err
+}
+
+// Close the handles of all the clusters.
+func (f *failoverDB) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	select {
+	case <-f.closed:
+		return nil
+	default:
+	}
+	close(f.closed)
+	var err error
+	for _, c := range f.clusters {
+		if c.db != nil {
+			if cerr := c.db.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (f *failoverDB) Exec(query string, args ...interface{}) (godbc.Result, error) {
+	return f.ExecContext(context.Background(), query, args...)
+}
+
+func (f *failoverDB) ExecContext(ctx context.Context, query string, args ...interface{}) (godbc.Result, error) {
+	i, db := f.current()
+	res, err := db.ExecContext(ctx, query, args...)
+	f.report(i, err)
+	return res, err
+}
+
+func (f *failoverDB) Ping() error {
+	return f.PingContext(context.Background())
+}
+
+// Ping the active cluster.
+func (f *failoverDB) PingContext(ctx context.Context) error {
+	i, db := f.current()
+	err := db.PingContext(ctx)
+	f.report(i, err)
+	return err
+}
+
+func (f *failoverDB) Prepare(query string) (godbc.Stmt, error) {
+	return f.PrepareContext(context.Background(), query)
+}
+
+func (f *failoverDB) PrepareContext(ctx context.Context, query string) (godbc.Stmt, error) {
+	i, db := f.current()
+	stmt, err := db.PrepareContext(ctx, query)
+	f.report(i, err)
+	return stmt, err
+}
+
+func (f *failoverDB) Query(query string, args ...interface{}) (godbc.Rows, error) {
+	return f.QueryContext(context.Background(), query, args...)
+}
+
+func (f *failoverDB) QueryContext(ctx context.Context, query string, args ...interface{}) (godbc.Rows, error) {
+	i, db := f.current()
+	rows, err := db.QueryContext(ctx, query, args...)
+	f.report(i, err)
+	return rows, err
+}
+
+func (f *failoverDB) QueryRow(query string, args ...interface{}) godbc.Row {
+	i, db := f.current()
+	row := db.QueryRow(query, args...)
+	var err error
+	if r, ok := row.(interface{ Err() error }); ok {
+		err = r.Err()
+	}
+	f.report(i, err)
+	return row
+}
+
+// Applies to the handles of all the clusters, including the ones opened
+// later.
+func (f *failoverDB) SetMaxIdleConns(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.maxIdle, f.hasMaxIdle = n, true
+	for _, c := range f.clusters {
+		if c.db != nil {
+			c.db.SetMaxIdleConns(n)
+		}
+	}
+}
+
+// Applies to the handles of all the clusters, including the ones opened
+// later.
+func (f *failoverDB) SetMaxOpenConns(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.maxOpen, f.hasMaxOpen = n, true
+	for _, c := range f.clusters {
+		if c.db != nil {
+			c.db.SetMaxOpenConns(n)
+		}
+	}
+}
+
+// The statistics of the handle of the active cluster.
+func (f *failoverDB) Stats() godbc.DBStats {
+	_, db := f.current()
+	return db.Stats()
+}
@@ -0,0 +1,96 @@
+package n1ql
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+func TestFailover(t *testing.T) {
+	var primaryDown int32 = 1
+	primary, psrv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&primaryDown) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if preparing(r) {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[{"cluster":"primary"}],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer psrv.Close()
+	standby, ssrv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		if preparing(r) {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[{"cluster":"standby"}],"metrics":{"mutationCount":2},"status":"success"}`))
+	})
+	defer ssrv.Close()
+
+	switches := make(chan [2]int, 10)
+	db := NewFailover([]godbc.DB{&n1qlDB{conn: primary}, &n1qlDB{conn: standby}}, FailoverOptions{
+		Window:        50 * time.Millisecond,
+		CheckInterval: 10 * time.Millisecond,
+		OnSwitch:      func(from, to int) { switches <- [2]int{from, to} },
+	})
+	defer db.Close()
+
+	affected := func() int64 {
+		res, err := db.Exec("UPDATE default SET a = 1")
+		if err != nil {
+			return 0
+		}
+		n, _ := res.RowsAffected()
+		return n
+	}
+
+	// requests fail for the window before the handle fails over
+	if n := affected(); n != 0 {
+		t.Fatalf("Expected the primary to fail, got %d", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	affected()
+	if s := <-switches; s != [2]int{0, 1} {
+		t.Fatalf("Expected a failover to the standby, got %v", s)
+	}
+	if n := affected(); n != 2 {
+		t.Fatalf("Expected the standby to run the request, got %d", n)
+	}
+
+	// and fail back once the primary is healthy for the window
+	atomic.StoreInt32(&primaryDown, 0)
+	select {
+	case s := <-switches:
+		if s != [2]int{1, 0} {
+			t.Fatalf("Expected a failback to the primary, got %v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a failback to the primary")
+	}
+	if n := affected(); n != 1 {
+		t.Errorf("Expected the primary to run the request, got %d", n)
+	}
+}
+
+func preparing(r *http.Request) bool {
+	r.ParseForm()
+	return strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE")
+}
+
+func TestClusterDown(t *testing.T) {
+	if !clusterDown(newBootstrapError(ErrUnreachable, "http://localhost:8091", nil, "unreachable")) {
+		t.Error("Expected unreachable clusters to be down")
+	}
+	if clusterDown(newBootstrapError(ErrUnauthorized, "http://localhost:8091", nil, "unauthorized")) {
+		t.Error("Expected unauthorized requests not to take the cluster down")
+	}
+	if clusterDown(ErrTimeout) || clusterDown(nil) {
+		t.Error("Expected failed requests not to take the cluster down")
+	}
+}
@@ -0,0 +1,41 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Send the request with key as its client_context_id, the same for each
+// time the driver sends it again, and let the driver send it again when it
+// may have been partly executed, a timeout for one, as it does for read
+// only requests. The statement must be idempotent, e.g. an UPSERT of given
+// values: the query service does not deduplicate requests by their key, so
+// a statement sent again may be applied twice.
+//
+//	_, err := db.Exec("UPSERT INTO orders VALUES (?, ?)", n1ql.IdempotencyKey(orderID), orderID, order)
+func IdempotencyKey(key string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("client_context_id", key)
+		opts.idempotent = key != ""
+	}
+}
+
+// A random UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
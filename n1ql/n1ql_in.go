@@ -0,0 +1,82 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A slice bound as a single array parameter by ExpandIn.
+type arrayArg struct {
+	values interface{}
+}
+
+// Mark a slice argument of ExpandIn to be bound as one array parameter,
+// for IN ? or ANY v IN ? SATISFIES ... END, rather than expanded. The
+// statement text then stays the same whatever the length of the slice,
+// which suits prepared statements.
+func AsArray(values interface{}) interface{} {
+	return arrayArg{values: values}
+}
+
+// Expand the slice arguments bound to ? placeholders, which N1QL cannot
+// bind as they are. Each slice becomes an array of placeholders, one per
+// element:
+//
+//	query, args, err := n1ql.ExpandIn("SELECT * FROM b WHERE id IN ?", []string{"a", "b"})
+//	// SELECT * FROM b WHERE id IN [?, ?], with args "a", "b"
+//
+// Slices marked with AsArray are bound as a single JSON array instead.
+// Strings and []byte, which hold a JSON value, are left as they are.
+func ExpandIn(query string, args ...interface{}) (string, []interface{}, error) {
+	if n := strings.Count(query, "?"); n != len(args) {
+		return "", nil, fmt.Errorf("N1QL: Argument count mismatch %d != %d", n, len(args))
+	}
+
+	var buf strings.Builder
+	expanded := make([]interface{}, 0, len(args))
+	rest := query
+	for _, arg := range args {
+		i := strings.IndexByte(rest, '?')
+		buf.WriteString(rest[:i])
+		rest = rest[i+1:]
+
+		if a, ok := arg.(arrayArg); ok {
+			b, err := json.Marshal(a.values)
+			if err != nil {
+				return "", nil, fmt.Errorf("N1QL: Cannot bind array parameter: %w", err)
+			}
+			buf.WriteByte('?')
+			expanded = append(expanded, b)
+			continue
+		}
+
+		v := reflect.ValueOf(arg)
+		if arg == nil || v.Kind() != reflect.Slice && v.Kind() != reflect.Array || v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.WriteByte('?')
+			expanded = append(expanded, arg)
+			continue
+		}
+		buf.WriteByte('[')
+		for j := 0; j < v.Len(); j++ {
+			if j > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteByte('?')
+			expanded = append(expanded, v.Index(j).Interface())
+		}
+		buf.WriteByte(']')
+	}
+	buf.WriteString(rest)
+	return buf.String(), expanded, nil
+}
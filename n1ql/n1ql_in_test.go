@@ -0,0 +1,61 @@
+package n1ql
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExpandIn(t *testing.T) {
+	query, args, err := ExpandIn("SELECT * FROM b WHERE id IN ? AND type = ? AND n IN ? AND x IN ?",
+		[]string{"a", "b"}, "user", []int{}, AsArray([]int{1, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "SELECT * FROM b WHERE id IN [?, ?] AND type = ? AND n IN [] AND x IN ?" {
+		t.Errorf("Unexpected query %s", query)
+	}
+	if fmt.Sprintf("%q", args) != `["a" "b" "user" "[1,2]"]` {
+		t.Errorf("Unexpected args %q", args)
+	}
+
+	if _, _, err := ExpandIn("SELECT ? + ?", 1); err == nil {
+		t.Error("Expected an argument count mismatch")
+	}
+	if _, _, err := ExpandIn("SELECT ?", AsArray([]interface{}{make(chan int)})); err == nil {
+		t.Error("Expected an error for values that are not JSON")
+	}
+
+	var statement, posArgs string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		statement, posArgs = r.PostForm.Get("statement"), r.PostForm.Get("args")
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":0},"status":"success"}`))
+	})
+	defer srv.Close()
+
+	query, args, _ = ExpandIn("DELETE FROM b WHERE id IN ?", []string{"a", "b"})
+	if _, err := conn.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+	if statement != `DELETE FROM b WHERE id IN [$1, $2]` || posArgs != `["a","b"]` {
+		t.Errorf("Unexpected statement %s with args %s", statement, posArgs)
+	}
+
+	query, args, _ = ExpandIn("DELETE FROM b WHERE id IN ?", AsArray([]string{"a", "b"}))
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.Exec(args...); err != nil {
+		t.Fatal(err)
+	}
+	if posArgs != `[["a","b"]]` {
+		t.Errorf("Unexpected positional args %s", posArgs)
+	}
+}
@@ -0,0 +1,59 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// Set when Rows and Stmts are tracked for leaks. Updated atomically.
+var leakDetection int32
+
+// Debug mode: record where each Rows and Stmt is created, and log the ones
+// that are garbage collected without having been closed, along with that
+// stack. Leaked Rows are closed at that point, which stops the goroutine
+// that would otherwise stay blocked delivering their results.
+// Recording the stacks has a cost: this is not meant for production use.
+func SetLeakDetection(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&leakDetection, v)
+}
+
+func trackRows(rows *n1qlRows) {
+	if atomic.LoadInt32(&leakDetection) == 0 {
+		return
+	}
+	stack := debug.Stack()
+	runtime.SetFinalizer(rows, func(rows *n1qlRows) {
+		if rows.closed {
+			return
+		}
+		logger.Printf("N1QL: Rows garbage collected without being closed. Created at:\n%s", stack)
+		close(rows.done)
+	})
+}
+
+func trackStmt(stmt *n1qlStmt) {
+	if atomic.LoadInt32(&leakDetection) == 0 {
+		return
+	}
+	stack := debug.Stack()
+	runtime.SetFinalizer(stmt, func(stmt *n1qlStmt) {
+		if stmt.prepared == "" {
+			return
+		}
+		logger.Printf("N1QL: Stmt garbage collected without being closed. Created at:\n%s", stack)
+	})
+}
@@ -0,0 +1,69 @@
+package n1ql
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...interface{}) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+func openLeakedRows(conn *n1qlConn, t *testing.T) {
+	if _, err := conn.Query("SELECT a FROM default"); err != nil {
+		t.Fatal("Query failed.", err)
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	logged := make(chanLogger, 10)
+	SetLogger(logged)
+	defer SetLogger(nil)
+	SetLeakDetection(true)
+	defer SetLeakDetection(false)
+
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1},{"a":2},{"a":3}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	rows.Close()
+	openLeakedRows(conn, t)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case msg := <-logged:
+			if !strings.Contains(msg, "Rows garbage collected") || !strings.Contains(msg, "openLeakedRows") {
+				t.Errorf("Unexpected leak report %s", msg)
+			}
+			for conn.stats.snapshot().BufferedResultSets() != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("Expected the leaked rows to release their results")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			select {
+			case msg := <-logged:
+				t.Errorf("Expected a single leak report, got %s", msg)
+			default:
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the leaked rows to be reported")
+		}
+	}
+}
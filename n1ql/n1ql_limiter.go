@@ -0,0 +1,178 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Priority of a request waiting for an in-flight slot.
+type RequestPriority int
+
+const (
+	PriorityLow RequestPriority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = 3
+)
+
+// Give the request the given priority when the connection has as many
+// requests in flight as SetMaxInFlight allows: the waiting requests of
+// higher priority are sent first. Requests have PriorityNormal by default.
+func Priority(p RequestPriority) QueryOption {
+	return func(opts *queryOptions) {
+		if p < PriorityLow {
+			p = PriorityLow
+		} else if p > PriorityHigh {
+			p = PriorityHigh
+		}
+		opts.priority = p
+		opts.hasPriority = true
+	}
+}
+
+// Most requests a connection has in flight, zero for no limit, and how long
+// a request may wait before it goes ahead of those of higher priority.
+var maxInFlight = 0
+var priorityAging = time.Second
+
+// Limit the requests each connection opened from now on has in flight, from
+// the time they are sent until their response is read in full, their context
+// is done or their response is closed. Requests over the limit wait, by
+// priority; one waiting longer than aging goes first whatever its priority,
+// so that background work is not starved. Pass 0 to remove the limit.
+func SetMaxInFlight(limit int, aging time.Duration) {
+	maxInFlight = limit
+	priorityAging = aging
+}
+
+// Admits requests up to a limit, queueing the others by priority.
+type inFlightLimiter struct {
+	lock    sync.Mutex
+	limit   int
+	aging   time.Duration
+	active  int
+	waiting [numPriorities][]*limiterWaiter
+}
+
+type limiterWaiter struct {
+	ready chan struct{}
+	since time.Time
+}
+
+// nil, which admits everything, when there is no limit
+func newInFlightLimiter(limit int, aging time.Duration) *inFlightLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &inFlightLimiter{limit: limit, aging: aging}
+}
+
+// Wait for a slot, until ctx is done.
+func (l *inFlightLimiter) acquire(ctx context.Context, p RequestPriority) error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	if l.active < l.limit && l.numWaiting() == 0 {
+		l.active++
+		l.lock.Unlock()
+		return nil
+	}
+	w := &limiterWaiter{ready: make(chan struct{}), since: time.Now()}
+	l.waiting[p] = append(l.waiting[p], w)
+	l.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		select {
+		case <-w.ready:
+			// granted meanwhile: hand the slot over
+			l.releaseLocked()
+		default:
+			l.remove(p, w)
+		}
+		return fmt.Errorf("N1QL: Request aborted while waiting to be sent: %w", ctx.Err())
+	}
+}
+
+// Give the slot to the next waiting request, if any.
+func (l *inFlightLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	l.releaseLocked()
+	l.lock.Unlock()
+}
+
+func (l *inFlightLimiter) releaseLocked() {
+	w := l.next()
+	if w == nil {
+		l.active--
+		return
+	}
+	close(w.ready)
+}
+
+// The waiter that goes next: the oldest one past the aging delay, otherwise
+// the oldest one of the highest priority.
+func (l *inFlightLimiter) next() *limiterWaiter {
+	pick := -1
+	now := time.Now()
+	for p := range l.waiting {
+		if len(l.waiting[p]) == 0 {
+			continue
+		}
+		w := l.waiting[p][0]
+		if now.Sub(w.since) >= l.aging && (pick < 0 || w.since.Before(l.waiting[pick][0].since)) {
+			pick = p
+		}
+	}
+	if pick < 0 {
+		for p := numPriorities - 1; p >= 0; p-- {
+			if len(l.waiting[p]) > 0 {
+				pick = p
+				break
+			}
+		}
+	}
+	if pick < 0 {
+		return nil
+	}
+	w := l.waiting[pick][0]
+	l.waiting[pick] = l.waiting[pick][1:]
+	return w
+}
+
+func (l *inFlightLimiter) numWaiting() int {
+	n := 0
+	for p := range l.waiting {
+		n += len(l.waiting[p])
+	}
+	return n
+}
+
+func (l *inFlightLimiter) remove(p RequestPriority, w *limiterWaiter) {
+	for i, o := range l.waiting[p] {
+		if o == w {
+			l.waiting[p] = append(l.waiting[p][:i], l.waiting[p][i+1:]...)
+			return
+		}
+	}
+}
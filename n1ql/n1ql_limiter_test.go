@@ -0,0 +1,255 @@
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Queue a waiter of the given priority and wait until it is queued
+func queueWaiter(t *testing.T, l *inFlightLimiter, p RequestPriority, admitted chan<- RequestPriority) {
+	go func() {
+		if err := l.acquire(context.Background(), p); err != nil {
+			t.Error(err)
+			return
+		}
+		admitted <- p
+	}()
+	for {
+		l.lock.Lock()
+		n := len(l.waiting[p])
+		l.lock.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterPriorities(t *testing.T) {
+	l := newInFlightLimiter(1, time.Hour)
+	if err := l.acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan RequestPriority, 3)
+	queueWaiter(t, l, PriorityLow, admitted)
+	queueWaiter(t, l, PriorityNormal, admitted)
+	queueWaiter(t, l, PriorityHigh, admitted)
+
+	for _, want := range []RequestPriority{PriorityHigh, PriorityNormal, PriorityLow} {
+		l.release()
+		if got := <-admitted; got != want {
+			t.Errorf("Expected priority %d to be admitted, got %d", want, got)
+		}
+	}
+	l.release()
+	if l.active != 0 {
+		t.Errorf("Expected no request in flight, got %d", l.active)
+	}
+}
+
+func TestLimiterAging(t *testing.T) {
+	l := newInFlightLimiter(1, 20*time.Millisecond)
+	l.acquire(context.Background(), PriorityNormal)
+
+	admitted := make(chan RequestPriority, 2)
+	queueWaiter(t, l, PriorityLow, admitted)
+	time.Sleep(30 * time.Millisecond)
+	queueWaiter(t, l, PriorityHigh, admitted)
+
+	l.release()
+	if got := <-admitted; got != PriorityLow {
+		t.Errorf("Expected the starving request to go first, got priority %d", got)
+	}
+	l.release()
+	<-admitted
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := newInFlightLimiter(1, time.Hour)
+	l.acquire(context.Background(), PriorityNormal)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx, PriorityHigh); err == nil {
+		t.Fatal("Expected the wait to be aborted")
+	}
+	if l.numWaiting() != 0 {
+		t.Errorf("Expected the aborted request to leave the queue")
+	}
+	l.release()
+	if l.active != 0 {
+		t.Errorf("Expected no request in flight, got %d", l.active)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1}],"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.limiter = newInFlightLimiter(1, time.Second)
+
+	for i := 0; i < 3; i++ {
+		rows, err := conn.Query("SELECT a FROM default", Priority(PriorityLow))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if _, err := conn.Exec("DELETE FROM default", Priority(PriorityHigh)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the slot is given back once the rows are done with the response
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn.limiter.lock.Lock()
+		active := conn.limiter.active
+		conn.limiter.lock.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the slots to be released, %d still held", active)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInFlightReleasedWithoutClose(t *testing.T) {
+	hold := make(chan struct{})
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("statement") == "SELECT 1" {
+			// the results do not end before the test does
+			w.Write([]byte(`{"results":[{"a":1},`))
+			w.(http.Flusher).Flush()
+			<-hold
+			return
+		}
+		w.Write([]byte(`{"results":[1,2,3,4,5,6,7,8],"status":"success"}`))
+	})
+	defer srv.Close()
+	defer close(hold)
+	conn.limiter = newInFlightLimiter(1, time.Second)
+
+	// rows left open once they are all read
+	rows, err := conn.Query("SELECT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if rows, err := conn.QueryContext(ctx, "SELECT 2"); err != nil {
+		t.Fatalf("Expected the slot of the read rows back, got %v", err)
+	} else {
+		rows.Close()
+	}
+
+	// rows left open once their request is canceled
+	reqCtx, cancelReq := context.WithCancel(context.Background())
+	open, err := conn.QueryContext(reqCtx, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	cancelReq()
+	if rows, err := conn.QueryContext(ctx, "SELECT 2"); err != nil {
+		t.Fatalf("Expected the slot of the canceled request back, got %v", err)
+	} else {
+		rows.Close()
+	}
+}
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	l := newNodeLimiters(&AdaptiveConcurrency{Initial: 8, Max: 9})
+	const node = "http://q1:8093/query/service"
+	overload := classify(errors.New("queue full"), []interface{}{map[string]interface{}{"code": 1117.0, "msg": "Request queue full"}})
+
+	sent := time.Now()
+	l.done(node, sent, overload)
+	if limit := l.limits()[stripurl(node)]; limit != 4 {
+		t.Fatalf("Expected the limit cut to 4, got %d", limit)
+	}
+	// sent before the cut: already accounted for
+	l.done(node, sent, overload)
+	if limit := l.limits()[stripurl(node)]; limit != 4 {
+		t.Fatalf("Expected the limit to stay at 4, got %d", limit)
+	}
+
+	// grows by one every limit requests as fast as the fastest
+	for i := 0; i < 5; i++ {
+		l.done(node, time.Now().Add(-10*time.Millisecond), nil)
+	}
+	if limit := l.limits()[stripurl(node)]; limit != 5 {
+		t.Fatalf("Expected the limit grown to 5, got %d", limit)
+	}
+	// but not when the node slows down
+	for i := 0; i < 20; i++ {
+		l.done(node, time.Now().Add(-time.Second), nil)
+	}
+	if limit := l.limits()[stripurl(node)]; limit != 5 {
+		t.Fatalf("Expected the limit to stay at 5, got %d", limit)
+	}
+	for i := 0; i < 100; i++ {
+		l.done(node, time.Now().Add(-10*time.Millisecond), nil)
+	}
+	if limit := l.limits()[stripurl(node)]; limit != 9 {
+		t.Fatalf("Expected the limit capped at 9, got %d", limit)
+	}
+}
+
+func TestAdaptiveConcurrencyRequests(t *testing.T) {
+	hold := make(chan struct{})
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("statement") == "SELECT 1" {
+			w.Write([]byte(`{"results":[{"a":1},`))
+			w.(http.Flusher).Flush()
+			<-hold
+			w.Write([]byte(`{"a":2}],"status":"success"}`))
+			return
+		}
+		if r.PostForm.Get("statement") == "SELECT 2" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"errors":[{"code":1117,"msg":"Request queue full"}],"status":"fatal"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[{"a":1}],"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.nodeLimiters = newNodeLimiters(&AdaptiveConcurrency{Initial: 2})
+	db := &n1qlDB{conn: conn}
+
+	// the node is full while the first rows are open
+	rows, err := conn.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec("SELECT 2"); !errors.Is(err, ErrServiceUnavailable) {
+		t.Fatalf("Expected the queue of the node to be full, got %v", err)
+	}
+	if limit := db.NodeConcurrency()[stripurl(srv.URL)]; limit != 1 {
+		t.Fatalf("Expected the limit cut to 1, got %v", db.NodeConcurrency())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := conn.QueryContext(ctx, "SELECT 3"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected to wait for the node, got %v", err)
+	}
+
+	close(hold)
+	rows.Close()
+	rows, err = conn.Query("SELECT 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+}
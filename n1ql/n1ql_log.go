@@ -0,0 +1,37 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"log"
+)
+
+// Destination of the messages logged by the driver. *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Logs through the standard logger of the log package
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+var logger Logger = stdLogger{}
+
+// Send the messages logged by the driver to l instead of the standard
+// logger. Passing nil restores the standard logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	logger = l
+}
@@ -0,0 +1,81 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Metrics of a request, as reported by the query service once it ended.
+// The counts the server did not report are zero.
+type Metrics struct {
+	ElapsedTime   time.Duration // from the request being received until the response was sent
+	ExecutionTime time.Duration // spent executing the statement
+	ResultCount   int64
+	ResultSize    int64 // bytes of the results
+	MutationCount int64
+	ErrorCount    int64
+}
+
+// The metrics as the server sends them: durations as strings such as
+// "1.5ms", counts as numbers, which may not fit in an int64: those are
+// capped.
+type metricsJSON struct {
+	ElapsedTime   string      `json:"elapsedTime"`
+	ExecutionTime string      `json:"executionTime"`
+	ResultCount   json.Number `json:"resultCount"`
+	ResultSize    json.Number `json:"resultSize"`
+	MutationCount json.Number `json:"mutationCount"`
+	ErrorCount    json.Number `json:"errorCount"`
+}
+
+// nil if the server sent no metrics.
+func (m *metricsJSON) metrics() *Metrics {
+	if m == nil {
+		return nil
+	}
+	count := func(n json.Number) int64 {
+		i, _ := strconv.ParseInt(string(n), 10, 64)
+		return i
+	}
+	elapsed, _ := time.ParseDuration(m.ElapsedTime)
+	execution, _ := time.ParseDuration(m.ExecutionTime)
+	return &Metrics{
+		ElapsedTime:   elapsed,
+		ExecutionTime: execution,
+		ResultCount:   count(m.ResultCount),
+		ResultSize:    count(m.ResultSize),
+		MutationCount: count(m.MutationCount),
+		ErrorCount:    count(m.ErrorCount),
+	}
+}
+
+// The result count reported by the server, if it reported one.
+func (m *metricsJSON) resultCount() (int64, bool) {
+	if m == nil || m.ResultCount == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(m.ResultCount), 10, 64)
+	return n, err == nil
+}
+
+// The metrics of raw, as sent by the server, nil if there are none.
+func parseMetrics(raw json.RawMessage) *Metrics {
+	if len(raw) == 0 {
+		return nil
+	}
+	var m metricsJSON
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil
+	}
+	return m.metrics()
+}
@@ -0,0 +1,281 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A QueryOption changes how a single request is executed. Options can be
+// passed anywhere in the argument list of Query, Exec and their variants,
+// and are not counted as positional arguments.
+//
+//	rows, err := db.Query("SELECT * FROM orders WHERE id = ?", n1ql.MemoryQuota(256), id)
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	params map[string]string
+
+	// client side only, never sent to the server
+	priority    RequestPriority
+	hasPriority bool
+	node        string
+	nodeIndex   int
+	hasNode     bool
+	tx          *txState
+	txStmt      int
+	hasTxStmt   bool
+	route       Service
+	hasRoute    bool
+	adHoc       bool
+	idempotent  bool
+
+	// bound with Named, by $name, encoded by the connection
+	named map[string]interface{}
+
+	// applied to the rows, see Transform
+	transforms []RowTransform
+
+	// of an argument that could not be encoded, failing the request
+	err error
+}
+
+func (opts *queryOptions) setParam(key, value string) {
+	if opts.params == nil {
+		opts.params = make(map[string]string)
+	}
+	opts.params[key] = value
+}
+
+// the priority of the request, PriorityNormal unless set
+func (opts *queryOptions) requestPriority() RequestPriority {
+	if opts == nil || !opts.hasPriority {
+		return PriorityNormal
+	}
+	return opts.priority
+}
+
+// the transaction the request belongs to, nil if none was begun with Begin
+func (opts *queryOptions) transaction() *txState {
+	if opts == nil {
+		return nil
+	}
+	return opts.tx
+}
+
+// apply the per-request REST parameters, overriding connection defaults
+func (opts *queryOptions) setQueryParams(v *url.Values) {
+	if opts == nil {
+		return
+	}
+	for key, value := range opts.params {
+		v.Set(key, value)
+	}
+}
+
+// Separate the query options and named arguments from the positional
+// arguments.
+func splitQueryOptions(args []interface{}) (*queryOptions, []interface{}) {
+	var opts *queryOptions
+	var newArgs []interface{}
+
+	for i, arg := range args {
+		var opt QueryOption
+		switch arg := arg.(type) {
+		case QueryOption:
+			opt = arg
+		case NamedArgs:
+			opt = arg.bind
+		default:
+			if newArgs != nil {
+				newArgs = append(newArgs, arg)
+			}
+			continue
+		}
+		if opts == nil {
+			opts = &queryOptions{}
+			newArgs = make([]interface{}, i, len(args))
+			copy(newArgs, args[:i])
+		}
+		opt(opts)
+	}
+
+	if opts == nil {
+		return nil, args
+	}
+	return opts, newArgs
+}
+
+// Prepend the given default options to the arguments, so that options
+// passed with the arguments override them.
+func withDefaultOptions(defaults []QueryOption, args []interface{}) []interface{} {
+	if len(defaults) == 0 {
+		return args
+	}
+	newArgs := make([]interface{}, 0, len(defaults)+len(args))
+	for _, opt := range defaults {
+		newArgs = append(newArgs, opt)
+	}
+	return append(newArgs, args...)
+}
+
+// Resolve unqualified keyspace names in the statement against the given
+// bucket and scope, e.g. "default:travel-sample.inventory".
+func QueryContext(queryContext string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("query_context", queryContext)
+	}
+}
+
+// Reject statements that would modify data.
+func ReadOnly(readonly bool) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("readonly", strconv.FormatBool(readonly))
+	}
+}
+
+// Set the server side timeout of the request.
+func Timeout(d time.Duration) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("timeout", d.String())
+	}
+}
+
+// Limit the memory, in megabytes, the request may use on the query node.
+// Requests going over it fail with ErrQuotaExceeded.
+func MemoryQuota(mb uint) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("memory_quota", strconv.FormatUint(uint64(mb), 10))
+	}
+}
+
+// Limit the number of items each operator of the execution pipeline may
+// buffer, bounding the resources the request holds on the query node.
+func PipelineCap(n int) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("pipeline_cap", strconv.Itoa(n))
+	}
+}
+
+// Limit the number of items each operator of the execution pipeline sends
+// to the next one at a time.
+func PipelineBatch(n int) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("pipeline_batch", strconv.Itoa(n))
+	}
+}
+
+// Limit the number of operators the query node runs in parallel for the
+// request, 1 to run them one at a time.
+func MaxParallelism(n int) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("max_parallelism", strconv.Itoa(n))
+	}
+}
+
+// Limit the number of index keys the index scans of the request buffer.
+func ScanCap(n int) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("scan_cap", strconv.Itoa(n))
+	}
+}
+
+// Set the scan consistency of the request: "not_bounded" or "request_plus".
+func ScanConsistency(consistency string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("scan_consistency", consistency)
+	}
+}
+
+// Ask the server to return the mutation tokens of the documents changed by
+// the statement, available through N1qlResult.MutationTokens.
+func MutationTokens() QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("mutation_token", "true")
+	}
+}
+
+// Wait for the indexes to include at least the given mutations, as returned
+// by N1qlResult.MutationTokens, before scanning.
+func AtPlus(scanVectors json.RawMessage) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("scan_consistency", "at_plus")
+		opts.setParam("scan_vectors", string(scanVectors))
+	}
+}
+
+// Send the request to the query node with the given address, either its
+// host:port or its query endpoint as listed by N1qlDB.QueryNodes, instead of
+// balancing it over the nodes, e.g. to compare the plans of the nodes or to
+// run an admin statement on a given node. A pinned request that cannot reach
+// its node fails rather than going to another node, and the node stays in
+// the list of the connection. Statements of a transaction always go to the
+// node of the transaction.
+func Node(address string) QueryOption {
+	return func(opts *queryOptions) {
+		opts.node = address
+		opts.hasNode = true
+	}
+}
+
+// Send the request to the query node at index i of N1qlDB.QueryNodes, as
+// Node does.
+func NodeIndex(i int) QueryOption {
+	return func(opts *queryOptions) {
+		opts.node = ""
+		opts.nodeIndex = i
+		opts.hasNode = true
+	}
+}
+
+// Tell the driver whether the statement starts (TX_START), commits
+// (TX_COMMIT) or rolls back (TX_ROLLBACK) the transaction of the connection,
+// or is none of these (TX_NONE), instead of guessing it from the first
+// words of the statement, see SetTxSniffing.
+//
+//	_, err := db.Exec("BEGIN WORK", n1ql.TxStatement(n1ql.TX_START))
+func TxStatement(kind int) QueryOption {
+	return func(opts *queryOptions) {
+		opts.txStmt = kind
+		opts.hasTxStmt = true
+	}
+}
+
+// Bind the named parameter $name of the statement to value, which is
+// encoded as positional arguments are, by the ArgEncoder of the connection.
+// The name may be given with or without its $.
+//
+//	rows, err := db.Query("SELECT * FROM b WHERE city = $city", n1ql.Named("city", "Paris"))
+func Named(name string, value interface{}) QueryOption {
+	key := "$" + strings.TrimPrefix(name, "$")
+	return func(opts *queryOptions) {
+		if opts.named == nil {
+			opts.named = make(map[string]interface{})
+		}
+		opts.named[key] = value
+	}
+}
+
+// Named parameters of a statement, passed among its arguments to bind each
+// of them as Named does.
+//
+//	rows, err := db.Query("SELECT * FROM b WHERE city = $city AND age > $age",
+//		n1ql.NamedArgs{"city": "Paris", "age": 30})
+type NamedArgs map[string]interface{}
+
+func (args NamedArgs) bind(opts *queryOptions) {
+	for name, value := range args {
+		Named(name, value)(opts)
+	}
+}
@@ -0,0 +1,245 @@
+package n1ql
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitQueryOptions(t *testing.T) {
+	args := []interface{}{"a", MemoryQuota(128), 2, PipelineCap(64)}
+	opts, rest := splitQueryOptions(args)
+	if len(rest) != 2 || rest[0] != "a" || rest[1] != 2 {
+		t.Errorf("Unexpected arguments %v", rest)
+	}
+	if opts == nil || opts.params["memory_quota"] != "128" || opts.params["pipeline_cap"] != "64" {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+
+	args = []interface{}{"a", 2}
+	opts, rest = splitQueryOptions(args)
+	if opts != nil || len(rest) != 2 {
+		t.Errorf("Expected arguments to be passed through, got %v %+v", rest, opts)
+	}
+}
+
+func TestTypedOptions(t *testing.T) {
+	opts, _ := splitQueryOptions([]interface{}{Timeout(1500 * time.Millisecond), MaxParallelism(4),
+		ScanCap(512), PipelineBatch(16)})
+	expected := map[string]string{"timeout": "1.5s", "max_parallelism": "4", "scan_cap": "512",
+		"pipeline_batch": "16"}
+	for key, value := range expected {
+		if opts.params[key] != value {
+			t.Errorf("Expected %s=%s, got %q", key, value, opts.params[key])
+		}
+	}
+	if len(opts.params) != len(expected) {
+		t.Errorf("Unexpected parameters %v", opts.params)
+	}
+}
+
+func TestMemoryQuotaExceeded(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if q := r.PostForm.Get("memory_quota"); q != "10" {
+			t.Errorf("Expected memory_quota 10, got %q", q)
+		}
+		w.Write([]byte(`{"errors":[{"code":5500,"msg":"Request has exceeded memory quota"}],"status":"fatal"}`))
+	})
+	defer srv.Close()
+
+	_, err := conn.Exec("UPDATE default SET a = ?", MemoryQuota(10), 1)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	_, err = conn.Query("SELECT * FROM default", MemoryQuota(10))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+}
+
+func TestNodePinning(t *testing.T) {
+	node := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"results":[%q],"status":"success"}`, name)
+		}))
+	}
+	a, b := node("a"), node("b")
+	defer a.Close()
+	defer b.Close()
+	dead := deadEndpoint()
+	conn := &n1qlConn{client: HTTPClient, queryAPIs: []string{a.URL, b.URL, dead}}
+
+	queryNode := func(opt QueryOption) (string, error) {
+		rows, err := conn.Query("SELECT 1", opt)
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+		var name string
+		if !rows.Next() {
+			return "", rows.Err()
+		}
+		err = rows.Scan(&name)
+		return name, err
+	}
+
+	hostB, _ := url.Parse(b.URL)
+	for _, c := range []struct {
+		opt  QueryOption
+		want string
+	}{
+		{NodeIndex(0), "a"},
+		{NodeIndex(1), "b"},
+		{Node(a.URL), "a"},
+		{Node(hostB.Host), "b"},
+	} {
+		for i := 0; i < 5; i++ {
+			if got, err := queryNode(c.opt); err != nil || got != c.want {
+				t.Fatalf("Expected node %s, got %q, %v", c.want, got, err)
+			}
+		}
+	}
+
+	for _, opt := range []QueryOption{NodeIndex(3), NodeIndex(-1), Node("localhost:1")} {
+		if _, err := queryNode(opt); err == nil {
+			t.Error("Expected an unknown node to fail")
+		}
+	}
+	if _, err := queryNode(Node(dead)); err == nil {
+		t.Error("Expected the request pinned to a dead node to fail")
+	}
+	if len(conn.queryAPIs) != 3 {
+		t.Errorf("Expected the pinned node to stay listed, got %v", conn.queryAPIs)
+	}
+	nodes := (&n1qlDB{conn: conn}).QueryNodes()
+	if len(nodes) != 3 || nodes[1] != b.URL {
+		t.Errorf("Unexpected query nodes %v", nodes)
+	}
+}
+
+func TestKeyspaceConsistency(t *testing.T) {
+	keyspaces := statementKeyspaces("SELECT * FROM `orders`.inventory.`line-items` l JOIN default:customers c ON ... " +
+		"WHERE l.note = 'FROM notes' UNION SELECT * FROM (SELECT 1) AS s")
+	if len(keyspaces) != 2 || keyspacePath(keyspaces[0], "") != "orders.inventory.line-items" ||
+		keyspacePath(keyspaces[1], "default:travel.inventory") != "travel.inventory.customers" {
+		t.Errorf("Unexpected keyspaces %q", keyspaces)
+	}
+
+	if err := SetKeyspaceConsistency("orders.*", "request_plus"); err != nil {
+		t.Fatal(err)
+	}
+	defer UnsetKeyspaceConsistency("orders.*")
+	if err := SetKeyspaceConsistency("*", "not_bounded"); err != nil {
+		t.Fatal(err)
+	}
+	defer UnsetKeyspaceConsistency("*")
+	if err := SetKeyspaceConsistency("[", "request_plus"); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+	if err := SetKeyspaceConsistency("x", "at_plus"); err == nil {
+		t.Error("Expected an invalid consistency to fail")
+	}
+
+	var consistency string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		consistency = r.PostForm.Get("scan_consistency")
+		w.Write([]byte(`{"results":[],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	for _, c := range []struct {
+		statement string
+		opt       QueryOption
+		want      string
+	}{
+		{"SELECT * FROM orders.inventory.items", nil, "request_plus"},
+		{"SELECT * FROM items", QueryContext("default:orders.inventory"), "request_plus"},
+		{"SELECT * FROM `travel-sample` t JOIN orders.s.c o ON t.id = o.id", nil, "request_plus"},
+		{"SELECT * FROM `travel-sample`", nil, "not_bounded"},
+		{"SELECT 1", nil, ""},
+		{"SELECT * FROM orders.inventory.items", ScanConsistency("not_bounded"), "not_bounded"},
+	} {
+		args := []interface{}{}
+		if c.opt != nil {
+			args = append(args, c.opt)
+		}
+		rows, err := conn.Query(c.statement, args...)
+		if err != nil {
+			t.Fatal("Query failed.", err)
+		}
+		rows.Close()
+		if consistency != c.want {
+			t.Errorf("Expected %q for %s, got %q", c.want, c.statement, consistency)
+		}
+
+		stmt, err := conn.Prepare(c.statement)
+		if err != nil {
+			t.Fatal("Prepare failed.", err)
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+		if consistency != c.want {
+			t.Errorf("Expected %q for the prepared %s, got %q", c.want, c.statement, consistency)
+		}
+	}
+
+	conn.SetQueryParam("scan_consistency", "not_bounded")
+	rows, err := conn.Query("SELECT * FROM orders.inventory.items")
+	if err == nil {
+		rows.Close()
+	}
+	if consistency != "not_bounded" {
+		t.Errorf("Expected the connection's consistency to win, got %q", consistency)
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	var form url.Values
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		form = r.PostForm
+		w.Write([]byte(`{"results":[],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT * FROM b WHERE city = $city", Named("city", "Paris"))
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	rows.Close()
+	if form.Get("$city") != `"Paris"` || form.Get("statement") != "SELECT * FROM b WHERE city = $city" {
+		t.Errorf("Unexpected request %v", form)
+	}
+
+	stmt, err := conn.Prepare("SELECT * FROM b WHERE city = $city AND age > $age AND name = ?")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+	rows, err = stmt.Query(NamedArgs{"city": "Paris", "age": 30}, "x", Named("$tags", []byte(`["a"]`)))
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	rows.Close()
+	if form.Get("$city") != `"Paris"` || form.Get("$age") != "30" || form.Get("$tags") != `["a"]` || form.Get("args") != `["x"]` {
+		t.Errorf("Unexpected request %v", form)
+	}
+	if _, err := conn.Query("SELECT $f", Named("f", map[string]interface{}{"f": func() {}})); err == nil {
+		t.Error("Expected an argument that cannot be encoded to fail")
+	}
+}
@@ -0,0 +1,110 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a query node that did not know a prepared statement is assumed
+// not to know it, so that the requests naming it go to the other nodes
+// while they are re-prepared, e.g. after a failover.
+var PlanMissTTL = 10 * time.Second
+
+// The query nodes that lately did not know prepared statements.
+type planMisses struct {
+	lock    sync.Mutex
+	entries map[planMiss]time.Time // of expiry
+}
+
+type planMiss struct {
+	node string
+	name string
+}
+
+func (m *planMisses) add(node, name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if m.entries == nil {
+		m.entries = make(map[planMiss]time.Time)
+	}
+	for miss, expires := range m.entries {
+		if now.After(expires) {
+			delete(m.entries, miss)
+		}
+	}
+	m.entries[planMiss{node: node, name: name}] = now.Add(PlanMissTTL)
+}
+
+// Whether node lately did not know the prepared statement name.
+func (m *planMisses) has(node, name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	expires, ok := m.entries[planMiss{node: node, name: name}]
+	return ok && time.Now().Before(expires)
+}
+
+// The name of the prepared statement a request runs, "" if it sends the
+// full plan or a statement.
+func preparedName(requestValues *url.Values) string {
+	if requestValues == nil {
+		return ""
+	}
+	prepared := requestValues.Get("prepared")
+	if !strings.HasPrefix(prepared, `"`) {
+		return ""
+	}
+	name, err := strconv.Unquote(prepared)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// The query node to send a request for the prepared statement name to,
+// instead of the one selected, if that one lately did not know it and
+// another one did not fail likewise.
+func (conn *n1qlConn) avoidPlanMiss(selectedNode int, queryAPI, name string) (int, string) {
+	if !conn.planMisses.has(queryAPI, name) {
+		return selectedNode, queryAPI
+	}
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	for i, other := range conn.queryAPIs {
+		if i != selectedNode && !conn.planMisses.has(other, name) {
+			atomic.AddInt64(&conn.stats.missesAvoided, 1)
+			return i, other
+		}
+	}
+	return selectedNode, queryAPI
+}
+
+// Remember the node of the response if err tells it did not know the
+// prepared statement of the request.
+func (conn *n1qlConn) notePlanMiss(body io.ReadCloser, requestValues *url.Values, err error) {
+	if err == nil || RetryClassOf(err) != RetryReprepare {
+		return
+	}
+	rb, ok := body.(*responseBody)
+	if !ok {
+		return
+	}
+	atomic.AddInt64(&conn.stats.planMisses, 1)
+	if name := preparedName(requestValues); name != "" {
+		conn.planMisses.add(rb.node, name)
+	}
+}
@@ -0,0 +1,123 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Limits of the connection pool of a connection, once it has one of its
+// own. Zero maxOpen means no limit, zero or less maxIdle no idle sockets.
+type poolLimits struct {
+	set     bool
+	maxOpen int
+	maxIdle int
+}
+
+// The HTTP client of the connection, which SetMaxOpenConns and
+// SetMaxIdleConns may replace at any time.
+func (conn *n1qlConn) httpClient() *http.Client {
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	return conn.client
+}
+
+// Bound the sockets open to each query node, and so the requests in flight
+// on it: requests over the limit wait for a socket to be free.
+func (conn *n1qlConn) setMaxOpenConns(n int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	limits := conn.poolLimits()
+	if n < 0 {
+		n = 0
+	}
+	limits.maxOpen = n
+	if n > 0 && limits.maxIdle > n {
+		limits.maxIdle = n
+	}
+	conn.resizePool(limits)
+}
+
+// Bound the idle sockets kept open to each query node.
+func (conn *n1qlConn) setMaxIdleConns(n int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	limits := conn.poolLimits()
+	if limits.maxOpen > 0 && n > limits.maxOpen {
+		n = limits.maxOpen
+	}
+	limits.maxIdle = n
+	conn.resizePool(limits)
+}
+
+// The current limits, the ones of the shared transport if they were never set
+func (conn *n1qlConn) poolLimits() poolLimits {
+	if conn.pool.set {
+		return conn.pool
+	}
+	return poolLimits{set: true, maxIdle: MaxIdleConnsPerHost}
+}
+
+// Give the connection a transport of its own, with the given limits, in
+// place of its current one. Requests in flight finish on the old one. The
+// caller holds conn.lock.
+func (conn *n1qlConn) resizePool(limits poolLimits) {
+	base, ok := conn.client.Transport.(*http.Transport)
+	if !ok {
+		base = HTTPTransport
+	}
+	t := base.Clone()
+	t.MaxConnsPerHost = limits.maxOpen
+	t.MaxIdleConnsPerHost = limits.maxIdle
+	t.DisableKeepAlives = limits.maxIdle <= 0
+	t.DialContext = conn.stats.countOpenConns(HTTPTransport.DialContext)
+
+	client := *conn.client
+	client.Transport = t
+	conn.client = &client
+	if conn.pool.set {
+		// the old transport was our own
+		base.CloseIdleConnections()
+	}
+	conn.pool = limits
+}
+
+// Wrap dial, or the default dialer if it is nil, to count the open sockets.
+func (stats *connStats) countOpenConns(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&stats.openConns, 1)
+		return &countedConn{Conn: c, stats: stats}, nil
+	}
+}
+
+// Socket accounted for in the open connections until it is closed.
+type countedConn struct {
+	net.Conn
+	stats  *connStats
+	closed int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.stats.openConns, -1)
+	}
+	return c.Conn.Close()
+}
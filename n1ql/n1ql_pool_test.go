@@ -0,0 +1,66 @@
+package n1ql
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionPool(t *testing.T) {
+	var active, maxActive int32
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	db.SetMaxOpenConns(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Exec("DELETE FROM default"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxActive > 2 {
+		t.Errorf("Expected at most 2 requests at once, got %d", maxActive)
+	}
+	if open := db.Stats().OpenConnections(); open < 1 || open > 2 {
+		t.Errorf("Expected 1 or 2 open connections, got %d", open)
+	}
+
+	// no idle sockets: they are closed along with the old pool
+	db.SetMaxIdleConns(0)
+	if _, err := db.Exec("DELETE FROM default"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for db.Stats().OpenConnections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no open connection, got %d", db.Stats().OpenConnections())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,190 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"container/list"
+	"context"
+	"net/url"
+	"sync"
+)
+
+// Number of statements whose prepared plans the connections opened from
+// now on keep for Query and Exec, see Options.PreparedCacheSize.
+var preparedCacheSize = 0
+
+// Keep the prepared plans of the last size statements run with Query and
+// Exec by the connections opened from now on, see Options.PreparedCacheSize.
+func SetPreparedCacheSize(size int) {
+	preparedCacheSize = size
+}
+
+// The prepared statements of Query and Exec, by statement and request
+// parameters, the least recently used evicted first.
+type stmtCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // of *stmtCacheEntry, most recently used first
+}
+
+type stmtCacheEntry struct {
+	key   string
+	query string
+	stmt  *n1qlStmt
+}
+
+// nil, caching nothing, unless size is positive
+func newStmtCache(size int) *stmtCache {
+	if size <= 0 {
+		return nil
+	}
+	return &stmtCache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// The key of a statement: the parameters of the request matter too, the
+// query context for one, but for the client context ID, which differs from
+// one request to the next.
+func stmtCacheKey(query string, opts *queryOptions) string {
+	v := url.Values{}
+	opts.setQueryParams(&v)
+	v.Del("client_context_id")
+	return query + "\x00" + v.Encode()
+}
+
+// The cached statement of key, nil if none, and a copy of it, taken before
+// eviction can close it.
+func (c *stmtCache) get(key string) (*n1qlStmt, *n1qlStmt) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	c.lru.MoveToFront(e)
+	cached := e.Value.(*stmtCacheEntry).stmt
+	stmt := *cached
+	return cached, &stmt
+}
+
+func (c *stmtCache) put(key, query string, stmt *n1qlStmt) {
+	var evicted []*n1qlStmt
+	c.lock.Lock()
+	if e, ok := c.entries[key]; ok {
+		// prepared meanwhile by another caller, which may still run it
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&stmtCacheEntry{key: key, query: query, stmt: stmt})
+	for c.lru.Len() > c.size {
+		evicted = append(evicted, c.evict(c.lru.Back()))
+	}
+	c.lock.Unlock()
+	deallocate(evicted)
+}
+
+// Drop the entry of key, if it still holds stmt.
+func (c *stmtCache) remove(key string, stmt *n1qlStmt) {
+	var evicted []*n1qlStmt
+	c.lock.Lock()
+	if e, ok := c.entries[key]; ok && e.Value.(*stmtCacheEntry).stmt == stmt {
+		evicted = append(evicted, c.evict(e))
+	}
+	c.lock.Unlock()
+	deallocate(evicted)
+}
+
+// Drop the entries of the given statements, whatever their parameters, or
+// all of them if none is given.
+func (c *stmtCache) invalidate(queries []string) {
+	var evicted []*n1qlStmt
+	c.lock.Lock()
+	drop := make(map[string]bool, len(queries))
+	for _, query := range queries {
+		drop[query] = true
+	}
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if len(queries) == 0 || drop[e.Value.(*stmtCacheEntry).query] {
+			evicted = append(evicted, c.evict(e))
+		}
+		e = next
+	}
+	c.lock.Unlock()
+	deallocate(evicted)
+}
+
+// Remove the entry of e, and return its statement, for the caller to
+// deallocate once it released c.lock, which it holds.
+func (c *stmtCache) evict(e *list.Element) *n1qlStmt {
+	entry := c.lru.Remove(e).(*stmtCacheEntry)
+	delete(c.entries, entry.key)
+	return entry.stmt
+}
+
+// Drop the plans of evicted statements from the nodes, in the background:
+// the lookups of the cache do not wait for the round trip to a node. The
+// copies of a statement still running prepare it again if need be.
+func deallocate(stmts []*n1qlStmt) {
+	if len(stmts) == 0 {
+		return
+	}
+	go func() {
+		for _, stmt := range stmts {
+			if err := stmt.Deallocate(); err != nil {
+				logger.Printf("%v", err)
+			}
+		}
+	}()
+}
+
+// The prepared statement of Query and Exec, prepared with the options of
+// the request: a copy of the cached one, if the connection caches them, so
+// that the callers do not share the state of the statement. Statements of
+// transactions are not cached. Only the cached statements are named in
+// the namespace of the connection, see Options.PreparedNamespace: the
+// server names the others after their text, so that preparing one again
+// reuses its plan rather than adding one more.
+func (db *n1qlDB) cachedPrepare(ctx context.Context, query string, opts *queryOptions) (*n1qlStmt, error) {
+	if db.conn == nil {
+		return nil, errorNoConnection
+	}
+	cache := db.conn.preparedCache
+	if cache == nil || opts.transaction() != nil {
+		return db.prepareWith(ctx, "", query, opts)
+	}
+
+	key := stmtCacheKey(query, opts)
+	cached, stmt := cache.get(key)
+	if cached == nil {
+		prepared, err := db.conn.prepare(ctx, db.conn.nextPreparedName(), query, opts)
+		if err != nil {
+			return nil, err
+		}
+		own := *prepared
+		cache.put(key, query, prepared)
+		cached, stmt = prepared, &own
+	}
+	stmt.defaults = db.defaults
+	stmt.onStale = func() {
+		// the plan is gone from the node: prepare it again next time
+		cache.remove(key, cached)
+	}
+	return stmt, nil
+}
+
+// Forget the prepared plans of the given statements, or all of them if
+// none is given, so that the next Query or Exec prepares them again, e.g.
+// once the indexes they use changed.
+func (db *n1qlDB) InvalidatePrepared(statements ...string) {
+	if db.conn == nil || db.conn.preparedCache == nil {
+		return
+	}
+	db.conn.preparedCache.invalidate(statements)
+}
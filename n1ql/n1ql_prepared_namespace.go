@@ -0,0 +1,94 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Whether the connections opened from now on name their prepared statements
+// in a namespace of the process, see Options.PreparedNamespace.
+var preparedNamespace = false
+
+// Name the statements prepared by the connections opened from now on in a
+// namespace of the process, see Options.PreparedNamespace.
+func SetPreparedNamespace(enabled bool) {
+	preparedNamespace = enabled
+}
+
+// How long closing a connection waits for its prepared statements to be
+// deleted from the query nodes.
+var PreparedCleanupTimeout = 5 * time.Second
+
+var processNamespace struct {
+	once sync.Once
+	name string
+}
+
+// Connections numbered in the namespace of the process.
+var namespaceConns uint64
+
+// The namespace of the prepared statements of the process, e.g.
+// "godbc-4242-9f86d081": its pid, which the instances of an application
+// on different hosts may share, and a random part, which they do not.
+func processPreparedNamespace() string {
+	processNamespace.once.Do(func() {
+		random, err := newUUID()
+		if err != nil {
+			random = strconv.FormatInt(time.Now().UnixNano(), 16)
+		}
+		processNamespace.name = fmt.Sprintf("godbc-%d-%.8s", os.Getpid(), random)
+	})
+	return processNamespace.name
+}
+
+// The prefix of the names of the statements a new connection prepares, ""
+// if not enabled: the server names them after their text then.
+func newPreparedPrefix(enabled bool) string {
+	if !enabled {
+		return ""
+	}
+	conn := atomic.AddUint64(&namespaceConns, 1)
+	return processPreparedNamespace() + "-" + strconv.FormatUint(conn, 10) + "-"
+}
+
+// The name of the next statement the connection prepares, "" if the server
+// is to name it.
+func (conn *n1qlConn) nextPreparedName() string {
+	if conn.preparedPrefix == "" {
+		return ""
+	}
+	return conn.preparedPrefix + strconv.FormatUint(atomic.AddUint64(&conn.preparedSeq, 1), 10)
+}
+
+// Delete the statements the connection prepared in its namespace from the
+// query nodes, if it has one.
+func (conn *n1qlConn) deletePrepared() error {
+	if conn.preparedPrefix == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PreparedCleanupTimeout)
+	defer cancel()
+	postData, err := buildPostData("DELETE FROM system:prepareds WHERE name LIKE $1",
+		[]interface{}{conn.preparedPrefix + "%"}, JSONArgs, conn.queryParams(), nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.performExec(ctx, "", &postData, nil); err != nil {
+		return fmt.Errorf("N1QL: Failed to delete the prepared statements of the connection: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// How much of the execution of a request the query service profiles, see
+// Profile.
+type ProfileMode string
+
+const (
+	ProfileOff     ProfileMode = "off"
+	ProfilePhases  ProfileMode = "phases"  // the time and item counts of each phase
+	ProfileTimings ProfileMode = "timings" // also the plan, with the timings of each operator
+)
+
+// Ask the query service to profile the request, and return the profile,
+// available through the Profile method of N1qlRows and N1qlResult.
+//
+//	rows, err := db.Query(statement, n1ql.Profile(n1ql.ProfileTimings))
+//	...
+//	profile := rows.(n1ql.N1qlRows).Profile()
+func Profile(mode ProfileMode) QueryOption {
+	return func(opts *queryOptions) {
+		opts.setParam("profile", string(mode))
+	}
+}
+
+// The profile of a request, as reported by the query service.
+type QueryProfile struct {
+	// Time spent in each phase of the execution, e.g. "fetch" or
+	// "indexScan", and the number of items and operators of each.
+	PhaseTimes     map[string]time.Duration
+	PhaseCounts    map[string]int64
+	PhaseOperators map[string]int64
+
+	// The executed plan with the timings of its operators, with
+	// ProfileTimings. Nil otherwise.
+	ExecutionTimings *OperatorTimings
+
+	// The profile exactly as returned by the server.
+	Raw json.RawMessage
+}
+
+// An operator of an executed plan, with its timings.
+type OperatorTimings struct {
+	Operator string // e.g. "IndexScan3"
+
+	// Time spent executing the operator, waiting for the services it uses,
+	// such as the index or data service, and waiting to be scheduled.
+	ExecTime time.Duration
+	ServTime time.Duration
+	KernTime time.Duration
+
+	ItemsIn  int64
+	ItemsOut int64
+
+	// The operators it runs, in order.
+	Children []*OperatorTimings
+
+	// The other fields of the operator, such as its index or keyspace.
+	Fields map[string]interface{}
+}
+
+// The profile of raw, as sent by the server, nil if there is none.
+func parseProfile(raw json.RawMessage) *QueryProfile {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var wire struct {
+		PhaseTimes       map[string]string      `json:"phaseTimes"`
+		PhaseCounts      map[string]int64       `json:"phaseCounts"`
+		PhaseOperators   map[string]int64       `json:"phaseOperators"`
+		ExecutionTimings map[string]interface{} `json:"executionTimings"`
+	}
+	if err := json.Unmarshal(raw, &wire); err != nil {
+		return nil
+	}
+	profile := &QueryProfile{PhaseCounts: wire.PhaseCounts, PhaseOperators: wire.PhaseOperators,
+		ExecutionTimings: operatorTimings(wire.ExecutionTimings), Raw: raw}
+	if wire.PhaseTimes != nil {
+		profile.PhaseTimes = make(map[string]time.Duration, len(wire.PhaseTimes))
+		for phase, t := range wire.PhaseTimes {
+			profile.PhaseTimes[phase], _ = time.ParseDuration(t)
+		}
+	}
+	return profile
+}
+
+// The timings of an operator of the plan and of the operators it runs,
+// given as "~child" or "~children".
+func operatorTimings(op map[string]interface{}) *OperatorTimings {
+	if op == nil {
+		return nil
+	}
+	timings := &OperatorTimings{Fields: make(map[string]interface{})}
+	for key, value := range op {
+		switch key {
+		case "#operator":
+			timings.Operator, _ = value.(string)
+		case "#stats":
+			stats, _ := value.(map[string]interface{})
+			timings.ExecTime = statDuration(stats["execTime"])
+			timings.ServTime = statDuration(stats["servTime"])
+			timings.KernTime = statDuration(stats["kernTime"])
+			timings.ItemsIn = statCount(stats["#itemsIn"])
+			timings.ItemsOut = statCount(stats["#itemsOut"])
+		case "~child":
+			if child := operatorTimings(asOperator(value)); child != nil {
+				timings.Children = append(timings.Children, child)
+			}
+		case "~children":
+			children, _ := value.([]interface{})
+			for _, c := range children {
+				if child := operatorTimings(asOperator(c)); child != nil {
+					timings.Children = append(timings.Children, child)
+				}
+			}
+		default:
+			timings.Fields[key] = value
+		}
+	}
+	return timings
+}
+
+func asOperator(value interface{}) map[string]interface{} {
+	op, _ := value.(map[string]interface{})
+	return op
+}
+
+func statDuration(value interface{}) time.Duration {
+	s, _ := value.(string)
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+func statCount(value interface{}) int64 {
+	n, _ := value.(float64)
+	return int64(n)
+}
@@ -9,12 +9,43 @@
 
 package n1ql
 
-import "github.com/couchbase/godbc"
+import (
+	"encoding/json"
 
-// Implements godbc.Result interfaces.
+	"github.com/couchbase/godbc"
+)
+
+type N1qlResult interface {
+	godbc.Result
+
+	// Scan vectors covering the documents changed by the statement, when
+	// requested with the MutationTokens option and returned by the server.
+	MutationTokens() json.RawMessage
+
+	// ID of the request, to find it in the logs of the server and in
+	// system:completed_requests.
+	RequestID() string
+
+	// The client_context_id the request was sent with, given with the
+	// ClientContextID option or generated.
+	ClientContextID() string
+
+	// Metrics of the request, nil if the server sent none.
+	Metrics() *Metrics
+
+	// Profile of the request, when asked for with the Profile option.
+	Profile() *QueryProfile
+}
+
+// Implements N1qlResult interface.
 type n1qlResult struct {
-	affectedRows int64
-	insertId     int64
+	affectedRows    int64
+	insertId        int64
+	mutationTokens  json.RawMessage
+	requestID       string
+	clientContextID string
+	metrics         *Metrics
+	profile         *QueryProfile
 }
 
 func (res *n1qlResult) LastInsertId() (int64, error) {
@@ -28,3 +59,23 @@ func (res *n1qlResult) RowsAffected() (int64, error) {
 func (res *n1qlResult) Rows() godbc.Rows {
 	return nil
 }
+
+func (res *n1qlResult) MutationTokens() json.RawMessage {
+	return res.mutationTokens
+}
+
+func (res *n1qlResult) RequestID() string {
+	return res.requestID
+}
+
+func (res *n1qlResult) ClientContextID() string {
+	return res.clientContextID
+}
+
+func (res *n1qlResult) Metrics() *Metrics {
+	return res.metrics
+}
+
+func (res *n1qlResult) Profile() *QueryProfile {
+	return res.profile
+}
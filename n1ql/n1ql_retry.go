@@ -0,0 +1,226 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How the driver may react to an error reported by the query service.
+type RetryClass int
+
+const (
+	// The request failed for good.
+	RetryNever RetryClass = iota
+
+	// The prepared statement is unknown or stale on the node that got it:
+	// it can be executed again from its full plan.
+	RetryReprepare
+
+	// The request was not executed: it can be sent again as is.
+	RetryRequest
+
+	// The request may have been partly executed: it can only be sent again
+	// if it is read only.
+	RetryIdempotent
+
+	// The transaction the request was part of failed: the application can
+	// run the whole transaction again. The driver never does it itself.
+	RetryTransaction
+)
+
+// Retry classes of the documented query service error codes.
+// Codes that are not listed are never retried.
+var retryClasses = map[int]RetryClass{
+	1080:  RetryIdempotent,  // timeout exceeded
+	1180:  RetryRequest,     // service shutting down
+	1181:  RetryRequest,     // service shut down
+	1182:  RetryRequest,     // service unavailable
+	4040:  RetryReprepare,   // no such prepared statement
+	4050:  RetryReprepare,   // unrecognized prepared statement
+	4070:  RetryReprepare,   // unable to decode prepared statement
+	4080:  RetryReprepare,   // prepared statement encoding mismatch
+	12009: RetryTransaction, // DML error, CAS mismatch inside a transaction
+}
+
+// A RetryClassifier decides the retry class of a query service error,
+// given its code and message.
+type RetryClassifier func(code int, msg string) RetryClass
+
+// The RetryClassifier in use, read by every failed request.
+var retryClassifier atomic.Value
+
+func init() {
+	retryClassifier.Store(RetryClassifier(DefaultRetryClass))
+}
+
+// Classify query service errors with the given function instead of the
+// driver's table. Passing nil restores the table.
+func SetRetryClassifier(classifier RetryClassifier) {
+	if classifier == nil {
+		classifier = DefaultRetryClass
+	}
+	retryClassifier.Store(classifier)
+}
+
+// Wait before sending again a request the query service did not execute,
+// doubled for each of the next retries.
+var RetryBackoff = 20 * time.Millisecond
+
+// How long a query node that did not execute a request, because it is
+// shutting down or unavailable, is avoided by the requests that follow.
+var UnavailableNodeTTL = 5 * time.Second
+
+// The retry class of an error code, according to the driver's table.
+// Custom classifiers can fall back to it for the codes they do not handle.
+func DefaultRetryClass(code int, msg string) RetryClass {
+	return retryClasses[code]
+}
+
+// The retry class of an error returned by the driver, RetryNever if the
+// query service did not report it.
+func RetryClassOf(err error) RetryClass {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+	return RetryNever
+}
+
+// Error reported by the query service, along with the retry class of its
+// first error: the one that made the request fail.
+type classifiedError struct {
+	err   error
+	class RetryClass
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Errors the classifier tells are transaction failures are conflicts.
+func (e *classifiedError) Is(target error) bool {
+	return target == ErrTxConflict && e.class == RetryTransaction
+}
+
+// Report err as the Error of the server errors, with the retry class of
+// the first one.
+func classify(err error, errs interface{}) error {
+	serverErr := newError(err, errs)
+	if serverErr == nil {
+		return err
+	}
+	classifier := retryClassifier.Load().(RetryClassifier)
+	if class := classifier(serverErr.Code, serverErr.Message); class != RetryNever {
+		return &classifiedError{err: serverErr, class: class}
+	}
+	return serverErr
+}
+
+// Whether a request that failed with err can be sent again. Requests that
+// take part in a transaction are pinned to its node and never resent, nor
+// are requests whose context is done, nor those of connections in dev mode.
+func (conn *n1qlConn) canResend(ctx context.Context, query string, opts *queryOptions, err error) bool {
+	if ctx.Err() != nil || conn.devMode || conn.txid != "" || opts.transaction() != nil || conn.txStatementType(query, opts) != TX_NONE {
+		return false
+	}
+	switch RetryClassOf(err) {
+	case RetryRequest:
+		return true
+	case RetryIdempotent:
+		return opts != nil && opts.idempotent || isReadOnly(conn.queryParams(), opts)
+	}
+	return false
+}
+
+// Wait before sending again a request that failed with err, the given
+// number of times already: requests the query service did not execute wait
+// RetryBackoff, doubled for each retry. Fails if ctx is done first.
+func resendBackoff(ctx context.Context, retries int, err error) error {
+	if RetryClassOf(err) != RetryRequest {
+		return nil
+	}
+	return sleepContext(ctx, RetryBackoff<<uint(retries))
+}
+
+// The query nodes that lately did not execute requests, as they were
+// shutting down or unavailable.
+type unavailableNodes struct {
+	lock    sync.Mutex
+	entries map[string]time.Time // of expiry
+}
+
+func (u *unavailableNodes) add(node string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	now := time.Now()
+	if u.entries == nil {
+		u.entries = make(map[string]time.Time)
+	}
+	for n, expires := range u.entries {
+		if now.After(expires) {
+			delete(u.entries, n)
+		}
+	}
+	u.entries[node] = now.Add(UnavailableNodeTTL)
+}
+
+// Whether node lately did not execute a request.
+func (u *unavailableNodes) has(node string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	expires, ok := u.entries[node]
+	return ok && time.Now().Before(expires)
+}
+
+// Remember the node of the response if err tells it did not execute the
+// request.
+func (conn *n1qlConn) noteUnavailable(body io.ReadCloser, err error) {
+	if err == nil || RetryClassOf(err) != RetryRequest {
+		return
+	}
+	if rb, ok := body.(*responseBody); ok {
+		conn.unavailable.add(rb.node)
+	}
+}
+
+// The query node to send a request to instead of the one selected, if that
+// one lately did not execute a request and another one did not likewise.
+func (conn *n1qlConn) avoidUnavailable(selectedNode int, queryAPI string) (int, string) {
+	if !conn.unavailable.has(queryAPI) {
+		return selectedNode, queryAPI
+	}
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	for i, other := range conn.queryAPIs {
+		if i != selectedNode && !conn.unavailable.has(other) {
+			return i, other
+		}
+	}
+	return selectedNode, queryAPI
+}
+
+// Whether the request is marked read only, for this query or for all of them
+func isReadOnly(params map[string]string, opts *queryOptions) bool {
+	v := url.Values{}
+	setQueryParams(&v, params, nil)
+	opts.setQueryParams(&v)
+	return v.Get("readonly") == "true"
+}
@@ -0,0 +1,276 @@
+package n1ql
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryClassOf(t *testing.T) {
+	cases := []struct {
+		body  string
+		class RetryClass
+	}{
+		{`{"errors":[{"code":1182,"msg":"Service unavailable"}],"status":"fatal"}`, RetryRequest},
+		{`{"errors":[{"code":1080,"msg":"Timeout 1s exceeded"}],"status":"timeout"}`, RetryIdempotent},
+		{`{"errors":[{"code":4040,"msg":"No such prepared statement: p1"}],"status":"fatal"}`, RetryReprepare},
+		{`{"errors":[{"code":12009,"msg":"DML Error, possible causes include CAS mismatch"}],"status":"fatal"}`, RetryTransaction},
+		{`{"errors":[{"code":3000,"msg":"syntax error"},{"code":1182,"msg":"Service unavailable"}],"status":"fatal"}`, RetryNever},
+	}
+
+	for _, c := range cases {
+		body := c.body
+		conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})
+		_, err := conn.Exec("DELETE FROM default", ReadOnly(false))
+		srv.Close()
+		if err == nil {
+			t.Fatalf("Expected an error for %s", body)
+		}
+		if class := RetryClassOf(err); class != c.class {
+			t.Errorf("Expected retry class %v for %s, got %v", c.class, body, class)
+		}
+	}
+}
+
+func TestResendRetryableErrors(t *testing.T) {
+	var requests int
+	var failure string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Write([]byte(failure))
+			return
+		}
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	failure = `{"errors":[{"code":1181,"msg":"Service shut down"}],"status":"fatal"}`
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Expected the query to be sent again.", err)
+	}
+	rows.Close()
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", requests)
+	}
+
+	// timeouts are only resent for read only requests
+	failure = `{"errors":[{"code":1080,"msg":"Timeout 1s exceeded"}],"status":"timeout"}`
+	requests = 0
+	if _, err := conn.Query("SELECT a FROM default"); err == nil {
+		t.Error("Expected the timeout to be reported")
+	}
+	requests = 0
+	rows, err = conn.Query("SELECT a FROM default", ReadOnly(true))
+	if err != nil {
+		t.Fatal("Expected the read only query to be sent again.", err)
+	}
+	rows.Close()
+
+	// requests that are part of a transaction are left to the application
+	failure = `{"errors":[{"code":1182,"msg":"Service unavailable"}],"status":"fatal"}`
+	requests = 0
+	conn.txid = "c1a5a0a3-0000-4000-8000-000000000000"
+	conn.txService = srv.URL
+	if _, err := conn.Query("SELECT a FROM default"); err == nil {
+		t.Error("Expected the transaction request not to be resent")
+	}
+}
+
+func TestReprepareOnUnknownPlan(t *testing.T) {
+	var fullPlans int
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE"):
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+		case r.PostForm.Get("prepared") == `"p1"`:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":4040,"msg":"No such prepared statement: p1"}],"status":"fatal"}`))
+		default:
+			fullPlans++
+			w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+		}
+	})
+	defer srv.Close()
+
+	stmt, err := conn.Prepare("DELETE FROM default")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatal("Expected the statement to run from its full plan.", err)
+	}
+	if fullPlans != 1 {
+		t.Errorf("Expected the full plan to be sent once, got %d", fullPlans)
+	}
+}
+
+func TestRetryClassifierOverride(t *testing.T) {
+	SetRetryClassifier(func(code int, msg string) RetryClass {
+		if code == 5000 && strings.Contains(msg, "queryport.indexNotFound") {
+			return RetryRequest
+		}
+		return DefaultRetryClass(code, msg)
+	})
+	defer SetRetryClassifier(nil)
+
+	var requests int
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"errors":[{"code":5000,"msg":"queryport.indexNotFound"}],"status":"fatal"}`))
+	})
+	defer srv.Close()
+
+	_, err := conn.Exec("DELETE FROM default")
+	if RetryClassOf(err) != RetryRequest {
+		t.Errorf("Expected the override to classify the error, got %v", err)
+	}
+	if requests != N1QL_MAX_RETRIES+1 {
+		t.Errorf("Expected %d requests, got %d", N1QL_MAX_RETRIES+1, requests)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	var ids []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ids = append(ids, r.PostForm.Get("client_context_id"))
+		if len(ids)%2 == 1 {
+			w.Write([]byte(`{"errors":[{"code":1080,"msg":"Timeout 1s exceeded"}],"status":"timeout"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+
+	// mutations that time out are not sent again without a key
+	if _, err := conn.Exec("UPSERT INTO default VALUES ('k', 1)"); err == nil {
+		t.Error("Expected the timeout to be reported")
+	}
+	if len(ids) != 1 || len(ids[0]) != 36 {
+		t.Errorf("Expected the mutation to be sent once with an ID of its own, got %v", ids)
+	}
+	ids = nil
+	if _, err := conn.Exec("UPSERT INTO default VALUES ('k', 1)", IdempotencyKey("order-1")); err != nil {
+		t.Fatal("Expected the keyed mutation to be sent again.", err)
+	}
+	if len(ids) != 2 || ids[0] != "order-1" || ids[1] != "order-1" {
+		t.Errorf("Unexpected client context IDs %v", ids)
+	}
+}
+
+func TestPlanMisses(t *testing.T) {
+	var misses int64
+	failover := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("prepared") == `"p1"` {
+			atomic.AddInt64(&misses, 1)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":4040,"msg":"No such prepared statement: p1"}],"status":"fatal"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	}))
+	defer failover.Close()
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+
+	stmt, err := conn.Prepare("DELETE FROM default")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+	conn.queryAPIs = append(conn.queryAPIs, failover.URL)
+
+	// the node that lost the plan is known once it failed a request
+	first := *stmt
+	if _, err := first.Exec(NodeIndex(1)); err != nil {
+		t.Fatal("Expected the statement to run from its full plan.", err)
+	}
+	for i := 0; i < 20; i++ {
+		s := *stmt
+		if _, err := s.Exec(); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+	}
+	if n := atomic.LoadInt64(&misses); n != 1 {
+		t.Errorf("Expected the node to be sent the name once, got %d", n)
+	}
+	if i, queryAPI := conn.avoidPlanMiss(1, failover.URL, "p1"); i != 0 || queryAPI != srv.URL {
+		t.Errorf("Expected the request to go to the other node, got %s", queryAPI)
+	}
+	stats := conn.stats.snapshot()
+	if stats.PlanMisses() != 1 || stats.Reprepares() != 1 || stats.PlanMissesAvoided() == 0 {
+		t.Errorf("Unexpected counters: %d misses, %d re-prepares, %d avoided",
+			stats.PlanMisses(), stats.Reprepares(), stats.PlanMissesAvoided())
+	}
+}
+
+func TestResendAvoidsUnavailableNode(t *testing.T) {
+	var down, up int32
+	shutdown := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&down, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"errors":[{"code":1180,"msg":"Service shutting down"}],"status":"fatal"}`))
+	}))
+	defer shutdown.Close()
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&up, 1)
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.queryAPIs = []string{shutdown.URL, srv.URL}
+
+	// the node shutting down gets at most the first request, the other ones
+	// go to the node that is up, after a backoff
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Exec("DELETE FROM default"); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+	}
+	if n := atomic.LoadInt32(&down); n > 1 {
+		t.Errorf("Expected the node shutting down to be avoided, got %d requests", n)
+	}
+	if n := atomic.LoadInt32(&up); n != 10 {
+		t.Errorf("Expected 10 requests to the node that is up, got %d", n)
+	}
+	if atomic.LoadInt32(&down) == 1 && time.Since(start) < RetryBackoff {
+		t.Errorf("Expected the request to be sent again after %v", RetryBackoff)
+	}
+}
+
+func TestSetRetryClassifierConcurrently(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errors":[{"code":3000,"msg":"syntax error"}],"status":"fatal"}`))
+	})
+	defer srv.Close()
+	defer SetRetryClassifier(nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			SetRetryClassifier(DefaultRetryClass)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Exec("SELEC 1"); RetryClassOf(err) != RetryNever {
+			t.Errorf("Expected a syntax error not to be retried, got %v", err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,224 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/couchbase/godbc"
+)
+
+// A service of the cluster a router sends statements to, see OpenRouter.
+type Service int
+
+const (
+	QueryService Service = iota
+	AnalyticsService
+)
+
+// Send the request to the given service when it is run through a router,
+// whatever its RouteClassifier says. Other handles ignore it.
+//
+//	rows, err := db.Query("SELECT city, COUNT(*) FROM hotels GROUP BY city",
+//		n1ql.Route(n1ql.QueryService))
+func Route(service Service) QueryOption {
+	return func(opts *queryOptions) {
+		opts.route = service
+		opts.hasRoute = true
+	}
+}
+
+// Decides the service of the statements run through a router without the
+// Route option.
+type RouteClassifier func(statement string) Service
+
+var (
+	comment         = regexp.MustCompile(`(?s)/\*.*?\*/|--[^\n]*`)
+	readStatement   = regexp.MustCompile(`(?i)^\s*(?:SELECT|WITH)\b`)
+	analyticsClause = regexp.MustCompile(`(?i)\bGROUP\s+BY\b|\bOVER\s*\(|\bWINDOW\b`)
+)
+
+// The classifier of routers given none: all the statements go to the query
+// service, only the requests with the Route option go to the analytics one.
+// The analytics service queries its own datasets rather than the buckets
+// and collections the statements name, so sending a statement there is
+// left to the caller.
+func DefaultRoute(statement string) Service {
+	return QueryService
+}
+
+// A classifier sending the read only statements grouping their results or
+// using window functions to the analytics service, the other statements to
+// the query service, for the applications whose analytics datasets shadow
+// the collections of the statements under the same names.
+//
+//	db, err := n1ql.OpenRouter(dsn, opts, n1ql.AggregateRoute)
+func AggregateRoute(statement string) Service {
+	statement = comment.ReplaceAllString(stringLiteral.ReplaceAllString(statement, `""`), " ")
+	if readStatement.MatchString(statement) && analyticsClause.MatchString(statement) {
+		return AnalyticsService
+	}
+	return QueryService
+}
+
+// Implements godbc.DB over a handle on the query service and one on the
+// analytics service of a cluster.
+type router struct {
+	query     godbc.DB
+	analytics godbc.DB
+	classify  RouteClassifier
+}
+
+// Open a handle sending each statement to the query or the analytics
+// service of the cluster, as told by the Route option of the request or
+// else by classify, DefaultRoute, sending it to the query service, if nil. It holds a connection to each
+// service, both opened with opts. Transactions always run on the query
+// service, as do the statements when the cluster has no analytics service.
+func OpenRouter(dataSourceName string, opts Options, classify RouteClassifier) (godbc.DB, error) {
+	opts.IsAnalytics = false
+	query, err := OpenWithOptions(dataSourceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.IsAnalytics = true
+	analytics, err := OpenWithOptions(dataSourceName, opts)
+	if errors.Is(err, ErrNoQueryService) {
+		return NewRouter(query, nil, classify), nil
+	}
+	if err != nil {
+		query.Close()
+		return nil, err
+	}
+	return NewRouter(query, analytics, classify), nil
+}
+
+// Same as OpenRouter, over handles opened by the caller. A nil analytics
+// handle sends everything to the query one.
+func NewRouter(query, analytics godbc.DB, classify RouteClassifier) godbc.DB {
+	if classify == nil {
+		classify = DefaultRoute
+	}
+	return &router{query: query, analytics: analytics, classify: classify}
+}
+
+// The handle to run the statement on, and its arguments without the Route
+// options.
+func (r *router) route(statement string, args []interface{}) (godbc.DB, []interface{}) {
+	service := Service(-1)
+	var rest []interface{}
+	for i, arg := range args {
+		if option, ok := arg.(QueryOption); ok {
+			var opts queryOptions
+			option(&opts)
+			if opts.hasRoute {
+				service = opts.route
+				if rest == nil {
+					rest = append(make([]interface{}, 0, len(args)), args[:i]...)
+				}
+				continue
+			}
+		}
+		if rest != nil {
+			rest = append(rest, arg)
+		}
+	}
+	if rest == nil {
+		rest = args
+	}
+	if service < 0 {
+		service = r.classify(statement)
+	}
+	if service == AnalyticsService && r.analytics != nil {
+		return r.analytics, rest
+	}
+	return r.query, rest
+}
+
+func (r *router) Begin() (godbc.Tx, error) {
+	return r.query.Begin()
+}
+
+func (r *router) Close() error {
+	err := r.query.Close()
+	if r.analytics != nil {
+		if aerr := r.analytics.Close(); err == nil {
+			err = aerr
+		}
+	}
+	return err
+}
+
+func (r *router) Exec(query string, args ...interface{}) (godbc.Result, error) {
+	return r.ExecContext(context.Background(), query, args...)
+}
+
+func (r *router) ExecContext(ctx context.Context, query string, args ...interface{}) (godbc.Result, error) {
+	db, args := r.route(query, args)
+	return db.ExecContext(ctx, query, args...)
+}
+
+func (r *router) Ping() error {
+	return r.PingContext(context.Background())
+}
+
+// Ping both services.
+func (r *router) PingContext(ctx context.Context) error {
+	if err := r.query.PingContext(ctx); err != nil {
+		return err
+	}
+	if r.analytics != nil {
+		return r.analytics.PingContext(ctx)
+	}
+	return nil
+}
+
+func (r *router) Prepare(query string) (godbc.Stmt, error) {
+	return r.PrepareContext(context.Background(), query)
+}
+
+func (r *router) PrepareContext(ctx context.Context, query string) (godbc.Stmt, error) {
+	db, _ := r.route(query, nil)
+	return db.PrepareContext(ctx, query)
+}
+
+func (r *router) Query(query string, args ...interface{}) (godbc.Rows, error) {
+	return r.QueryContext(context.Background(), query, args...)
+}
+
+func (r *router) QueryContext(ctx context.Context, query string, args ...interface{}) (godbc.Rows, error) {
+	db, args := r.route(query, args)
+	return db.QueryContext(ctx, query, args...)
+}
+
+func (r *router) QueryRow(query string, args ...interface{}) godbc.Row {
+	db, args := r.route(query, args)
+	return db.QueryRow(query, args...)
+}
+
+func (r *router) SetMaxIdleConns(n int) {
+	r.query.SetMaxIdleConns(n)
+	if r.analytics != nil {
+		r.analytics.SetMaxIdleConns(n)
+	}
+}
+
+func (r *router) SetMaxOpenConns(n int) {
+	r.query.SetMaxOpenConns(n)
+	if r.analytics != nil {
+		r.analytics.SetMaxOpenConns(n)
+	}
+}
+
+// The statistics of the query handle.
+func (r *router) Stats() godbc.DBStats {
+	return r.query.Stats()
+}
@@ -0,0 +1,94 @@
+package n1ql
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAggregateRoute(t *testing.T) {
+	cases := []struct {
+		statement string
+		service   Service
+	}{
+		{"SELECT city, COUNT(*) FROM hotels GROUP BY city", AnalyticsService},
+		{"with t AS (SELECT 1) select RANK() OVER (ORDER BY a) FROM t", AnalyticsService},
+		{"/* nightly */ SELECT a FROM b WINDOW w AS (ORDER BY a)", AnalyticsService},
+		{"SELECT * FROM hotels WHERE id = $1", QueryService},
+		{"SELECT * FROM hotels WHERE name = 'GROUP BY'", QueryService},
+		{"UPDATE hotels SET c = (SELECT COUNT(*) FROM r GROUP BY x)", QueryService},
+		{"-- SELECT a FROM b GROUP BY a\nDELETE FROM b", QueryService},
+	}
+	for _, c := range cases {
+		if service := AggregateRoute(c.statement); service != c.service {
+			t.Errorf("Expected %v for %s, got %v", c.service, c.statement, service)
+		}
+		if service := DefaultRoute(c.statement); service != QueryService {
+			t.Errorf("Expected the query service by default for %s, got %v", c.statement, service)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	handler := func(statements chan<- string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			if statement := r.PostForm.Get("statement"); strings.HasPrefix(statement, "PREPARE") {
+				statements <- statement
+				w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+				return
+			}
+			w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+		}
+	}
+	queryStatements, analyticsStatements := make(chan string, 10), make(chan string, 10)
+	query, querySrv := newTestConn(handler(queryStatements))
+	defer querySrv.Close()
+	analytics, analyticsSrv := newTestConn(handler(analyticsStatements))
+	defer analyticsSrv.Close()
+	db := NewRouter(&n1qlDB{conn: query}, &n1qlDB{conn: analytics}, AggregateRoute)
+
+	run := func(statement string, args ...interface{}) {
+		rows, err := db.Query(statement, args...)
+		if err != nil {
+			t.Fatal("Query failed.", err)
+		}
+		rows.Close()
+	}
+	run("SELECT a FROM b GROUP BY a")
+	if s := <-analyticsStatements; s != "PREPARE SELECT a FROM b GROUP BY a" {
+		t.Errorf("Unexpected statement on analytics %s", s)
+	}
+	run("SELECT a FROM b WHERE c = ?", Route(AnalyticsService), 1)
+	if s := <-analyticsStatements; s != "PREPARE SELECT a FROM b WHERE c = $1" {
+		t.Errorf("Unexpected statement on analytics %s", s)
+	}
+	run("SELECT a FROM b GROUP BY a", Route(QueryService))
+	if _, err := db.Exec("DELETE FROM b"); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if s := <-queryStatements; s != "PREPARE SELECT a FROM b GROUP BY a" {
+		t.Errorf("Unexpected statement on query %s", s)
+	}
+	if s := <-queryStatements; s != "PREPARE DELETE FROM b" {
+		t.Errorf("Unexpected statement on query %s", s)
+	}
+
+	// without a classifier, only the Route option leads to analytics
+	db = NewRouter(&n1qlDB{conn: query}, &n1qlDB{conn: analytics}, nil)
+	run("SELECT a FROM b GROUP BY a")
+	if s := <-queryStatements; s != "PREPARE SELECT a FROM b GROUP BY a" {
+		t.Errorf("Unexpected statement on query %s", s)
+	}
+	run("SELECT a FROM b GROUP BY a", Route(AnalyticsService))
+	if s := <-analyticsStatements; s != "PREPARE SELECT a FROM b GROUP BY a" {
+		t.Errorf("Unexpected statement on analytics %s", s)
+	}
+
+	// without analytics, everything goes to query
+	db = NewRouter(&n1qlDB{conn: query}, nil, AggregateRoute)
+	run("SELECT a FROM b GROUP BY a")
+	if s := <-queryStatements; s != "PREPARE SELECT a FROM b GROUP BY a" {
+		t.Errorf("Unexpected statement on query %s", s)
+	}
+}
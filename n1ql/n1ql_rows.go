@@ -10,95 +10,397 @@
 package n1ql
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"reflect"
 	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/godbc"
 )
 
-// Implements godbc.Rows.
+type N1qlRows interface {
+	godbc.Rows
+
+	// ID of the request, to find it in the logs of the server and in
+	// system:completed_requests.
+	RequestID() string
+
+	// The client_context_id the request was sent with, given with the
+	// ClientContextID option or generated.
+	ClientContextID() string
+
+	// Status reported by the server.
+	// Only available in passthrough mode.
+	Status() string
+
+	// Metrics of the request, exactly as returned by the server.
+	// Only available in passthrough mode.
+	RawMetrics() json.RawMessage
+
+	// Metrics of the request, nil until the server sent them, which it does
+	// after the results: once they are all read, or the rows closed after
+	// that.
+	Metrics() *Metrics
+
+	// Profile of the request, when asked for with the Profile option. Nil
+	// until the server sent it, as Metrics.
+	Profile() *QueryProfile
+
+	// Signature of the results, nil if the server did not return one.
+	Signature() *Signature
+
+	// Closed once the columns are known, which may be before the first row
+	// is decoded, so that headers can be rendered ahead of the results.
+	ColumnsReady() <-chan struct{}
+
+	// Same as Scan, for callers reusing the destinations from row to row.
+	ScanInto(dest []interface{}) error
+
+	// Copy the values of the current row, in column order, into buf.
+	ScanRow(buf *RowBuffer) error
+
+	// Copy the fields of the current row, which must be an object, into the
+	// fields of the struct dest points to. See StructScan for the mapping.
+	StructScan(dest interface{}) error
+
+	// Warnings reported by the server, such as index advice or the use of
+	// deprecated features. The ones sent after the results are only there
+	// once the results are all read.
+	Warnings() []Warning
+}
+
+// A warning of the query service about a request that did not fail.
+type Warning struct {
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+}
+
+// A RowBuffer receives the values of successive rows, reusing its storage
+// from one row to the next.
+type RowBuffer struct {
+	Values []interface{}
+}
+
+// Implements N1qlRows.
 type n1qlRows struct {
-	resp        *http.Response
-	results     io.Reader
-	resultChan  chan interface{}
-	errChan     chan error
-	closed      bool
-	signature   interface{}
-	extras      interface{}
-	metrics     interface{}
-	errors      interface{}
-	passthrough bool
-	columns     []string
-	rowsSent    int
-	curValues   []interface{}
-	iterError   error
-}
-
-func resultToRows(results io.Reader, resp *http.Response, signature interface{}, metrics, errors, extraVals interface{}) (*n1qlRows, error) {
-
-	rows := &n1qlRows{results: results,
+	*rowsFeed
+	closed          bool
+	signature       interface{}
+	passthrough     bool
+	columns         []string
+	rowsSent        int
+	curValues       []interface{}
+	curRow          interface{}     // as decoded, for StructScan
+	curRaw          json.RawMessage // the JSON of curRow, for single column rows
+	values          []interface{}
+	iterError       error
+	deferredErr     error
+	requestID       string
+	clientContextID string
+	status          string
+	rawMetrics      json.RawMessage
+	warnings        []Warning // sent before the results
+	headMetrics     *Metrics  // likewise, for responses without results
+	headProfile     *QueryProfile
+
+	rawSignature json.RawMessage
+	sig          *Signature
+	columnsReady chan struct{}
+
+	// set once Next reached the end of the results
+	ended bool
+
+	// applied to each row by Next, see Transform
+	transforms []RowTransform
+
+	// called when the rows are closed with the number of rows read, whether
+	// they were all read and the error they ended with
+	onClose func(read int, complete bool, err error)
+}
+
+// The response the rows are read from, and how they are handed over to Next.
+// Kept apart from the rows, so that the goroutine decoding the results does
+// not keep the rows reachable once their user drops them.
+type rowsFeed struct {
+	resp            *http.Response
+	results         io.Reader
+	dec             *json.Decoder // streaming the results, if results is nil
+	trailerErr      error         // reported after the results, set before resultChan is closed
+	trailerWarnings []Warning     // likewise
+	trailerMetrics  *Metrics      // likewise
+	trailerProfile  *QueryProfile // likewise
+	resultChan      chan interface{}
+	errChan         chan error
+	done            chan struct{}
+	finished        chan struct{}
+	extras          interface{}
+	metrics         interface{}
+	errors          interface{}
+	stats           *connStats
+	buffered        int64
+	keepRaw         bool // send rawRows, for rows of a single column
+	useNumber       bool // decode numbers as json.Number
+}
+
+// A row along with the JSON it was decoded from.
+type rawRow struct {
+	raw   json.RawMessage
+	value interface{}
+}
+
+func resultToRows(results io.Reader, resp *http.Response, stats *connStats, useNumber bool, signature interface{}, metrics, errors, extraVals interface{}) (*n1qlRows, error) {
+
+	// the results are held in memory until they are all read
+	var buffered int64
+	if r, ok := results.(interface{ Len() int }); ok {
+		buffered = int64(r.Len())
+	}
+	return newRows(results, nil, buffered, resp, stats, useNumber, signature, metrics, errors, extraVals)
+}
+
+// Rows decoding the results from dec, positioned at the first of them, one
+// at a time as Next asks for them, and then the rest of the response.
+func streamToRows(dec *json.Decoder, resp *http.Response, stats *connStats, useNumber bool, signature interface{}) (*n1qlRows, error) {
+
+	// only what the decoder read ahead is held in memory
+	var buffered int64
+	if r, ok := dec.Buffered().(interface{ Len() int }); ok {
+		buffered = int64(r.Len())
+	}
+	return newRows(nil, dec, buffered, resp, stats, useNumber, signature, nil, nil, nil)
+}
+
+func newRows(results io.Reader, dec *json.Decoder, buffered int64, resp *http.Response, stats *connStats, useNumber bool, signature interface{}, metrics, errors, extraVals interface{}) (*n1qlRows, error) {
+	if err := stats.reserveRows(buffered); err != nil {
+		return nil, err
+	}
+
+	feed := &rowsFeed{results: results,
+		dec:        dec,
 		resp:       resp,
-		signature:  signature,
+		stats:      stats,
+		buffered:   buffered,
+		useNumber:  useNumber,
 		extras:     extraVals,
 		metrics:    metrics,
 		errors:     errors,
 		resultChan: make(chan interface{}, 1),
 		errChan:    make(chan error),
+		done:       make(chan struct{}),
+		finished:   make(chan struct{}),
 	}
+	rows := &n1qlRows{rowsFeed: feed, signature: signature, columnsReady: make(chan struct{})}
+
+	// the signature precedes the results in the response, and has been
+	// decoded by now
+	close(rows.columnsReady)
 
 	// detect if we are in passthrough mode
 	if metrics != nil && extraVals != nil {
 		rows.passthrough = true
 	}
 
-	go rows.populateRows()
+	// a single column is the whole row, which Scan can hand over as is
+	feed.keepRaw = !rows.passthrough && len(rows.columnNames()) == 1
+
+	go feed.populateRows()
+	trackRows(rows)
 
 	return rows, nil
 }
 
-func (rows *n1qlRows) populateRows() {
-	var resultRows []interface{}
-	defer rows.resp.Body.Close()
+// Decode a row, its numbers as json.Number if useNumber.
+func unmarshalRow(raw json.RawMessage, v interface{}, useNumber bool) error {
+	if !useNumber {
+		return json.Unmarshal(raw, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func (rows *rowsFeed) populateRows() {
+	var resultsDecoder *json.Decoder
+	defer close(rows.finished)
+	defer rows.stats.releaseRows(rows.buffered)
+	defer func() {
+		select {
+		case <-rows.done:
+			// closed before all the results were delivered: stop the request
+			// rather than letting the server stream the rest of them
+			rows.discard(resultsDecoder)
+			abortResponse(rows.resp.Body)
+		default:
+			drainAndClose(rows.resp.Body)
+		}
+	}()
 
-	resultsDecoder, err := getDecoder(rows.results)
+	var err error
+	resultsDecoder = rows.dec
+	if resultsDecoder == nil {
+		// the response was read in full: its in-flight slot is not needed
+		// while the rows are read
+		releaseInFlight(rows.resp.Body)
+		resultsDecoder, err = getDecoder(rows.results)
+		if err == nil {
+			_, err = resultsDecoder.Token() // opening bracket
+		}
+	}
 	if err != nil {
-		rows.errChan <- err
-	} else {
-		err = resultsDecoder.Decode(&resultRows)
-		if err != nil {
-			rows.errChan <- err
+		select {
+		case rows.errChan <- err:
+		case <-rows.done:
+			return
 		}
 	}
 
-	if rows.extras != nil {
-		rows.resultChan <- rows.extras
+	if rows.extras != nil && !rows.send(rows.extras) {
+		return
 	}
 
 	// second row will be metrics
-	if rows.metrics != nil {
-		rows.resultChan <- rows.metrics
+	if rows.metrics != nil && !rows.send(rows.metrics) {
+		return
 	}
 
-	for _, row := range resultRows {
-		if rows.closed == true {
+	// results are decoded one at a time, as Next() asks for them
+	tracer := tracerOf(rows.resp.Body)
+	limits := currentDecodeLimits()
+	var received int64
+	for err == nil && resultsDecoder.More() {
+		var row interface{}
+		decodeStart := time.Now()
+		if rows.keepRaw || rows.useNumber || limits != nil {
+			var raw json.RawMessage
+			if err = resultsDecoder.Decode(&raw); err == nil && limits != nil {
+				err = limits.check(raw, received+1)
+			}
+			if err == nil {
+				var value interface{}
+				err = unmarshalRow(raw, &value, rows.useNumber)
+				row = value
+				if rows.keepRaw {
+					row = rawRow{raw: raw, value: value}
+				}
+			}
+		} else {
+			err = resultsDecoder.Decode(&row)
+		}
+		tracer.addDecode(decodeStart)
+		if err == nil {
+			received++
+			atomic.AddInt64(&rows.stats.rowsDecoded, 1)
+		}
+		if err != nil {
+			releaseInFlight(rows.resp.Body)
+			select {
+			case rows.errChan <- err:
+			case <-rows.done:
+				return
+			}
 			break
 		}
-		rows.resultChan <- row
+		if !rows.send(row) {
+			return
+		}
 	}
 
-	if rows.errors != nil {
-		rows.resultChan <- rows.errors
+	// what follows streamed results, errors in particular
+	if err == nil && rows.dec != nil {
+		status, err := readTrailer(resultsDecoder)
+		releaseInFlight(rows.resp.Body)
+		if err != nil {
+			select {
+			case rows.errChan <- err:
+			case <-rows.done:
+			}
+			return
+		}
+		rows.trailerErr = status.err(received)
+		rows.trailerWarnings = status.warnings
+		rows.trailerMetrics = status.metrics.metrics()
+		rows.trailerProfile = parseProfile(status.profile)
+	}
+
+	if rows.errors != nil && !rows.send(rows.errors) {
+		return
 	}
 
 	close(rows.resultChan)
 
 }
 
+// Read the end of the results and the fields of the response that follow
+// them, up to its closing brace.
+func readTrailer(dec *json.Decoder) (*responseStatus, error) {
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, err
+	}
+	status := &responseStatus{}
+	for dec.More() {
+		key, err := decodeKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := status.decode(dec, key)
+		if !ok {
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// record the size of the results that were never delivered
+func (rows *rowsFeed) discard(dec *json.Decoder) {
+	var n int64
+	if dec != nil {
+		if r, ok := dec.Buffered().(interface{ Len() int }); ok {
+			n += int64(r.Len())
+		}
+	}
+	if r, ok := rows.results.(interface{ Len() int }); ok {
+		n += int64(r.Len())
+	}
+	atomic.AddInt64(&rows.stats.earlyClosed, 1)
+	atomic.AddInt64(&rows.stats.bytesDiscarded, n)
+}
+
+// hand a row over to Next, unless the rows are closed first
+func (rows *rowsFeed) send(row interface{}) bool {
+	select {
+	case rows.resultChan <- row:
+		return true
+	case <-rows.done:
+		return false
+	}
+}
+
 func (rows *n1qlRows) Columns() ([]string, error) {
-	// TODO: This should be computed once, and stored, particularly since it is used by every
-	// call to Next().
+	columns := rows.columnNames()
+	return append(make([]string, 0, len(columns)), columns...), nil
+}
+
+// The columns, computed once from the signature, as used by every call to Next()
+func (rows *n1qlRows) columnNames() []string {
+	if rows.columns != nil {
+		return rows.columns
+	}
 
 	var columns = make([]string, 0)
 
@@ -115,12 +417,89 @@ func (rows *n1qlRows) Columns() ([]string, error) {
 
 	sort.Strings(columns)
 	rows.columns = columns
-	return columns, nil
+	return columns
 }
 
+func (rows *n1qlRows) ColumnsReady() <-chan struct{} {
+	return rows.columnsReady
+}
+
+func (rows *n1qlRows) Signature() *Signature {
+	if rows.sig == nil {
+		rows.sig, _ = ParseSignature(rows.rawSignature)
+	}
+	return rows.sig
+}
+
+// The warnings sent before the results, and the ones sent after them once
+// the results are all read or the rows closed.
+func (rows *n1qlRows) Warnings() []Warning {
+	if !rows.ended && !rows.closed {
+		return rows.warnings
+	}
+	n := len(rows.warnings)
+	return append(rows.warnings[:n:n], rows.trailerWarnings...)
+}
+
+func (rows *n1qlRows) Metrics() *Metrics {
+	if (rows.ended || rows.closed) && rows.trailerMetrics != nil {
+		return rows.trailerMetrics
+	}
+	return rows.headMetrics
+}
+
+func (rows *n1qlRows) Profile() *QueryProfile {
+	if (rows.ended || rows.closed) && rows.trailerProfile != nil {
+		return rows.trailerProfile
+	}
+	return rows.headProfile
+}
+
+func (rows *n1qlRows) RequestID() string {
+	return rows.requestID
+}
+
+func (rows *n1qlRows) ClientContextID() string {
+	return rows.clientContextID
+}
+
+func (rows *n1qlRows) Status() string {
+	return rows.status
+}
+
+func (rows *n1qlRows) RawMetrics() json.RawMessage {
+	return rows.rawMetrics
+}
+
+// Close stops the delivery of rows and releases the response. Errors the
+// server reported are returned, and from then on by Err(), so they are not
+// lost when the caller stops iterating early. Errors that follow the results
+// are only known once the results are all read: closing before then aborts
+// the request without them.
 func (rows *n1qlRows) Close() error {
-	rows.closed = true
-	return nil
+	if !rows.closed {
+		rows.closed = true
+		close(rows.done)
+		if rows.dec != nil {
+			// the results may still be on their way: stop waiting for them
+			cancelResponse(rows.resp.Body)
+		}
+		<-rows.finished
+		if rows.deferredErr == nil {
+			rows.deferredErr = withClientContextID(withRequestID(rows.trailerErr, rows.requestID), rows.clientContextID)
+		}
+	}
+	rows.curValues = nil
+	rows.curRow = nil
+	rows.curRaw = nil
+	if rows.iterError == nil {
+		rows.iterError = rows.deferredErr
+	}
+	if onClose := rows.onClose; onClose != nil {
+		rows.onClose = nil
+		onClose(rows.rowsSent, rows.ended && rows.iterError == nil, rows.iterError)
+	}
+	return rows.deferredErr
 }
 
 func (rows *n1qlRows) Err() error {
@@ -135,46 +514,293 @@ func (rows *n1qlRows) Scan(dest ...interface{}) error {
 		return fmt.Errorf("Scan() asked for %d values, but only %d are available.", len(dest), len(rows.curValues))
 	}
 	for i, d := range dest {
-		curVal := rows.curValues[i]
-		switch ptr := d.(type) {
-		case *float64:
-			v, ok := curVal.(float64)
-			if !ok {
-				return fmt.Errorf("Cannot assign to *float64 at index %d of Scan() from value %v.", i, curVal)
+		if err := rows.scanColumn(d, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy column i of the current row into the destination d of Scan. The
+// sql.Null* types and pointers to pointers take null and missing values
+// as not valid and nil.
+func (rows *n1qlRows) scanColumn(d interface{}, i int) error {
+	value, present := rows.columnValue(i)
+	null := !present || value == nil
+	switch ptr := d.(type) {
+	case *sql.NullString:
+		ptr.String, ptr.Valid = "", !null
+		if null {
+			return nil
+		}
+		return rows.scanColumn(&ptr.String, i)
+	case *sql.NullFloat64:
+		ptr.Float64, ptr.Valid = 0, !null
+		if null {
+			return nil
+		}
+		return rows.scanColumn(&ptr.Float64, i)
+	case *sql.NullBool:
+		ptr.Bool, ptr.Valid = false, !null
+		if null {
+			return nil
+		}
+		return rows.scanColumn(&ptr.Bool, i)
+	case *sql.NullInt64:
+		ptr.Int64, ptr.Valid = 0, !null
+		if null {
+			return nil
+		}
+		return rows.scanColumn(&ptr.Int64, i)
+	case sql.Scanner:
+		return rows.scanScanner(ptr, i)
+	}
+	if v := reflect.ValueOf(d); v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Ptr {
+		if null {
+			v.Elem().Set(reflect.Zero(v.Elem().Type()))
+			return nil
+		}
+		p := reflect.New(v.Elem().Type().Elem())
+		if err := rows.scanColumn(p.Interface(), i); err != nil {
+			return err
+		}
+		v.Elem().Set(p)
+		return nil
+	}
+
+	curVal := rows.curValues[i]
+	switch ptr := d.(type) {
+	case *float64:
+		v, ok := numberValue(curVal)
+		if !ok {
+			return fmt.Errorf("Cannot assign to *float64 at index %d of Scan() from value %v.", i, curVal)
+		}
+		*ptr = v
+	case *string:
+		v, ok := curVal.(string)
+		if ok {
+			*ptr = v
+		} else {
+			bytes, err := json.Marshal(curVal)
+			if err != nil {
+				return err
 			}
+			*ptr = string(bytes)
+		}
+	case *bool:
+		v, ok := curVal.(bool)
+		if !ok {
+			return fmt.Errorf("Cannot assign to *bool at index %d of Scan() from value %v.", i, curVal)
+		}
+		*ptr = v
+	case *int:
+		if v, ok := exactInteger(curVal, strconv.IntSize); ok {
+			*ptr = int(v)
+			return nil
+		}
+		v, err := scanInteger(curVal, i, "int", -(1 << (strconv.IntSize - 1)), 1<<(strconv.IntSize-1))
+		if err != nil {
+			return err
+		}
+		*ptr = int(v)
+	case *int64:
+		if v, ok := exactInteger(curVal, 64); ok {
 			*ptr = v
-		case *string:
-			v, ok := curVal.(string)
-			if ok {
+			return nil
+		}
+		v, err := scanInteger(curVal, i, "int64", -(1 << 63), 1<<63)
+		if err != nil {
+			return err
+		}
+		*ptr = int64(v)
+	case *uint64:
+		if n, ok := curVal.(json.Number); ok {
+			if v, err := strconv.ParseUint(string(n), 10, 64); err == nil {
 				*ptr = v
-			} else {
-				bytes, err := json.Marshal(curVal)
-				if err != nil {
-					return err
-				}
-				*ptr = string(bytes)
-			}
-		case *bool:
-			v, ok := curVal.(bool)
-			if !ok {
-				return fmt.Errorf("Cannot assign to *bool at index %d of Scan() from value %v.", i, curVal)
+				return nil
 			}
+		}
+		v, err := scanInteger(curVal, i, "uint64", 0, 1<<64)
+		if err != nil {
+			return err
+		}
+		*ptr = uint64(v)
+	case *float32:
+		v, ok := numberValue(curVal)
+		if !ok {
+			return fmt.Errorf("Cannot assign to *float32 at index %d of Scan() from value %v.", i, curVal)
+		}
+		if math.Abs(v) > math.MaxFloat32 {
+			return &OverflowError{Value: v, Type: "float32", Index: i}
+		}
+		*ptr = float32(v)
+	case *json.Number:
+		switch v := curVal.(type) {
+		case json.Number:
 			*ptr = v
+		case float64:
+			*ptr = json.Number(strconv.FormatFloat(v, 'g', -1, 64))
 		default:
-			return fmt.Errorf("Unsupported destination type at parameter %d of Scan().", i)
+			return fmt.Errorf("Cannot assign to *json.Number at index %d of Scan() from value %v.", i, curVal)
+		}
+	case *json.RawMessage:
+		v, err := rows.rawValue(i)
+		if err != nil {
+			return err
+		}
+		*ptr = v
+	case *[]byte:
+		v, err := rows.rawValue(i)
+		if err != nil {
+			return err
+		}
+		*ptr = v
+	case *time.Time:
+		v, err := parseTime(curVal)
+		if err != nil {
+			return fmt.Errorf("Cannot assign to *time.Time at index %d of Scan() from value %v: %w", i, curVal, err)
 		}
+		*ptr = v
+	default:
+		return fmt.Errorf("Unsupported destination type at parameter %d of Scan().", i)
+	}
+	return nil
+}
+
+// Hand column i of the current row to a sql.Scanner, as the value
+// database/sql would: strings, numbers, booleans and null as they are,
+// objects and arrays as their JSON, and missing values as null.
+func (rows *n1qlRows) scanScanner(scanner sql.Scanner, i int) error {
+	value, _ := rows.columnValue(i)
+	switch v := value.(type) {
+	case json.Number:
+		if n, ok := exactInteger(v, 64); ok {
+			value = n
+		} else if f, ok := numberValue(v); ok {
+			value = f
+		}
+	case map[string]interface{}, []interface{}:
+		raw, err := rows.rawValue(i)
+		if err != nil {
+			return err
+		}
+		value = raw
+	}
+	if err := scanner.Scan(value); err != nil {
+		return fmt.Errorf("Cannot scan value %v at index %d of Scan(): %w", rows.curValues[i], i, err)
+	}
+	return nil
+}
+
+// The value of column i of the current row, and whether the row has it.
+// Object rows of several columns lack the columns they have no field for.
+func (rows *n1qlRows) columnValue(i int) (interface{}, bool) {
+	if row, ok := rows.curRow.(map[string]interface{}); ok && len(rows.curValues) > 1 {
+		value, present := row[rows.columnNames()[i]]
+		return value, present
+	}
+	return rows.curValues[i], true
+}
+
+// The JSON of the value of column i of the current row. The JSON of a
+// single column row is the one received, shared with the row.
+func (rows *n1qlRows) rawValue(i int) ([]byte, error) {
+	if rows.curRaw != nil && len(rows.curValues) == 1 {
+		return rows.curRaw, nil
+	}
+	return json.Marshal(rows.curValues[i])
+}
+
+// Returned by Scan when a number does not fit in its destination.
+type OverflowError struct {
+	Value float64
+	Type  string // of the destination
+	Index int    // of the destination
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("N1QL: Value %v at index %d of Scan() overflows %s", e.Value, e.Index, e.Type)
+}
+
+// The value of a JSON number as an integer within [min, max)
+func scanInteger(value interface{}, index int, typ string, min, max float64) (float64, error) {
+	v, ok := numberValue(value)
+	if !ok || v != math.Trunc(v) {
+		return 0, fmt.Errorf("Cannot assign to *%s at index %d of Scan() from value %v.", typ, index, value)
+	}
+	if v < min || v >= max {
+		return 0, &OverflowError{Value: v, Type: typ, Index: index}
+	}
+	return v, nil
+}
 
+// The value of a JSON number, decoded as a float64 or as a json.Number.
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// The value of a json.Number written as an integer of bitSize bits, which
+// is exact where its float64 may not be.
+func exactInteger(value interface{}, bitSize int) (int64, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(n), 10, bitSize)
+	return v, err == nil
+}
+
+func (rows *n1qlRows) ScanInto(dest []interface{}) error {
+	return rows.Scan(dest...)
+}
+
+func (rows *n1qlRows) ScanRow(buf *RowBuffer) error {
+	if rows.curValues == nil {
+		return errors.New("No current row.")
 	}
+	buf.Values = append(buf.Values[:0], rows.curValues...)
 	return nil
 }
 
 func (rows *n1qlRows) Next() bool {
+	if rows.closed {
+		return false
+	}
+next:
 	select {
 	case r, ok := <-rows.resultChan:
 		if ok {
-			cols, _ := rows.Columns()
-			numColumns := len(cols)
-			dest := make([]interface{}, numColumns)
+			numColumns := len(rows.columnNames())
+
+			rows.curRaw = nil
+			if row, isRaw := r.(rawRow); isRaw {
+				rows.curRaw = row.raw
+				r = row.value
+			}
+			if rows.transforms != nil {
+				var keep bool
+				if r, keep = applyTransforms(rows.transforms, r); !keep {
+					goto next
+				}
+				// the row may no longer be the JSON it was decoded from
+				rows.curRaw = nil
+			}
+
+			// the values are copied out by Scan, so the slice is reused
+			if cap(rows.values) < numColumns {
+				rows.values = make([]interface{}, numColumns)
+			}
+			dest := rows.values[:numColumns]
+			for i := range dest {
+				dest[i] = nil
+			}
 
 			if numColumns == 1 {
 				dest[0] = r
@@ -206,6 +832,9 @@ func (rows *n1qlRows) Next() bool {
 				case []interface{}:
 					i := 0
 					for _, value := range resultRow {
+						if i >= numColumns {
+							break
+						}
 						dest[i] = value
 						i++
 					}
@@ -214,9 +843,19 @@ func (rows *n1qlRows) Next() bool {
 			}
 			rows.rowsSent++
 			rows.curValues = dest
+			rows.curRow = r
 			return true
 		} else {
+			rows.ended = true
 			rows.curValues = nil
+			rows.curRow = nil
+			rows.curRaw = nil
+			if rows.deferredErr == nil {
+				rows.deferredErr = withClientContextID(withRequestID(rows.trailerErr, rows.requestID), rows.clientContextID)
+			}
+			if rows.iterError == nil {
+				rows.iterError = rows.deferredErr
+			}
 			return false
 		}
 	case e := <-rows.errChan:
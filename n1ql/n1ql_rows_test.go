@@ -0,0 +1,1088 @@
+package n1ql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPassthroughSummary(t *testing.T) {
+	SetPassthroughMode(true)
+	defer SetPassthroughMode(false)
+
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"requestID":"5a3e","signature":{"zip":"string"},"results":[{"zip":"02134"}],` +
+			`"status":"success","metrics":{"elapsedTime":"1.5ms","resultCount":1,"resultSize":10000000000000000001}}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT zip FROM addresses")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	defer rows.Close()
+
+	nrows := rows.(N1qlRows)
+	if nrows.RequestID() != "5a3e" || nrows.Status() != "success" {
+		t.Errorf("Unexpected request ID %q or status %q", nrows.RequestID(), nrows.Status())
+	}
+	metrics := `{"elapsedTime":"1.5ms","resultCount":1,"resultSize":10000000000000000001}`
+	if string(nrows.RawMetrics()) != metrics {
+		t.Errorf("Unexpected metrics %s", nrows.RawMetrics())
+	}
+
+	var vals []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal("Scan failed.", err.Error())
+		}
+		vals = append(vals, v)
+	}
+	if len(vals) != 4 {
+		t.Fatalf("Expected 4 rows, got %v", vals)
+	}
+	if vals[0] != `{"requestID":"5a3e","signature":{"zip":"string"},"status":"success"}` {
+		t.Errorf("Unexpected summary row %s", vals[0])
+	}
+	if vals[1] != metrics {
+		t.Errorf("Unexpected metrics row %s", vals[1])
+	}
+	if vals[3] != `{"errors":null}` {
+		t.Errorf("Unexpected errors row %s", vals[3])
+	}
+}
+
+func TestCloseReportsDeferredErrors(t *testing.T) {
+	var errorsFirst bool
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		errs := `"errors":[{"code":5010,"msg":"Error evaluating projection"}]`
+		if errorsFirst {
+			w.Write([]byte(`{"signature":{"a":"number"},` + errs + `,"results":[{"a":1},{"a":2},{"a":3}],"status":"errors"}`))
+			return
+		}
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1},{"a":2},{"a":3}],` + errs + `,"status":"errors"}`))
+	})
+	defer srv.Close()
+
+	// errors sent ahead of the results are known before they are read
+	errorsFirst = true
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Close(); err == nil {
+		t.Error("Expected Close to report the server errors")
+	}
+	if rows.Err() == nil {
+		t.Error("Expected Err to report the server errors")
+	}
+	if rows.Next() {
+		t.Error("Expected no rows after Close")
+	}
+
+	errorsFirst = false
+	rows, err = conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if n != 3 || rows.Err() == nil {
+		t.Errorf("Expected 3 rows followed by an error, got %d rows and %v", n, rows.Err())
+	}
+	if err := rows.Close(); err == nil {
+		t.Error("Expected Close to report the errors following the results")
+	}
+}
+
+func TestRowsAreStreamed(t *testing.T) {
+	release := make(chan struct{})
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1},`))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(`{"a":2}],"errors":[{"code":5010,"msg":"Error evaluating projection"}],"status":"errors"}`))
+	})
+	defer srv.Close()
+	defer close(release)
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	defer rows.Close()
+
+	// the first row is delivered while the server is still sending the rest
+	var row string
+	if !rows.Next() || rows.Scan(&row) != nil || row != `{"a":1}` {
+		t.Fatalf("Expected the first row before the end of the response, got %s", row)
+	}
+	release <- struct{}{}
+	if !rows.Next() || rows.Scan(&row) != nil || row != `{"a":2}` {
+		t.Fatalf("Expected the second row, got %s", row)
+	}
+	if rows.Next() {
+		t.Fatal("Expected no more rows")
+	}
+	if err := rows.Err(); err == nil || !strings.Contains(err.Error(), "5010") {
+		t.Errorf("Expected the errors following the results, got %v", err)
+	}
+}
+
+func TestEarlyCloseDiscardsResults(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[`))
+		for i := 0; i < 1000; i++ {
+			if i > 0 {
+				w.Write([]byte(","))
+			}
+			w.Write([]byte(`{"a":1}`))
+		}
+		w.Write([]byte(`],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	db := &n1qlDB{conn: conn}
+	rows, err := db.conn.Query("SELECT a FROM default LIMIT 1000")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	for i := 0; i < 10 && rows.Next(); i++ {
+	}
+	rows.Close()
+
+	stats := db.Stats().(N1qlDBStats)
+	if stats.EarlyClosedRequests() != 1 {
+		t.Errorf("Expected 1 early closed request, got %d", stats.EarlyClosedRequests())
+	}
+	// the results are streamed, so most of them were never read
+	if stats.BytesReceived() > int64(500*len(`{"a":1},`)) {
+		t.Errorf("Expected the request to stop early, got %d bytes", stats.BytesReceived())
+	}
+
+	rows, err = db.conn.Query("SELECT a FROM default LIMIT 1000")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if n := db.Stats().(N1qlDBStats).EarlyClosedRequests(); n != 1 {
+		t.Errorf("Fully read results must not count as early closed, got %d", n)
+	}
+}
+
+func TestScanRowReusesBuffer(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number","b":"string"},` +
+			`"results":[{"a":1,"b":"x"},{"a":2,"b":"y"},{"a":3}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a, b FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	defer rows.Close()
+	nrows := rows.(N1qlRows)
+
+	var buf RowBuffer
+	var a float64
+	var b string
+	dest := []interface{}{&a, &b}
+	var sum float64
+	var names string
+	for nrows.Next() {
+		if err := nrows.ScanRow(&buf); err != nil {
+			t.Fatal("ScanRow failed.", err.Error())
+		}
+		if len(buf.Values) != 2 || buf.Values[0] != a+1 {
+			t.Errorf("Unexpected row %v", buf.Values)
+		}
+		if err := nrows.ScanInto(dest); err != nil {
+			t.Fatal("ScanInto failed.", err.Error())
+		}
+		sum += a
+		names += b
+	}
+	if sum != 6 || names != "xy" {
+		t.Errorf("Unexpected values %v %q", sum, names)
+	}
+}
+
+func TestRowsMemoryAccounting(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1},{"a":2},{"a":3}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	// only what was received ahead of decoding is held
+	stats := conn.stats.snapshot()
+	buffered := stats.BytesBuffered()
+	if stats.BufferedResultSets() != 1 || buffered <= 0 || buffered > int64(len(`{"a":1},{"a":2},{"a":3}],"status":"success"}`)) {
+		t.Errorf("Unexpected buffered results %d, %d bytes", stats.BufferedResultSets(), buffered)
+	}
+
+	// a second result set would go over the limit
+	SetRowsMemoryLimit(buffered + 1)
+	defer SetRowsMemoryLimit(0)
+	if _, err := conn.Query("SELECT a FROM default"); !errors.Is(err, ErrRowsMemoryLimit) {
+		t.Errorf("Expected ErrRowsMemoryLimit, got %v", err)
+	}
+
+	rows.Close()
+	stats = conn.stats.snapshot()
+	if stats.BufferedResultSets() != 0 || stats.BytesBuffered() != 0 {
+		t.Errorf("Expected closed rows to release their results, got %d, %d bytes", stats.BufferedResultSets(), stats.BytesBuffered())
+	}
+	rows, err = conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Expected the query to fit once the first rows are closed.", err)
+	}
+	rows.Close()
+}
+
+func TestStructScan(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"*":"*"},"results":[` +
+			`{"id":"k1","Name":"Alice","age":31,"tags":["a","b"],"address":{"city":"Paris"},"zip":"75001","extra":true},` +
+			`{"id":"k2","name":"Bob"}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	type Base struct {
+		ID string `n1ql:"id" json:"key"`
+	}
+	type person struct {
+		Base
+		Name    string
+		Age     int      `json:"age,omitempty"`
+		Tags    []string `n1ql:"tags"`
+		Address struct {
+			City string `json:"city"`
+		} `n1ql:"address"`
+		Zip    string `n1ql:"-"`
+		secret string
+	}
+
+	rows, err := conn.Query("SELECT * FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	defer rows.Close()
+	nrows := rows.(N1qlRows)
+
+	var p person
+	if err := nrows.StructScan(&p); err == nil {
+		t.Error("Expected StructScan to fail before Next")
+	}
+	if !nrows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := nrows.StructScan(&p); err != nil {
+		t.Fatal("StructScan failed.", err)
+	}
+	if p.ID != "k1" || p.Name != "Alice" || p.Age != 31 || len(p.Tags) != 2 || p.Address.City != "Paris" || p.Zip != "" {
+		t.Errorf("Unexpected struct %+v", p)
+	}
+
+	// the fields the second row does not have are reset
+	if !nrows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := nrows.StructScan(&p); err != nil {
+		t.Fatal("StructScan failed.", err)
+	}
+	if p.ID != "k2" || p.Name != "Bob" || p.Age != 0 || p.Tags != nil || p.Address.City != "" {
+		t.Errorf("Unexpected struct %+v", p)
+	}
+
+	if err := nrows.StructScan(p); err == nil {
+		t.Error("Expected StructScan to reject a non pointer")
+	}
+	var wrong struct {
+		Name int `n1ql:"name"`
+	}
+	if err := nrows.StructScan(&wrong); err == nil {
+		t.Error("Expected StructScan to report a type mismatch")
+	}
+}
+
+func TestResultVerification(t *testing.T) {
+	var response string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	})
+	defer srv.Close()
+
+	count := func() (int, error) {
+		rows, err := conn.Query("SELECT a FROM default")
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		return n, rows.Close()
+	}
+
+	// a truncated result goes unnoticed unless verification is on
+	response = `{"signature":{"a":"number"},"results":[{"a":1},{"a":2}],"metrics":{"resultCount":3},"status":"success"}`
+	if n, err := count(); n != 2 || err != nil {
+		t.Errorf("Expected 2 rows and no error, got %d, %v", n, err)
+	}
+	SetResultVerification(true)
+	defer SetResultVerification(false)
+	if n, err := count(); n != 2 || !errors.Is(err, ErrResultMismatch) {
+		t.Errorf("Expected 2 rows and ErrResultMismatch, got %d, %v", n, err)
+	}
+	response = `{"signature":{"a":"number"},"results":[],"metrics":{"resultCount":1},"status":"success"}`
+	if n, err := count(); n != 0 || !errors.Is(err, ErrResultMismatch) {
+		t.Errorf("Expected no rows and ErrResultMismatch, got %d, %v", n, err)
+	}
+
+	response = `{"signature":{"a":"number"},"results":[{"a":1},{"a":2}],"metrics":{"resultCount":2},"status":"success"}`
+	if n, err := count(); n != 2 || err != nil {
+		t.Errorf("Expected 2 rows and no error, got %d, %v", n, err)
+	}
+	response = `{"signature":{"a":"number"},"results":[{"a":1}],"status":"success"}`
+	if n, err := count(); n != 1 || err != nil {
+		t.Errorf("Expected a response without metrics to pass, got %d, %v", n, err)
+	}
+}
+
+func TestScanTime(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":"json","results":["2021-03-04T05:06:07.5+01:00","2021-03-04 05:06:07",` +
+			`"2021-03-04",1614834367000,-1500,"04/03/2021",true],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	scan := func() ([]time.Time, []error) {
+		rows, err := conn.Query("SELECT RAW t FROM default")
+		if err != nil {
+			t.Fatal("Query failed.", err)
+		}
+		defer rows.Close()
+		var times []time.Time
+		var errs []error
+		for rows.Next() {
+			var v time.Time
+			err := rows.Scan(&v)
+			times = append(times, v)
+			errs = append(errs, err)
+		}
+		return times, errs
+	}
+
+	times, errs := scan()
+	expected := []time.Time{
+		time.Date(2021, 3, 4, 4, 6, 7, 500000000, time.UTC),
+		time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		time.Date(1969, 12, 31, 23, 59, 58, 500000000, time.UTC),
+	}
+	for i, e := range expected {
+		if errs[i] != nil || !times[i].Equal(e) {
+			t.Errorf("Row %d: expected %v, got %v, %v", i, e, times[i], errs[i])
+		}
+	}
+	if errs[5] == nil || errs[6] == nil {
+		t.Errorf("Expected unrecognized dates to fail, got %v, %v", errs[5], errs[6])
+	}
+
+	SetTimeLayouts("02/01/2006")
+	defer SetTimeLayouts()
+	times, errs = scan()
+	if errs[0] == nil || errs[5] != nil || !times[5].Equal(time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected only the custom layout to be used, got %v, %v, %v", errs[0], times[5], errs[5])
+	}
+}
+
+func TestScanNumbers(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"a":"number","b":"number","c":"number","d":"number"},` +
+			`"results":[{"a":42,"b":-9007199254740992,"c":18446744073709549568,"d":1.5},` +
+			`{"a":1.5,"b":9223372036854775808,"c":-1,"d":1e39}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a, b, c, d FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+
+	var a int
+	var b int64
+	var c uint64
+	var d float32
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Scan(&a, &b, &c, &d); err != nil {
+		t.Fatal("Scan failed.", err)
+	}
+	if a != 42 || b != -9007199254740992 || c != 18446744073709549568 || d != 1.5 {
+		t.Errorf("Unexpected values %d %d %d %v", a, b, c, d)
+	}
+
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	var overflow *OverflowError
+	if err := rows.Scan(&a); err == nil || errors.As(err, &overflow) {
+		t.Errorf("Expected a fraction to be rejected, got %v", err)
+	}
+	for i, dest := range []interface{}{&b, &c, &d} {
+		values := []interface{}{new(string), new(string), new(string), new(string)}
+		values[i+1] = dest
+		err := rows.Scan(values...)
+		if !errors.As(err, &overflow) || overflow.Index != i+1 {
+			t.Errorf("Expected an overflow at index %d, got %v", i+1, err)
+		}
+	}
+}
+
+func TestScanRaw(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.Contains(r.PostForm.Get("statement"), "RAW") {
+			w.Write([]byte(`{"signature":"json","results":[{"b": [1, {"c": null}], "a": 12345678901234567890}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"signature":{"a":"json","b":"json"},"results":[{"a":{"x":1},"b":[true]}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	// the JSON of a single column row is the one sent by the server
+	rows, err := conn.Query("SELECT RAW d FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	var raw json.RawMessage
+	var b []byte
+	if !rows.Next() || rows.Scan(&raw) != nil || rows.Scan(&b) != nil {
+		t.Fatal("Expected a row")
+	}
+	if string(raw) != `{"b": [1, {"c": null}], "a": 12345678901234567890}` || string(b) != string(raw) {
+		t.Errorf("Unexpected raw values %s, %s", raw, b)
+	}
+	rows.Close()
+
+	rows, err = conn.Query("SELECT a, b FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+	if !rows.Next() || rows.Scan(&raw, &b) != nil {
+		t.Fatal("Expected a row")
+	}
+	if string(raw) != `{"x":1}` || string(b) != `[true]` {
+		t.Errorf("Unexpected raw values %s, %s", raw, b)
+	}
+}
+
+// A custom type scanning the JSON of an object
+type point struct {
+	X, Y float64
+}
+
+func (p *point) Scan(value interface{}) error {
+	raw, ok := value.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected %T", value)
+	}
+	return json.Unmarshal(raw, p)
+}
+
+func TestScanScanner(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"p":"json","s":"string","n":"number"},` +
+			`"results":[{"p":{"X":1,"Y":2},"s":"x"},{"p":[1],"s":null,"n":3}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT p, s, n FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+
+	// columns in sorted order: n, p, s
+	var n sql.NullFloat64
+	var p point
+	var s sql.NullString
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Scan(&n, &p, &s); err != nil {
+		t.Fatal("Scan failed.", err)
+	}
+	if p.X != 1 || p.Y != 2 || !s.Valid || s.String != "x" {
+		t.Errorf("Unexpected values %+v %+v", p, s)
+	}
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Scan(&n, new(string), &s); err != nil || !n.Valid || n.Float64 != 3 || s.Valid {
+		t.Errorf("Unexpected values %+v %+v, %v", n, s, err)
+	}
+	if err := rows.Scan(&n, &p); err == nil || !strings.Contains(err.Error(), "cannot unmarshal array") {
+		t.Errorf("Expected the error of the scanner, got %v", err)
+	}
+}
+
+func TestScanNulls(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"b":"boolean","f":"number","i":"number","s":"string"},` +
+			`"results":[{"b":true,"f":2.5,"i":1000000,"s":"x"},{"b":null,"i":null}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT b, f, i, s FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+
+	var b sql.NullBool
+	var f sql.NullFloat64
+	var i sql.NullInt64
+	var s sql.NullString
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Scan(&b, &f, &i, &s); err != nil {
+		t.Fatal("Scan failed.", err)
+	}
+	if !b.Valid || !b.Bool || !f.Valid || f.Float64 != 2.5 || !i.Valid || i.Int64 != 1000000 || !s.Valid || s.String != "x" {
+		t.Errorf("Unexpected values %+v %+v %+v %+v", b, f, i, s)
+	}
+	var pb *bool
+	var pi *int64
+	var ps *string
+	if err := rows.Scan(&pb, new(float64), &pi, &ps); err != nil {
+		t.Fatal("Scan failed.", err)
+	}
+	if pb == nil || !*pb || pi == nil || *pi != 1000000 || ps == nil || *ps != "x" {
+		t.Errorf("Unexpected values %v %v %v", pb, pi, ps)
+	}
+
+	// null and missing
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	if err := rows.Scan(&b, &f, &i, &s); err != nil {
+		t.Fatal("Scan failed.", err)
+	}
+	if b.Valid || f.Valid || i.Valid || s.Valid {
+		t.Errorf("Expected no valid value, got %+v %+v %+v %+v", b, f, i, s)
+	}
+	if err := rows.Scan(&pb, new(*float64), &pi, &ps); err != nil {
+		t.Fatal("Scan failed.", err)
+	}
+	if pb != nil || pi != nil || ps != nil {
+		t.Errorf("Expected nil pointers, got %v %v %v", pb, pi, ps)
+	}
+	if err := rows.Scan(new(bool)); err == nil {
+		t.Error("Expected null to fail a *bool")
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"f":"number","n":"number"},` +
+			`"results":[{"f":1.5,"n":9007199254740993}],"status":"success"}`))
+	}
+	conn, srv := newTestConn(handler)
+	defer srv.Close()
+
+	// by default, integers beyond 2^53 are rounded
+	rows, err := conn.Query("SELECT f, n FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	var n int64
+	if !rows.Next() || rows.Scan(new(float64), &n) != nil || n == 9007199254740993 {
+		t.Errorf("Expected a rounded value, got %d", n)
+	}
+	rows.Close()
+
+	conn.useNumber = true
+	rows, err = conn.Query("SELECT f, n FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatal("Expected a row")
+	}
+	var f float64
+	var u uint64
+	var s string
+	var num json.Number
+	var ni sql.NullInt64
+	for _, dest := range [][]interface{}{{&f, &n}, {new(float32), &u}, {new(string), &s}, {new(json.Number), &num}, {new(float64), &ni}} {
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatalf("Scan into %T failed: %v", dest[1], err)
+		}
+	}
+	if f != 1.5 || n != 9007199254740993 || u != 9007199254740993 || s != "9007199254740993" ||
+		num != "9007199254740993" || ni.Int64 != 9007199254740993 {
+		t.Errorf("Unexpected values %v %v %v %v %v %v", f, n, u, s, num, ni)
+	}
+	var v struct{ N int64 }
+	if err := rows.(N1qlRows).StructScan(&v); err != nil || v.N != 9007199254740993 {
+		t.Errorf("Unexpected struct %+v, %v", v, err)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	SetDecodeLimits(4, 64)
+	defer SetDecodeLimits(0, 0)
+
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		row := `{"a":[[{"b":"[[[["}]]}`
+		switch r.PostForm.Get("statement") {
+		case "SELECT deep":
+			row = `{"a":[[{"b":[1]}]]}`
+		case "SELECT big":
+			row = `{"a":"` + strings.Repeat("x", 64) + `"}`
+		}
+		w.Write([]byte(`{"signature":{"a":"json"},"results":[{"a":1},` + row + `],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	for _, c := range []struct {
+		statement string
+		limit     string
+	}{
+		{"SELECT ok", ""},
+		{"SELECT deep", "depth"},
+		{"SELECT big", "size"},
+	} {
+		rows, err := conn.Query(c.statement)
+		if err != nil {
+			t.Fatal("Query failed.", err)
+		}
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		err = rows.Err()
+		rows.Close()
+
+		var limitErr *DecodeLimitError
+		if c.limit == "" {
+			if err != nil || n != 2 {
+				t.Errorf("%s: Expected 2 rows, got %d, %v", c.statement, n, err)
+			}
+		} else if !errors.As(err, &limitErr) || limitErr.Limit != c.limit || limitErr.Row != 2 || n != 1 {
+			t.Errorf("%s: Expected row 2 over the %s limit, got %d rows, %v", c.statement, c.limit, n, err)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"requestID":"r1","warnings":[{"code":4000,"msg":"Index advice"}],"results":[{"a":1},{"a":2}],` +
+			`"warnings":[{"code":1203,"msg":"Deprecated function"}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	check := func(rows N1qlRows, want ...Warning) {
+		t.Helper()
+		got := rows.Warnings()
+		if len(got) != len(want) {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		}
+	}
+	advice := Warning{Code: 4000, Message: "Index advice"}
+	deprecated := Warning{Code: 1203, Message: "Deprecated function"}
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	check(rows.(N1qlRows), advice)
+	for rows.Next() {
+	}
+	check(rows.(N1qlRows), advice, deprecated)
+	rows.Close()
+
+	SetPassthroughMode(true)
+	defer SetPassthroughMode(false)
+	rows, err = conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+	// the last of the repeated keys is kept
+	check(rows.(N1qlRows), deprecated)
+}
+
+func TestResponseStatus(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "SELECT") {
+			w.Write([]byte(`{"results":[{"a":1}],"status":"stopped"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"status":"timeout","metrics":{"mutationCount":3}}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Expected the partial results to be returned.", err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	var serr *StatusError
+	if n != 1 || !errors.As(rows.Err(), &serr) || serr.Status != "stopped" {
+		t.Errorf("Expected the row and the status, got %d rows and %v", n, rows.Err())
+	}
+	rows.Close()
+
+	if _, err := conn.Exec("UPDATE default SET a = 1"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.PostForm.Get("statement") {
+		case "SELECT a FROM default":
+			w.Write([]byte(`{"requestID":"r1","results":[{"a":1}],"status":"success"}`))
+		case "SELECT a FROM late":
+			w.Write([]byte(`{"requestID":"r2","results":[{"a":1}],` +
+				`"errors":[{"code":5000,"msg":"Panic"}],"status":"fatal"}`))
+		case "SELECT a FROM missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"requestID":"r3","errors":[{"code":12003,"msg":"Keyspace not found"}],"status":"fatal"}`))
+		case "UPDATE default SET a = 1":
+			w.Write([]byte(`{"requestID":"r4","results":[],"status":"success","metrics":{"mutationCount":1}}`))
+		default:
+			w.Write([]byte(`{"requestID":"r5","results":[],"status":"stopped"}`))
+		}
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	if id := rows.(N1qlRows).RequestID(); id != "r1" {
+		t.Errorf("Expected request r1, got %q", id)
+	}
+	rows.Close()
+
+	rows, err = conn.Query("SELECT a FROM late")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	for rows.Next() {
+	}
+	if id := RequestIDOf(rows.Err()); id != "r2" || !strings.Contains(rows.Err().Error(), "(request r2)") {
+		t.Errorf("Expected the error of request r2, got %q: %v", id, rows.Err())
+	}
+	rows.Close()
+
+	_, err = conn.Query("SELECT a FROM missing")
+	var qerr *Error
+	if !errors.As(err, &qerr) || qerr.RequestID != "r3" {
+		t.Errorf("Expected the error of request r3, got %v", err)
+	}
+
+	res, err := conn.Exec("UPDATE default SET a = 1")
+	if err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if id := res.(N1qlResult).RequestID(); id != "r4" {
+		t.Errorf("Expected request r4, got %q", id)
+	}
+
+	_, err = conn.Exec("DELETE FROM default")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || RequestIDOf(err) != "r5" {
+		t.Errorf("Expected the status of request r5, got %v", err)
+	}
+}
+
+func TestClientContextID(t *testing.T) {
+	var sent []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sent = append(sent, r.PostForm.Get("client_context_id"))
+		if strings.HasPrefix(r.PostForm.Get("statement"), "SELECT") {
+			w.Write([]byte(`{"results":[{"a":1}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"errors":[{"code":5000,"msg":"Panic"}],"status":"fatal"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a FROM default", ClientContextID("trace-1"))
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	if id := rows.(N1qlRows).ClientContextID(); id != "trace-1" || sent[0] != "trace-1" {
+		t.Errorf("Expected client context trace-1, got %q, sent %q", id, sent[0])
+	}
+	rows.Close()
+
+	rows, err = conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	if id := rows.(N1qlRows).ClientContextID(); len(id) != 36 || id != sent[1] {
+		t.Errorf("Expected a generated client context ID, got %q, sent %q", id, sent[1])
+	}
+	rows.Close()
+
+	_, err = conn.Exec("DELETE FROM default", ClientContextID("trace-2"))
+	if id := ClientContextIDOf(err); id != "trace-2" {
+		t.Errorf("Expected the error of client context trace-2, got %q: %v", id, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	const metrics = `"metrics":{"elapsedTime":"12.5ms","executionTime":"12ms","resultCount":2,` +
+		`"resultSize":42,"mutationCount":2,"errorCount":1}`
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "SELECT") {
+			w.Write([]byte(`{"results":[{"a":1},{"a":2}],"status":"success",` + metrics + `}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"status":"success",` + metrics + `}`))
+	})
+	defer srv.Close()
+
+	check := func(what string, got *Metrics) {
+		t.Helper()
+		want := Metrics{ElapsedTime: 12500 * time.Microsecond, ExecutionTime: 12 * time.Millisecond,
+			ResultCount: 2, ResultSize: 42, MutationCount: 2, ErrorCount: 1}
+		if got == nil || *got != want {
+			t.Errorf("%s: expected %+v, got %+v", what, want, got)
+		}
+	}
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	if m := rows.(N1qlRows).Metrics(); m != nil {
+		t.Errorf("Expected no metrics before the results are read, got %+v", m)
+	}
+	for rows.Next() {
+	}
+	check("rows", rows.(N1qlRows).Metrics())
+	rows.Close()
+
+	rows, err = conn.Query("UPDATE default SET a = 1")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	check("rows without results", rows.(N1qlRows).Metrics())
+	rows.Close()
+
+	res, err := conn.Exec("UPDATE default SET a = 1")
+	if err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	check("result", res.(N1qlResult).Metrics())
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("Expected 2 rows affected, got %d", n)
+	}
+
+	SetPassthroughMode(true)
+	defer SetPassthroughMode(false)
+	rows, err = conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+	check("passthrough", rows.(N1qlRows).Metrics())
+}
+
+func TestProfile(t *testing.T) {
+	const profile = `"profile":{"phaseTimes":{"authorize":"12µs","fetch":"1.5ms","primaryScan":"500µs"},` +
+		`"phaseCounts":{"fetch":2,"primaryScan":2},"phaseOperators":{"authorize":1,"fetch":1,"primaryScan":1},` +
+		`"executionTimings":{"#operator":"Authorize","#stats":{"#phaseSwitches":3,"execTime":"2µs","servTime":"10µs"},` +
+		`"~child":{"#operator":"Sequence","#stats":{"#phaseSwitches":1},"~children":[` +
+		`{"#operator":"PrimaryScan3","index":"#primary","keyspace":"default",` +
+		`"#stats":{"#itemsOut":2,"execTime":"20µs","kernTime":"1µs","servTime":"480µs"}},` +
+		`{"#operator":"Fetch","keyspace":"default","#stats":{"#itemsIn":2,"#itemsOut":2,"servTime":"1.4ms"}}]}}}`
+	var got url.Values
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got = r.PostForm
+		if strings.HasPrefix(r.PostForm.Get("statement"), "SELECT") {
+			w.Write([]byte(`{"results":[{"a":1},{"a":2}],"status":"success",` + profile + `}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"status":"success",` + profile + `}`))
+	})
+	defer srv.Close()
+
+	check := func(what string, p *QueryProfile) {
+		t.Helper()
+		if got.Get("profile") != "timings" {
+			t.Errorf("%s: expected profile=timings, got %q", what, got.Get("profile"))
+		}
+		if p == nil {
+			t.Fatalf("%s: no profile", what)
+		}
+		if p.PhaseTimes["fetch"] != 1500*time.Microsecond || p.PhaseCounts["fetch"] != 2 || p.PhaseOperators["authorize"] != 1 {
+			t.Errorf("%s: unexpected phases %v %v %v", what, p.PhaseTimes, p.PhaseCounts, p.PhaseOperators)
+		}
+		root := p.ExecutionTimings
+		if root == nil || root.Operator != "Authorize" || root.ServTime != 10*time.Microsecond || len(root.Children) != 1 {
+			t.Fatalf("%s: unexpected root %+v", what, root)
+		}
+		seq := root.Children[0]
+		if seq.Operator != "Sequence" || len(seq.Children) != 2 {
+			t.Fatalf("%s: unexpected sequence %+v", what, seq)
+		}
+		scan, fetch := seq.Children[0], seq.Children[1]
+		if scan.Operator != "PrimaryScan3" || scan.ItemsOut != 2 || scan.ServTime != 480*time.Microsecond ||
+			scan.Fields["index"] != "#primary" {
+			t.Errorf("%s: unexpected scan %+v", what, scan)
+		}
+		if fetch.Operator != "Fetch" || fetch.ItemsIn != 2 || fetch.ServTime != 1400*time.Microsecond {
+			t.Errorf("%s: unexpected fetch %+v", what, fetch)
+		}
+	}
+
+	rows, err := conn.Query("SELECT a FROM default", Profile(ProfileTimings))
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	for rows.Next() {
+	}
+	check("rows", rows.(N1qlRows).Profile())
+	rows.Close()
+
+	res, err := conn.Exec("UPDATE default SET a = 1", Profile(ProfileTimings))
+	if err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	check("result", res.(N1qlResult).Profile())
+}
+
+func TestServerCancel(t *testing.T) {
+	canceled := make(chan string, 2)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			canceled <- r.URL.Path
+			return
+		}
+		r.ParseForm()
+		if r.PostForm.Get("statement") == "SELECT a FROM done" {
+			w.Write([]byte(`{"requestID":"r2","results":[{"a":1}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"requestID":"r1","results":[{"a":1},`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, err := conn.QueryContext(ctx, "SELECT a FROM slow")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	if !rows.Next() {
+		t.Fatal("Expected the first row", rows.Err())
+	}
+	cancel()
+	select {
+	case path := <-canceled:
+		if path != "/admin/active_requests/r1" {
+			t.Errorf("Unexpected cancellation %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be canceled on the server")
+	}
+	rows.Close()
+
+	// requests that ended are not canceled
+	ctx, cancel = context.WithCancel(context.Background())
+	rows, err = conn.QueryContext(ctx, "SELECT a FROM done")
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	cancel()
+	select {
+	case path := <-canceled:
+		t.Errorf("Unexpected cancellation %s", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTransform(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":{"*":"*"},"results":[{"beer-sample":{"name":"ale","abv":5}},` +
+			`{"beer-sample":{"name":"water","abv":0}},{"beer-sample":{"name":"stout","abv":8}}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	strong := FilterRows(func(row map[string]interface{}) bool {
+		abv, _ := row["abv"].(float64)
+		return abv > 0
+	})
+	rows, err := conn.Query("SELECT * FROM `beer-sample`",
+		Transform(UnwrapField("beer-sample"), strong), Transform(RenameField("name", "beer")))
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != `{"abv":5,"beer":"ale"}` || got[1] != `{"abv":8,"beer":"stout"}` {
+		t.Errorf("Unexpected rows %v", got)
+	}
+}
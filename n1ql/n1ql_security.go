@@ -0,0 +1,98 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Error of a request that failed authentication or authorization, along
+// with its security context, to tell which grant is missing. errors.Is
+// matches ErrAuth, and errors.As the Error of the server, if any.
+type AuthorizationError struct {
+	// The user the request was authenticated as, "" if it had no
+	// credentials.
+	User string
+
+	// The keyspaces named by the statement, when the driver knows it.
+	Keyspaces []string
+
+	// The roles the server told the request requires, e.g.
+	// "query_select on travel-sample".
+	Roles []string
+
+	err error
+}
+
+func (e *AuthorizationError) Error() string {
+	var context []string
+	if e.User != "" {
+		context = append(context, "user "+e.User)
+	} else {
+		context = append(context, "no user")
+	}
+	if len(e.Keyspaces) > 0 {
+		context = append(context, "keyspaces "+strings.Join(e.Keyspaces, ", "))
+	}
+	if len(e.Roles) > 0 {
+		context = append(context, "requires "+strings.Join(e.Roles, ", "))
+	}
+	return e.err.Error() + " [" + strings.Join(context, "; ") + "]"
+}
+
+func (e *AuthorizationError) Unwrap() error {
+	return e.err
+}
+
+// The role advice of the authorization errors of the server, as in "Add
+// role query_select on travel-sample to allow the query to run."
+var roleAdvice = regexp.MustCompile(`(?i)\badd role (\S+) on (\S+?)\.?(?:\s|$)`)
+
+// err along with the security context of the request, if it failed
+// authentication or authorization. body is the response of the request,
+// and query its statement, "" if it runs a prepared one.
+func securityContext(err error, body io.ReadCloser, query string) error {
+	if err == nil || !errors.Is(err, ErrAuth) {
+		return err
+	}
+	var authErr *AuthorizationError
+	if errors.As(err, &authErr) {
+		return err
+	}
+	authErr = &AuthorizationError{err: err}
+	if rb, ok := body.(*responseBody); ok {
+		authErr.User = rb.user
+	}
+	if query != "" {
+		authErr.Keyspaces = statementKeyspaces(query)
+	}
+	var serverErr *Error
+	if errors.As(err, &serverErr) {
+		for _, e := range serverErr.Errors {
+			for _, m := range roleAdvice.FindAllStringSubmatch(e.Message, -1) {
+				authErr.Roles = append(authErr.Roles, m[1]+" on "+m[2])
+			}
+		}
+	}
+	return authErr
+}
+
+// Add the keyspaces of a prepared statement to the security context of
+// err, if it has one without them.
+func withKeyspaces(err error, keyspaces []string) error {
+	var authErr *AuthorizationError
+	if errors.As(err, &authErr) && len(authErr.Keyspaces) == 0 {
+		authErr.Keyspaces = keyspaces
+	}
+	return err
+}
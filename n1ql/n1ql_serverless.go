@@ -0,0 +1,184 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long serverless connections reuse the query nodes discovered by an
+// earlier Open of the same cluster before discovering them again.
+var ServerlessDiscoveryTTL = time.Minute
+
+// Settings of the transports of serverless connections: few idle sockets,
+// kept open long and probed often, so that warm invocations of a function
+// find a live socket.
+const (
+	serverlessMaxIdleConnsPerHost = 2
+	serverlessIdleConnTimeout     = 5 * time.Minute
+	serverlessKeepAlive           = 15 * time.Second
+	serverlessDialTimeout         = 5 * time.Second
+)
+
+// Query nodes discovered by serverless connections, by cluster.
+var discoveryCache = struct {
+	sync.Mutex
+	entries map[string]discoveryEntry
+}{entries: make(map[string]discoveryEntry)}
+
+type discoveryEntry struct {
+	queryAPIs []string
+	expires   time.Time
+}
+
+// Key of the query nodes of the cluster name, for the given options.
+func discoveryKey(name string, opts *Options) string {
+	return name + "|" + strconv.FormatBool(opts.IsAnalytics) + "|" + opts.networkType()
+}
+
+// Copy of the cached query nodes, nil if they are unknown or expired.
+func cachedQueryAPIs(key string) []string {
+	discoveryCache.Lock()
+	defer discoveryCache.Unlock()
+	entry, ok := discoveryCache.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(discoveryCache.entries, key)
+		return nil
+	}
+	return append([]string(nil), entry.queryAPIs...)
+}
+
+func cacheQueryAPIs(key string, queryAPIs []string) {
+	discoveryCache.Lock()
+	defer discoveryCache.Unlock()
+	discoveryCache.entries[key] = discoveryEntry{queryAPIs: append([]string(nil), queryAPIs...),
+		expires: time.Now().Add(ServerlessDiscoveryTTL)}
+}
+
+// Transports shared by the serverless connections with the same TLS and
+// proxy settings.
+var serverlessTransports = struct {
+	sync.Mutex
+	transports map[string]*http.Transport
+}{transports: make(map[string]*http.Transport)}
+
+// The client of a serverless connection, on the transport shared with the
+// serverless connections with the same settings.
+func (opts *Options) serverlessClient(https bool) (*http.Client, error) {
+	key := fmt.Sprintf("%t|%t|%s|%s|%s|%s|%s", https, opts.SkipVerify, opts.CAFile, opts.CertFile,
+		opts.KeyFile, opts.PrivateKeyPassphrase, opts.Proxy)
+	serverlessTransports.Lock()
+	defer serverlessTransports.Unlock()
+	if transport, ok := serverlessTransports.transports[key]; ok {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	proxy, err := proxyFunc(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: serverlessDialTimeout, KeepAlive: serverlessKeepAlive}
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: serverlessMaxIdleConnsPerHost,
+		IdleConnTimeout:     serverlessIdleConnTimeout,
+	}
+	if https {
+		cfg, err := opts.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = cfg
+	}
+	serverlessTransports.transports[key] = transport
+	return &http.Client{Transport: transport}, nil
+}
+
+// Wait until one of the query nodes of the handle answers a ping, pinging
+// them all at once and again, after a short and growing wait, until ctx is
+// done. Unauthorized pings fail at once.
+func (db *n1qlDB) WaitUntilReady(ctx context.Context) error {
+	if db.conn == nil {
+		return errorNoConnection
+	}
+	wait := 25 * time.Millisecond
+	for {
+		err := db.conn.pingAny(ctx)
+		if err == nil || errors.Is(err, ErrUnauthorized) {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("N1QL: Query nodes not ready: %w", err)
+		}
+		if wait *= 2; wait > time.Second {
+			wait = time.Second
+		}
+	}
+}
+
+// Ping the query nodes at once. Returns as soon as one answers, with the
+// error of one of them if none does.
+func (conn *n1qlConn) pingAny(ctx context.Context) error {
+	conn.lock.RLock()
+	queryAPIs := append([]string(nil), conn.queryAPIs...)
+	conn.lock.RUnlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan error, len(queryAPIs))
+	for _, queryAPI := range queryAPIs {
+		go func(queryAPI string) {
+			results <- conn.ping(ctx, queryAPI)
+		}(queryAPI)
+	}
+	var err error
+	for range queryAPIs {
+		if err = <-results; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Run the ping statement on a query node.
+func (conn *n1qlConn) ping(ctx context.Context, queryAPI string) error {
+	txParams := map[string]string{"txid": "", "tximplicit": ""}
+	request, err := conn.prepareRequest(conn.pingStatement(), queryAPI, nil, txParams)
+	if err != nil {
+		return err
+	}
+	resp, err := conn.httpClient().Do(request.WithContext(ctx))
+	if err != nil {
+		return newBootstrapError(bootstrapErrorKind(err), queryAPI, err,
+			fmt.Sprintf("N1QL: Unable to connect to endpoint %s: %v", stripurl(queryAPI), stripurl(err.Error())))
+	}
+	defer drainAndClose(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return newBootstrapError(ErrUnauthorized, queryAPI, nil,
+			fmt.Sprintf("N1QL: Unauthorized access to N1QL endpoint %s: check the credentials", stripurl(queryAPI)))
+	}
+	return newBootstrapError(ErrUnreachable, queryAPI, nil,
+		fmt.Sprintf("N1QL: Unable to connect to N1QL endpoint %s: %v", stripurl(queryAPI), resp.Status))
+}
@@ -0,0 +1,203 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+// Sends the statements of a handle to a second cluster as well, in the
+// background and on a best effort basis, and reports how the two compare,
+// e.g. while moving an application from one cluster to another.
+//
+//	target, err := n1ql.OpenWithOptions("couchbases://new.example.com", opts)
+//	...
+//	db.(n1ql.N1qlDB).SetShadow(&n1ql.Shadow{DB: target, Hook: func(r n1ql.ShadowReport) {
+//		if r.Mismatch() {
+//			log.Printf("%s: %d rows in %v, %d rows in %v on the shadow", r.Statement,
+//				r.Rows, r.Latency, r.ShadowRows, r.ShadowLatency)
+//		}
+//	}})
+type Shadow struct {
+	// Handle on the second cluster.
+	DB godbc.DB
+
+	// Called with the comparison of each statement sent to both, once both
+	// are done: by the goroutine running the shadow statement, or by the
+	// caller closing the rows of the primary, whichever is last.
+	Hook ShadowHook
+
+	// Also send the statements run with Exec, writing to both clusters.
+	// Otherwise only the queries are sent.
+	Writes bool
+
+	// Most shadow statements running at once; statements beyond are not
+	// shadowed. 16 if zero.
+	MaxPending int
+}
+
+// Receives the comparison of a statement run on both clusters.
+type ShadowHook func(report ShadowReport)
+
+// A statement run with Query or Exec, as it went on the handle, the
+// primary, and on the shadow.
+type ShadowReport struct {
+	Statement string
+
+	// Rows returned, or affected for Exec. The rows of the primary are the
+	// ones its caller read before closing them, all of them if Complete.
+	Rows       int64
+	ShadowRows int64
+	Complete   bool
+
+	// Until the response started
+	Latency       time.Duration
+	ShadowLatency time.Duration
+
+	Err       error
+	ShadowErr error
+}
+
+// Whether one failed and not the other, or they returned different row
+// counts.
+func (r ShadowReport) Mismatch() bool {
+	if (r.Err == nil) != (r.ShadowErr == nil) {
+		return true
+	}
+	return r.Err == nil && r.Complete && r.Rows != r.ShadowRows
+}
+
+// A shadow in use by a connection.
+type shadowRunner struct {
+	Shadow
+	pending chan struct{}
+}
+
+// A statement sent to both, reported once both are done.
+type shadowRequest struct {
+	lock    sync.Mutex
+	report  ShadowReport
+	pending int
+	hook    ShadowHook
+}
+
+func (req *shadowRequest) done(update func(r *ShadowReport)) {
+	req.lock.Lock()
+	update(&req.report)
+	req.pending--
+	last := req.pending == 0
+	req.lock.Unlock()
+	if last && req.hook != nil {
+		req.hook(req.report)
+	}
+}
+
+// Send the statements of the connection to shadow too. Nil stops.
+func (conn *n1qlConn) setShadow(shadow *Shadow) {
+	var runner *shadowRunner
+	if shadow != nil && shadow.DB != nil {
+		max := shadow.MaxPending
+		if max <= 0 {
+			max = 16
+		}
+		runner = &shadowRunner{Shadow: *shadow, pending: make(chan struct{}, max)}
+	}
+	conn.lock.Lock()
+	conn.shadow = runner
+	conn.lock.Unlock()
+}
+
+// The shadow of the connection, nil if it has none.
+func (conn *n1qlConn) shadowRunner() *shadowRunner {
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	return conn.shadow
+}
+
+// Start running the statement on the shadow, unless too many are running
+// already. Returns the request to report the primary to, nil if the
+// statement is not shadowed.
+func (sh *shadowRunner) start(statement string, args []interface{}, exec bool) *shadowRequest {
+	if exec && !sh.Writes {
+		return nil
+	}
+	select {
+	case sh.pending <- struct{}{}:
+	default:
+		return nil
+	}
+	req := &shadowRequest{report: ShadowReport{Statement: statement}, pending: 2, hook: sh.Hook}
+
+	go func() {
+		defer func() { <-sh.pending }()
+		var n int64
+		start := time.Now()
+		var latency time.Duration
+		var err error
+		if exec {
+			var res godbc.Result
+			res, err = sh.DB.ExecContext(context.Background(), statement, args...)
+			latency = time.Since(start)
+			if err == nil {
+				n, _ = res.RowsAffected()
+			}
+		} else {
+			var rows godbc.Rows
+			rows, err = sh.DB.QueryContext(context.Background(), statement, args...)
+			latency = time.Since(start)
+			if err == nil {
+				for rows.Next() {
+					n++
+				}
+				err = rows.Err()
+				if cerr := rows.Close(); err == nil {
+					err = cerr
+				}
+			}
+		}
+		req.done(func(r *ShadowReport) {
+			r.ShadowRows, r.ShadowLatency, r.ShadowErr = n, latency, err
+		})
+	}()
+	return req
+}
+
+// Report the outcome of the query on the primary, once its rows are closed.
+func (req *shadowRequest) query(start time.Time, rows godbc.Rows, err error) {
+	latency := time.Since(start)
+	nr, ok := rows.(*n1qlRows)
+	if err != nil || !ok {
+		req.done(func(r *ShadowReport) {
+			r.Latency, r.Err = latency, err
+		})
+		return
+	}
+	nr.onClose = func(read int, complete bool, err error) {
+		req.done(func(r *ShadowReport) {
+			r.Rows, r.Complete, r.Latency, r.Err = int64(read), complete, latency, err
+		})
+	}
+}
+
+// Report the outcome of the statement run with Exec on the primary.
+func (req *shadowRequest) exec(start time.Time, res godbc.Result, err error) {
+	latency := time.Since(start)
+	var n int64
+	if err == nil {
+		n, _ = res.RowsAffected()
+	}
+	req.done(func(r *ShadowReport) {
+		r.Rows, r.Complete, r.Latency, r.Err = n, err == nil, latency, err
+	})
+}
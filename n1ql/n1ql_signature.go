@@ -0,0 +1,90 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+type SignatureKind int
+
+const (
+	SignatureScalar SignatureKind = iota // a single type, e.g. "json" for SELECT RAW
+	SignatureObject                      // named fields, each with its own signature
+	SignatureArray                       // elements sharing one signature
+)
+
+// The shape of the results of a statement, as reported by the server.
+type Signature struct {
+	Kind   SignatureKind
+	Type   string                // type of a scalar, e.g. "number", "string" or "json"
+	Fields map[string]*Signature // fields of an object
+	Elem   *Signature            // elements of an array, nil if unknown
+}
+
+// Decode a signature as returned by the server. A null signature, as
+// returned by some DML statements, decodes to nil.
+func ParseSignature(raw []byte) (*Signature, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var sign interface{}
+	if err := json.Unmarshal(raw, &sign); err != nil {
+		return nil, fmt.Errorf("N1QL: Failed to parse signature: %w", err)
+	}
+	return newSignature(sign), nil
+}
+
+func newSignature(sign interface{}) *Signature {
+	switch s := sign.(type) {
+	case nil:
+		return nil
+	case string:
+		return &Signature{Kind: SignatureScalar, Type: s}
+	case map[string]interface{}:
+		sig := &Signature{Kind: SignatureObject, Fields: make(map[string]*Signature, len(s))}
+		for name, field := range s {
+			sig.Fields[name] = newSignature(field)
+		}
+		return sig
+	case []interface{}:
+		sig := &Signature{Kind: SignatureArray}
+		if len(s) > 0 {
+			sig.Elem = newSignature(s[0])
+		}
+		return sig
+	default:
+		return &Signature{Kind: SignatureScalar, Type: fmt.Sprintf("%v", s)}
+	}
+}
+
+// Names of the fields of an object signature, sorted as the columns of the rows.
+func (sig *Signature) Columns() []string {
+	if sig == nil || sig.Kind != SignatureObject {
+		return nil
+	}
+	columns := make([]string, 0, len(sig.Fields))
+	for name := range sig.Fields {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// True for SELECT * like signatures, whose fields are not known in advance.
+func (sig *Signature) IsWildcard() bool {
+	if sig == nil || sig.Kind != SignatureObject {
+		return false
+	}
+	f, ok := sig.Fields["*"]
+	return ok && f != nil && f.Kind == SignatureScalar && f.Type == "*"
+}
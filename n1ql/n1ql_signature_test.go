@@ -0,0 +1,63 @@
+package n1ql
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseSignature(t *testing.T) {
+	sig, err := ParseSignature([]byte(`{"name":"string","abv":"number","geo":{"lat":"number"},"tags":["string"]}`))
+	if err != nil {
+		t.Fatal("ParseSignature failed.", err.Error())
+	}
+	if sig.Kind != SignatureObject || !reflect.DeepEqual(sig.Columns(), []string{"abv", "geo", "name", "tags"}) {
+		t.Errorf("Unexpected signature %+v", sig)
+	}
+	if f := sig.Fields["geo"]; f.Kind != SignatureObject || f.Fields["lat"].Type != "number" {
+		t.Errorf("Unexpected nested object %+v", f)
+	}
+	if f := sig.Fields["tags"]; f.Kind != SignatureArray || f.Elem.Type != "string" {
+		t.Errorf("Unexpected array %+v", f)
+	}
+
+	sig, _ = ParseSignature([]byte(`"json"`))
+	if sig.Kind != SignatureScalar || sig.Type != "json" || sig.IsWildcard() {
+		t.Errorf("Unexpected scalar %+v", sig)
+	}
+	sig, _ = ParseSignature([]byte(`{"*":"*"}`))
+	if !sig.IsWildcard() {
+		t.Errorf("Expected a wildcard signature, got %+v", sig)
+	}
+	sig, err = ParseSignature([]byte(`null`))
+	if sig != nil || err != nil {
+		t.Errorf("Expected no signature, got %+v %v", sig, err)
+	}
+}
+
+func TestRowsSignature(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"signature":["number"],"results":[[1,2]],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT RAW [1, 2]")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	defer rows.Close()
+
+	select {
+	case <-rows.(N1qlRows).ColumnsReady():
+	default:
+		t.Error("Expected the columns to be ready")
+	}
+
+	sig := rows.(N1qlRows).Signature()
+	if sig == nil || sig.Kind != SignatureArray || sig.Elem.Type != "number" {
+		t.Errorf("Unexpected signature %+v", sig)
+	}
+	if cols, _ := rows.Columns(); len(cols) != 1 || cols[0] != "*" {
+		t.Errorf("Unexpected columns %v", cols)
+	}
+}
@@ -0,0 +1,166 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Requests whose arguments take at least this many bytes have their body
+// written to a temporary file in spoolDir instead of being built in memory.
+// Zero disables spooling.
+var spoolThreshold = 0
+var spoolDir = ""
+
+// Bytes of a value escaped at once when spooling a form.
+const spoolChunk = 32 * 1024
+
+// Write the body of requests whose positional and named arguments take at
+// least threshold bytes to a temporary file in dir, the default directory
+// for temporary files if empty, and stream it from there. This keeps the
+// memory a request takes bounded when it carries arrays of megabytes, at the
+// cost of disk I/O. Pass 0 to disable.
+func SetRequestSpooling(threshold int, dir string) {
+	spoolThreshold = threshold
+	spoolDir = dir
+}
+
+// The number of bytes the arguments of the request take.
+func argsSize(v url.Values) int {
+	n := 0
+	for key, values := range v {
+		if key != "args" && !strings.HasPrefix(key, "$") {
+			continue
+		}
+		for _, value := range values {
+			n += len(value)
+		}
+	}
+	return n
+}
+
+// A request body read from a temporary file, which is removed when the
+// body is closed.
+type spoolBody struct {
+	*os.File
+}
+
+func (body *spoolBody) Close() error {
+	err := body.File.Close()
+	os.Remove(body.Name())
+	return err
+}
+
+// Counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Write the form encoding of v, as v.Encode returns it, to w. Values are
+// escaped a chunk at a time, never as a whole.
+func writeForm(w io.Writer, v url.Values) error {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sep := ""
+	for _, key := range keys {
+		prefix := url.QueryEscape(key) + "="
+		for _, value := range v[key] {
+			if _, err := io.WriteString(w, sep+prefix); err != nil {
+				return err
+			}
+			sep = "&"
+			for len(value) > 0 {
+				chunk := value
+				if len(chunk) > spoolChunk {
+					chunk = chunk[:spoolChunk]
+				}
+				value = value[len(chunk):]
+				if _, err := io.WriteString(w, url.QueryEscape(chunk)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Spool the form encoding of v, gzip compressed if compress, to a temporary
+// file. Returns the file rewound, the size of the body and the size of the
+// form before compression.
+func spoolForm(v url.Values, compress bool) (*spoolBody, int64, int64, error) {
+	f, err := ioutil.TempFile(spoolDir, "n1ql-request-")
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("Error spooling HTTP request: %w", err)
+	}
+	body := &spoolBody{f}
+
+	bw := bufio.NewWriter(f)
+	var zw *gzip.Writer
+	form := &countingWriter{w: bw}
+	if compress {
+		zw = gzip.NewWriter(bw)
+		form.w = zw
+	}
+	err = writeForm(form, v)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return nil, 0, 0, fmt.Errorf("Error spooling HTTP request: %w", err)
+	}
+	return body, size, form.n, nil
+}
+
+// build a POST request for the form values, streamed from a temporary file
+func newSpooledRequest(queryAPI string, v url.Values, compress bool, creds *credentials) (*http.Request, int64, error) {
+	compress = compress && argsSize(v) >= compressionThreshold
+	body, size, formSize, err := spoolForm(v, compress)
+	if err != nil {
+		return nil, 0, err
+	}
+	request, err := newFormRequest(queryAPI, body, compress, creds)
+	if err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+	request.ContentLength = size
+	return request, formSize, nil
+}
@@ -0,0 +1,247 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync/atomic"
+
+	"github.com/couchbase/godbc"
+)
+
+type N1qlDBStats interface {
+	godbc.DBStats
+
+	// Number of requests aborted because their Rows were closed before all
+	// the results were read, and the bytes of results they discarded. Only
+	// the bytes already received count, the rest is never sent.
+	EarlyClosedRequests() int64
+	BytesDiscarded() int64
+
+	// Number of open Rows still holding results that were not read, and the
+	// approximate bytes of those results: all of them in passthrough mode,
+	// what was received ahead of decoding otherwise.
+	BufferedResultSets() int64
+	BytesBuffered() int64
+
+	// Bytes of request bodies sent, as sent and before compression, bytes of
+	// response bodies received, after the transport decompressed them if it
+	// negotiated compression, and number of result rows decoded.
+	BytesSent() int64
+	BytesSentUncompressed() int64
+	BytesReceived() int64
+	RowsDecoded() int64
+
+	// Number of requests sent on a new connection and on one reused from
+	// the idle pool, and number of TLS handshakes, full or resumed from a
+	// previous session.
+	NewConnections() int64
+	ReusedConnections() int64
+	TLSHandshakes() int64
+	TLSResumedHandshakes() int64
+
+	// Number of requests failed by a query node that did not know their
+	// prepared statement, of prepared statements run again from their full
+	// plan or prepared again for that reason, and of requests sent to
+	// another node than the one selected because it lately did not know
+	// their prepared statement, see PlanMissTTL.
+	PlanMisses() int64
+	Reprepares() int64
+	PlanMissesAvoided() int64
+}
+
+// Bytes of results held by the open Rows of all the connections, and the
+// most they may hold together. Updated atomically.
+var rowsBuffered, rowsMemoryLimit int64
+
+// Limit the bytes of results that the open Rows of all connections may hold
+// together, so that result sets that are never closed cannot exhaust the
+// memory of the process. Queries whose results would go over the limit fail
+// with ErrRowsMemoryLimit. Zero, the default, means no limit.
+func SetRowsMemoryLimit(limit int64) {
+	atomic.StoreInt64(&rowsMemoryLimit, limit)
+}
+
+// Counters maintained by a connection. Updated atomically.
+type connStats struct {
+	earlyClosed      int64
+	bytesDiscarded   int64
+	resultSets       int64
+	bytesBuffered    int64
+	bytesSent        int64
+	bytesSentUncompr int64
+	bytesReceived    int64
+	rowsDecoded      int64
+	newConns         int64
+	reusedConns      int64
+	tlsHandshakes    int64
+	tlsResumed       int64
+	openConns        int64
+	planMisses       int64
+	reprepares       int64
+	missesAvoided    int64
+}
+
+// Implements N1qlDBStats, as a snapshot of the connection counters.
+type n1qlDBStats struct {
+	earlyClosed      int64
+	bytesDiscarded   int64
+	resultSets       int64
+	bytesBuffered    int64
+	bytesSent        int64
+	bytesSentUncompr int64
+	bytesReceived    int64
+	rowsDecoded      int64
+	newConns         int64
+	reusedConns      int64
+	tlsHandshakes    int64
+	tlsResumed       int64
+	openConns        int64
+	planMisses       int64
+	reprepares       int64
+	missesAvoided    int64
+}
+
+func (stats *connStats) snapshot() *n1qlDBStats {
+	return &n1qlDBStats{
+		earlyClosed:      atomic.LoadInt64(&stats.earlyClosed),
+		bytesDiscarded:   atomic.LoadInt64(&stats.bytesDiscarded),
+		resultSets:       atomic.LoadInt64(&stats.resultSets),
+		bytesBuffered:    atomic.LoadInt64(&stats.bytesBuffered),
+		bytesSent:        atomic.LoadInt64(&stats.bytesSent),
+		bytesSentUncompr: atomic.LoadInt64(&stats.bytesSentUncompr),
+		bytesReceived:    atomic.LoadInt64(&stats.bytesReceived),
+		rowsDecoded:      atomic.LoadInt64(&stats.rowsDecoded),
+		newConns:         atomic.LoadInt64(&stats.newConns),
+		reusedConns:      atomic.LoadInt64(&stats.reusedConns),
+		tlsHandshakes:    atomic.LoadInt64(&stats.tlsHandshakes),
+		tlsResumed:       atomic.LoadInt64(&stats.tlsResumed),
+		openConns:        atomic.LoadInt64(&stats.openConns),
+		planMisses:       atomic.LoadInt64(&stats.planMisses),
+		reprepares:       atomic.LoadInt64(&stats.reprepares),
+		missesAvoided:    atomic.LoadInt64(&stats.missesAvoided),
+	}
+}
+
+// Account for a request body of uncompressed bytes, sent as sent bytes
+func (stats *connStats) addSent(sent, uncompressed int64) {
+	atomic.AddInt64(&stats.bytesSent, sent)
+	atomic.AddInt64(&stats.bytesSentUncompr, uncompressed)
+}
+
+// Count the connections the request gets and the TLS handshakes it makes.
+func (stats *connStats) traceConnections(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&stats.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&stats.newConns, 1)
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&stats.tlsHandshakes, 1)
+			if state.DidResume {
+				atomic.AddInt64(&stats.tlsResumed, 1)
+			}
+		},
+	})
+}
+
+// Account for n bytes of results held by a new Rows, unless they would take
+// the open Rows over the memory limit.
+func (stats *connStats) reserveRows(n int64) error {
+	total := atomic.AddInt64(&rowsBuffered, n)
+	if limit := atomic.LoadInt64(&rowsMemoryLimit); limit > 0 && total > limit {
+		atomic.AddInt64(&rowsBuffered, -n)
+		return ErrRowsMemoryLimit
+	}
+	atomic.AddInt64(&stats.resultSets, 1)
+	atomic.AddInt64(&stats.bytesBuffered, n)
+	return nil
+}
+
+// Release the bytes reserved by a Rows that no longer holds its results
+func (stats *connStats) releaseRows(n int64) {
+	atomic.AddInt64(&rowsBuffered, -n)
+	atomic.AddInt64(&stats.resultSets, -1)
+	atomic.AddInt64(&stats.bytesBuffered, -n)
+}
+
+// Sockets open to the query nodes, once SetMaxOpenConns or SetMaxIdleConns
+// gave the connection a pool of its own. Zero before that.
+func (stats *n1qlDBStats) OpenConnections() int {
+	return int(stats.openConns)
+}
+
+func (stats *n1qlDBStats) EarlyClosedRequests() int64 {
+	return stats.earlyClosed
+}
+
+func (stats *n1qlDBStats) BytesDiscarded() int64 {
+	return stats.bytesDiscarded
+}
+
+func (stats *n1qlDBStats) BufferedResultSets() int64 {
+	return stats.resultSets
+}
+
+func (stats *n1qlDBStats) BytesBuffered() int64 {
+	return stats.bytesBuffered
+}
+
+func (stats *n1qlDBStats) BytesSent() int64 {
+	return stats.bytesSent
+}
+
+func (stats *n1qlDBStats) BytesSentUncompressed() int64 {
+	return stats.bytesSentUncompr
+}
+
+func (stats *n1qlDBStats) BytesReceived() int64 {
+	return stats.bytesReceived
+}
+
+func (stats *n1qlDBStats) RowsDecoded() int64 {
+	return stats.rowsDecoded
+}
+
+func (stats *n1qlDBStats) NewConnections() int64 {
+	return stats.newConns
+}
+
+func (stats *n1qlDBStats) ReusedConnections() int64 {
+	return stats.reusedConns
+}
+
+func (stats *n1qlDBStats) TLSHandshakes() int64 {
+	return stats.tlsHandshakes
+}
+
+func (stats *n1qlDBStats) TLSResumedHandshakes() int64 {
+	return stats.tlsResumed
+}
+
+func (stats *n1qlDBStats) PlanMisses() int64 {
+	return stats.planMisses
+}
+
+func (stats *n1qlDBStats) Reprepares() int64 {
+	return stats.reprepares
+}
+
+func (stats *n1qlDBStats) PlanMissesAvoided() int64 {
+	return stats.missesAvoided
+}
@@ -10,9 +10,17 @@
 package n1ql
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/couchbase/godbc"
 )
@@ -21,6 +29,14 @@ type N1qlStmt interface {
 	godbc.Stmt
 	QueryRaw(args ...interface{}) (io.ReadCloser, error)
 	ExecRaw(args ...interface{}) (io.ReadCloser, error)
+
+	// Signature of the results of the statement, nil if unknown.
+	Signature() *Signature
+
+	// Remove the prepared plan from the cache of the query nodes, then
+	// close the statement. Services preparing many statements use it to
+	// keep the server's plan cache from growing without bounds.
+	Deallocate() error
 }
 
 // Implements N1qlStmt interface.
@@ -29,58 +45,184 @@ type n1qlStmt struct {
 	prepared  string
 	signature string
 	argCount  int
+	maxArgs   int      // highest positional parameter, ? or $n
+	keyspaces []string // named by the statement, for the scan consistency rules
 	name      string
+	defaults  []QueryOption
+
+	// name given by the server, kept once name is cleared to send the full plan
+	planName string
+
+	// encoded_plan returned by the server, sent along with the name so that
+	// the nodes that do not know the name run the plan
+	encodedPlan string
+
+	// called when the server no longer knows the statement by its name
+	onStale func()
+
+	// the text of the statement, for the errors of dev mode
+	statement string
 }
 
 func (stmt *n1qlStmt) Close() error {
 	stmt.prepared = ""
 	stmt.signature = ""
 	stmt.argCount = 0
+	stmt.maxArgs = 0
 	stmt = nil
 	return nil
 }
 
+func (stmt *n1qlStmt) Deallocate() error {
+	if stmt.prepared == "" {
+		return fmt.Errorf("N1QL: Prepared statement not found")
+	}
+	if stmt.planName != "" {
+		postData, err := buildPostData("DELETE FROM system:prepareds WHERE name = $1", []interface{}{stmt.planName}, JSONArgs,
+			stmt.conn.queryParams(), nil)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.conn.performExec(context.Background(), "", &postData, nil); err != nil {
+			return err
+		}
+	}
+	return stmt.Close()
+}
+
+func (stmt *n1qlStmt) stale() {
+	atomic.AddInt64(&stmt.conn.stats.reprepares, 1)
+	if stmt.onStale != nil {
+		stmt.onStale()
+	}
+}
+
+func (stmt *n1qlStmt) Signature() *Signature {
+	sig, _ := ParseSignature([]byte(stmt.signature))
+	return sig
+}
+
 func (stmt *n1qlStmt) NumInput() int {
 	return stmt.argCount
 }
 
-func buildPositionalArgList(args []interface{}) string {
-	positionalArgs := make([]string, 0)
-	for _, arg := range args {
-		switch arg := arg.(type) {
-		case string:
-			// add double quotes since this is a string
-			positionalArgs = append(positionalArgs, fmt.Sprintf("\"%v\"", arg))
-		case []byte:
-			positionalArgs = append(positionalArgs, string(arg))
-		default:
-			positionalArgs = append(positionalArgs, fmt.Sprintf("%v", arg))
-		}
+// Buffers used to encode argument lists, so that binding many parameters
+// does not allocate a new string for every argument.
+var argBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// The JSON array of the arguments. Strings are sent as JSON strings and
+// []byte as the JSON they hold; maps, slices, arrays and structs, and the
+// values implementing json.Marshaler, are marshaled to JSON.
+func buildPositionalArgList(args []interface{}) (string, error) {
+	if len(args) == 0 {
+		return "", nil
 	}
 
-	if len(positionalArgs) > 0 {
-		paStr := "["
-		for i, param := range positionalArgs {
-			if i == len(positionalArgs)-1 {
-				paStr = fmt.Sprintf("%s%s]", paStr, param)
-			} else {
-				paStr = fmt.Sprintf("%s%s,", paStr, param)
-			}
+	buf := argBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer argBufPool.Put(buf)
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+
+	buf.WriteByte('[')
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeArg(buf, enc, arg); err != nil {
+			return "", fmt.Errorf("N1QL: Cannot encode argument %d: %w", i+1, err)
 		}
-		return paStr
 	}
-	return ""
+	buf.WriteByte(']')
+	return buf.String(), nil
+}
+
+// The JSON of a single argument, as sent in an argument list.
+func encodeArg(arg interface{}) (string, error) {
+	buf := argBufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer argBufPool.Put(buf)
+
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := writeArg(buf, enc, arg); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Write arg to buf, enc encoding to buf.
+func writeArg(buf *bytes.Buffer, enc *json.Encoder, arg interface{}) error {
+	if isNilArg(arg) {
+		buf.WriteString("null")
+		return nil
+	}
+	switch arg := arg.(type) {
+	case string:
+		// strings are quoted and escaped. Encode terminates each value
+		// with a newline, which is dropped.
+		enc.Encode(arg)
+		buf.Truncate(buf.Len() - 1)
+	case []byte:
+		buf.Write(arg)
+	case time.Time:
+		buf.WriteString(timeArg(arg))
+	case *time.Time:
+		buf.WriteString(timeArg(*arg))
+	default:
+		// named types of strings are quoted too, and the values JSON
+		// cannot hold, such as NaN, fail
+		return encodeJSON(buf, enc, arg)
+	}
+	return nil
+}
+
+// The JSON of a time argument: an RFC 3339 string, or the milliseconds
+// since the epoch if SetTimeArgsAsEpochMillis was set.
+func timeArg(t time.Time) string {
+	if timeArgsAsEpochMillis {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return `"` + t.Format(time.RFC3339Nano) + `"`
+}
+
+func encodeJSON(buf *bytes.Buffer, enc *json.Encoder, arg interface{}) error {
+	if err := enc.Encode(arg); err != nil {
+		return err
+	}
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+// Whether arg is nil, a nil pointer or nil JSON, passed for a null.
+func isNilArg(arg interface{}) bool {
+	switch arg := arg.(type) {
+	case nil:
+		return true
+	case []byte:
+		return arg == nil
+	}
+	v := reflect.ValueOf(arg)
+	return v.Kind() == reflect.Ptr && v.IsNil()
 }
 
 // prepare a http request for the query
 //
-func (stmt *n1qlStmt) prepareRequest(args []interface{}) (*url.Values, error) {
+func (stmt *n1qlStmt) prepareRequest(args []interface{}, opts *queryOptions) (*url.Values, error) {
 
 	postData := url.Values{}
 
 	// use name prepared statement if possible
 	if stmt.name != "" {
 		postData.Set("prepared", fmt.Sprintf("\"%s\"", stmt.name))
+		if stmt.encodedPlan != "" && !noEncodedPlans {
+			postData.Set("encoded_plan", stmt.encodedPlan)
+		}
 	} else {
 		postData.Set("prepared", stmt.prepared)
 	}
@@ -88,52 +230,68 @@ func (stmt *n1qlStmt) prepareRequest(args []interface{}) (*url.Values, error) {
 	if len(args) < stmt.NumInput() {
 		return nil, fmt.Errorf("N1QL: Insufficient args. Prepared statement contains positional args")
 	}
+	if argMode == ArgsStrict && len(args) > stmt.maxArgs {
+		return nil, fmt.Errorf("N1QL: Too many args. Prepared statement takes %d, got %d", stmt.maxArgs, len(args))
+	}
 
 	if len(args) > 0 {
-		paStr := buildPositionalArgList(args)
+		paStr, err := stmt.conn.encodeArgs(args)
+		if err != nil {
+			return nil, err
+		}
 		if len(paStr) > 0 {
 			postData.Set("args", paStr)
 		}
 	}
 
-	setQueryParams(&postData, nil)
+	setQueryParams(&postData, stmt.conn.queryParams(), nil)
+	opts.setQueryParams(&postData)
+	applyKeyspaceConsistency(&postData, stmt.keyspaces)
 
 	return &postData, nil
 }
 
 func (stmt *n1qlStmt) Query(args ...interface{}) (godbc.Rows, error) {
+	return stmt.QueryContext(context.Background(), args...)
+}
+
+// Same as Query, aborting the request when ctx is done.
+func (stmt *n1qlStmt) QueryContext(ctx context.Context, args ...interface{}) (godbc.Rows, error) {
 	if stmt.prepared == "" {
 		return nil, fmt.Errorf("N1QL: Prepared statement not found")
 	}
+	opts, args := splitQueryOptions(withDefaultOptions(stmt.defaults, args))
 
 retry:
-	requestValues, err := stmt.prepareRequest(args)
+	requestValues, err := stmt.prepareRequest(args, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := stmt.conn.performQuery("", requestValues)
-	if err != nil && stmt.name != "" {
-		// retry once if we used a named prepared statement
+	rows, err := stmt.conn.performQuery(ctx, "", requestValues, opts)
+	if err != nil && stmt.name != "" && RetryClassOf(err) == RetryReprepare {
+		// the node does not know the named prepared statement: retry once with the full plan
 		stmt.name = ""
+		stmt.stale()
 		goto retry
 	}
 
-	return rows, err
+	return rows, stmt.conn.verbose(withKeyspaces(err, stmt.keyspaces), stmt.statement)
 }
 
 func (stmt *n1qlStmt) QueryRaw(args ...interface{}) (io.ReadCloser, error) {
 	if stmt.prepared == "" {
 		return nil, fmt.Errorf("N1QL: Prepared statement not found")
 	}
+	opts, args := splitQueryOptions(withDefaultOptions(stmt.defaults, args))
 
 retry:
-	requestValues, err := stmt.prepareRequest(args)
+	requestValues, err := stmt.prepareRequest(args, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	body, err := stmt.conn.performQueryRaw("", requestValues)
+	body, err := stmt.conn.performQueryRaw(context.Background(), "", requestValues, opts)
 	if err != nil && stmt.name != "" {
 		// retry once if we used a named prepared statement
 		stmt.name = ""
@@ -145,36 +303,46 @@ retry:
 
 func (stmt *n1qlStmt) QueryRow(args ...interface{}) godbc.Row {
 	rows, err := stmt.Query(args...)
-	if err != nil {
-		return nil
-	}
-	hasFirst := rows.Next()
-	if !hasFirst {
-		return nil
-	}
-	return rows // Row is a subset of Rows.
+	return firstRow(rows, err, stmt.conn.noRowsError)
 }
 
 func (stmt *n1qlStmt) Exec(args ...interface{}) (godbc.Result, error) {
+	return stmt.ExecContext(context.Background(), args...)
+}
+
+// Same as Exec, aborting the request when ctx is done.
+func (stmt *n1qlStmt) ExecContext(ctx context.Context, args ...interface{}) (godbc.Result, error) {
 	if stmt.prepared == "" {
 		return nil, fmt.Errorf("N1QL: Prepared statement not found")
 	}
-	requestValues, err := stmt.prepareRequest(args)
+	opts, args := splitQueryOptions(withDefaultOptions(stmt.defaults, args))
+
+retry:
+	requestValues, err := stmt.prepareRequest(args, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return stmt.conn.performExec("", requestValues)
+	res, err := stmt.conn.performExec(ctx, "", requestValues, opts)
+	if err != nil && stmt.name != "" && RetryClassOf(err) == RetryReprepare {
+		// the node does not know the named prepared statement: retry once with the full plan
+		stmt.name = ""
+		stmt.stale()
+		goto retry
+	}
+
+	return res, stmt.conn.verbose(withKeyspaces(err, stmt.keyspaces), stmt.statement)
 }
 
 func (stmt *n1qlStmt) ExecRaw(args ...interface{}) (io.ReadCloser, error) {
 	if stmt.prepared == "" {
 		return nil, fmt.Errorf("N1QL: Prepared statement not found")
 	}
-	requestValues, err := stmt.prepareRequest(args)
+	opts, args := splitQueryOptions(withDefaultOptions(stmt.defaults, args))
+	requestValues, err := stmt.prepareRequest(args, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	return stmt.conn.performExecRaw("", requestValues)
+	return stmt.conn.performExecRaw(context.Background(), "", requestValues, opts)
 }
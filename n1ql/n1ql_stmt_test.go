@@ -0,0 +1,285 @@
+package n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildPositionalArgList(t *testing.T) {
+	args := []interface{}{"San \"Francisco\" <CA>", 5, 4.5, true, []byte(`{"a":[1,2]}`)}
+	expected := `["San \"Francisco\" <CA>",5,4.5,true,{"a":[1,2]}]`
+	if s, err := buildPositionalArgList(args); err != nil || s != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, s, err)
+	}
+	if s, err := buildPositionalArgList(nil); err != nil || s != "" {
+		t.Errorf("Expected empty argument list, got %s, %v", s, err)
+	}
+
+	type city struct {
+		Name string `json:"name"`
+		Zip  []int  `json:"zip,omitempty"`
+	}
+	args = []interface{}{map[string]string{"a": "<b>"}, []float64{1, 2.5}, [2]bool{true}, city{Name: "Paris"},
+		&city{Zip: []int{75001}}, json.RawMessage(`{"c":null}`), time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	expected = `[{"a":"<b>"},[1,2.5],[true,false],{"name":"Paris"},{"name":"","zip":[75001]},{"c":null},"2024-01-02T03:04:05Z"]`
+	if s, err := buildPositionalArgList(args); err != nil || s != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, s, err)
+	}
+
+	d := time.Date(2024, 1, 2, 3, 4, 5, 6000000, time.FixedZone("CET", 3600))
+	args = []interface{}{d, &d}
+	expected = `["2024-01-02T03:04:05.006+01:00","2024-01-02T03:04:05.006+01:00"]`
+	if s, err := buildPositionalArgList(args); err != nil || s != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, s, err)
+	}
+	SetTimeArgsAsEpochMillis(true)
+	s, err := buildPositionalArgList(args)
+	SetTimeArgsAsEpochMillis(false)
+	if expected = `[1704161045006,1704161045006]`; err != nil || s != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, s, err)
+	}
+
+	var noZip *int
+	args = []interface{}{nil, noZip, "a", []byte(nil)}
+	expected = `[null,null,"a",null]`
+	if s, err := buildPositionalArgList(args); err != nil || s != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, s, err)
+	}
+
+	type status string
+	args = []interface{}{status(`a"b`), int8(-3), uint(7), float32(0.5)}
+	expected = `["a\"b",-3,7,0.5]`
+	if s, err := buildPositionalArgList(args); err != nil || s != expected {
+		t.Errorf("Expected %s, got %s, %v", expected, s, err)
+	}
+	if _, err := buildPositionalArgList([]interface{}{math.NaN()}); err == nil {
+		t.Error("Expected NaN to fail to encode")
+	}
+
+	if _, err := buildPositionalArgList([]interface{}{1, map[string]interface{}{"f": func() {}}}); err == nil ||
+		!strings.Contains(err.Error(), "argument 2") {
+		t.Errorf("Expected an encoding error, got %v", err)
+	}
+}
+
+func BenchmarkBuildPositionalArgList(b *testing.B) {
+	args := make([]interface{}, 5000)
+	for i := range args {
+		args[i] = fmt.Sprintf("key::%d", i)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if s, _ := buildPositionalArgList(args); !strings.HasPrefix(s, `["key::0"`) {
+			b.Fatal(s)
+		}
+	}
+}
+
+func TestDeallocate(t *testing.T) {
+	var statement, args string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		statement, args = r.PostForm.Get("statement"), r.PostForm.Get("args")
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+
+	stmt, err := conn.Prepare("SELECT 1")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+	if err := stmt.Deallocate(); err != nil {
+		t.Fatal("Deallocate failed.", err)
+	}
+	if statement != "DELETE FROM system:prepareds WHERE name = $1" || args != `["p1"]` {
+		t.Errorf("Unexpected deallocation %s %s", statement, args)
+	}
+	if _, err := stmt.Query(); err == nil {
+		t.Error("Expected the deallocated statement to be closed")
+	}
+}
+
+func TestStrictArgs(t *testing.T) {
+	var args string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		args = r.PostForm.Get("args")
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+
+	stmt, err := conn.Prepare("DELETE FROM default WHERE a = ? AND b = $3")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+
+	// extra arguments are sent along by default
+	if _, err := stmt.Exec(1, 2, 3, 4); err != nil || args != "[1,2,3,4]" {
+		t.Errorf("Expected the extra args to be sent, got %s, %v", args, err)
+	}
+
+	SetArgMode(ArgsStrict)
+	defer SetArgMode(ArgsVariadic)
+	if _, err := stmt.Exec(1, 2, 3); err != nil || args != "[1,2,3]" {
+		t.Errorf("Expected the args up to $3 to be accepted, got %s, %v", args, err)
+	}
+	if _, err := stmt.Exec(1, 2, 3, 4); err == nil || !strings.Contains(err.Error(), "Too many args") {
+		t.Errorf("Expected the extra arg to be rejected, got %v", err)
+	}
+}
+
+func TestPrepareAndQuery(t *testing.T) {
+	requests := make(chan url.Values, 10)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		requests <- r.PostForm
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1}],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	stmt, rows, err := db.PrepareAndQuery("SELECT a FROM b WHERE c = ?", 1)
+	if err != nil {
+		t.Fatal("PrepareAndQuery failed.", err)
+	}
+	if !rows.Next() {
+		t.Error("Expected a row")
+	}
+	rows.Close()
+	first := <-requests
+	name := strings.TrimSuffix(strings.TrimPrefix(first.Get("statement"), "PREPARE `"), "` FROM SELECT a FROM b WHERE c = $1")
+	if len(name) != 36 || first.Get("auto_execute") != "true" || first.Get("args") != "[1]" {
+		t.Errorf("Unexpected request %v", first)
+	}
+
+	rows, err = stmt.Query(2)
+	if err != nil {
+		t.Fatal("Query failed.", err)
+	}
+	rows.Close()
+	if next := <-requests; next.Get("prepared") != `"`+name+`"` || next.Get("args") != "[2]" {
+		t.Errorf("Expected the statement to run by name, got %v", next)
+	}
+
+	if _, res, err := db.PrepareAndExec("DELETE FROM b"); err != nil {
+		t.Fatal("PrepareAndExec failed.", err)
+	} else if n, _ := res.RowsAffected(); n != 1 {
+		t.Errorf("Expected 1 row affected, got %d", n)
+	}
+}
+
+func TestEncodedPlan(t *testing.T) {
+	plans := make(chan string, 10)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if strings.HasPrefix(r.PostForm.Get("statement"), "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1","encoded_plan":"H4sIAAAAAAAA"}],"status":"success"}`))
+			return
+		}
+		plans <- r.PostForm.Get("prepared") + " " + r.PostForm.Get("encoded_plan")
+		w.Write([]byte(`{"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+	})
+	defer srv.Close()
+
+	stmt, err := conn.Prepare("DELETE FROM default")
+	if err != nil {
+		t.Fatal("Prepare failed.", err)
+	}
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if p := <-plans; p != `"p1" H4sIAAAAAAAA` {
+		t.Errorf("Expected the encoded plan with the name, got %s", p)
+	}
+
+	SetEncodedPlans(false)
+	defer SetEncodedPlans(true)
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatal("Exec failed.", err)
+	}
+	if p := <-plans; p != `"p1" ` {
+		t.Errorf("Expected the name only, got %s", p)
+	}
+}
+
+func TestPreparedNamespace(t *testing.T) {
+	var statements []string
+	var deleted string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		statements = append(statements, statement)
+		if strings.HasPrefix(statement, "PREPARE `") {
+			name := strings.SplitN(statement, "`", 3)[1]
+			w.Write([]byte(`{"results":[{"name":"` + name + `"}],"status":"success"}`))
+			return
+		}
+		if strings.HasPrefix(statement, "PREPARE") {
+			w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			return
+		}
+		if strings.HasPrefix(statement, "DELETE FROM system:prepareds") {
+			deleted = r.PostForm.Get("args")
+		}
+		w.Write([]byte(`{"results":[],"status":"success"}`))
+	})
+	defer srv.Close()
+	conn.preparedPrefix = newPreparedPrefix(true)
+	other := newPreparedPrefix(true)
+	db := &n1qlDB{conn: conn}
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Prepare("SELECT * FROM default WHERE a = ?"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prefix := fmt.Sprintf("godbc-%d-", os.Getpid())
+	if !strings.HasPrefix(conn.preparedPrefix, prefix) || conn.preparedPrefix == other {
+		t.Fatalf("Expected a namespace of the process and the connection, got %q and %q", conn.preparedPrefix, other)
+	}
+	for i, want := range []string{"1", "2"} {
+		if statements[i] != "PREPARE `"+conn.preparedPrefix+want+"` FROM SELECT * FROM default WHERE a = $1" {
+			t.Errorf("Unexpected statement %q", statements[i])
+		}
+	}
+
+	// the one-shot statements of Exec are left to the server to name, the
+	// cached ones are not
+	statements = nil
+	for _, size := range []int{0, 0, 1, 1} {
+		conn.preparedCache = newStmtCache(size)
+		if _, err := db.Exec("DELETE FROM default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"PREPARE DELETE FROM default", "PREPARE DELETE FROM default",
+		"PREPARE `" + conn.preparedPrefix + "3` FROM DELETE FROM default",
+		"PREPARE `" + conn.preparedPrefix + "4` FROM DELETE FROM default"}
+	for i, want := range expected {
+		if 2*i >= len(statements) || statements[2*i] != want {
+			t.Fatalf("Expected the statements prepared %q, got %q", expected, statements)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != `["`+conn.preparedPrefix+`%"]` {
+		t.Errorf("Expected the statements of the namespace to be deleted, got %q", deleted)
+	}
+}
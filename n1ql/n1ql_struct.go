@@ -0,0 +1,129 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// StructScan copies the fields of the current row into the fields of the
+// struct dest points to. A struct field takes the result field named by its
+// n1ql tag, else by its json tag, else by its own name, matched regardless of
+// case. Fields tagged "-" and unexported fields are ignored, and the fields
+// of embedded structs are taken as fields of dest.
+//
+// Values are decoded into the fields as encoding/json would decode them.
+// Fields the row does not have are reset to their zero value, so that dest
+// can be reused from row to row; result fields without a struct field are
+// ignored.
+func (rows *n1qlRows) StructScan(dest interface{}) error {
+	if rows.curValues == nil {
+		return errors.New("No current row.")
+	}
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("N1QL: StructScan needs a pointer to a struct, got %T", dest)
+	}
+	row, ok := rows.curRow.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("N1QL: StructScan needs an object row, got %v", rows.curRow)
+	}
+
+	v = v.Elem()
+	for _, f := range structFields(v.Type()) {
+		field := v.FieldByIndex(f.index)
+		field.Set(reflect.Zero(field.Type()))
+		value, ok := row[f.name]
+		if !ok {
+			value, ok = foldedField(row, f.name)
+		}
+		if !ok || value == nil {
+			continue
+		}
+		bytes, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(bytes, field.Addr().Interface())
+		}
+		if err != nil {
+			return fmt.Errorf("N1QL: Cannot assign field %s of the row to %s: %w", f.name, v.Type().FieldByIndex(f.index).Name, err)
+		}
+	}
+	return nil
+}
+
+// The value of the field of row whose name matches name regardless of case.
+func foldedField(row map[string]interface{}, name string) (interface{}, bool) {
+	for key, value := range row {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// A struct field StructScan assigns, and the result field it takes.
+type structField struct {
+	name  string
+	index []int
+}
+
+// Fields of the struct types StructScan was used with.
+var structFieldsCache sync.Map
+
+func structFields(t reflect.Type) []structField {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	fields := appendStructFields(nil, t, nil)
+	structFieldsCache.Store(t, fields)
+	return fields
+}
+
+func appendStructFields(fields []structField, t reflect.Type, index []int) []structField {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := fieldName(f)
+		if name == "-" {
+			continue
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			fields = appendStructFields(fields, f.Type, fieldIndex)
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{name: name, index: fieldIndex})
+	}
+	return fields
+}
+
+// The name given by the n1ql or json tag of a field, "-" if it is to be
+// ignored, "" if it has none.
+func fieldName(f reflect.StructField) string {
+	tag, ok := f.Tag.Lookup("n1ql")
+	if !ok {
+		tag = f.Tag.Get("json")
+	}
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+	return tag
+}
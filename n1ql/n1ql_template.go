@@ -0,0 +1,99 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A dotted path of identifiers, such as bucket.scope.collection, each of
+// them escaped by Template.
+type Path []string
+
+// Build a statement from a template, for the statements whose keyspaces or
+// fields are only known at run time. In the template, %i stands for an
+// identifier, given as a string or a Path, which is escaped, and %v for a
+// value, which is bound as a positional parameter rather than written in
+// the statement; %% is a percent sign. Returns the statement and the
+// arguments to run it with.
+//
+//	stmt, args, err := n1ql.Template("SELECT %i FROM %i WHERE city = %v",
+//		field, n1ql.Path{bucket, "inventory", "hotels"}, city)
+//	...
+//	rows, err := db.Query(stmt, args...)
+func Template(template string, args ...interface{}) (string, []interface{}, error) {
+	var stmt strings.Builder
+	var values []interface{}
+	next := 0
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' {
+			stmt.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(template) {
+			return "", nil, fmt.Errorf("N1QL: Template ends with %%")
+		}
+		verb := template[i]
+		if verb == '%' {
+			stmt.WriteByte('%')
+			continue
+		}
+		if next == len(args) {
+			return "", nil, fmt.Errorf("N1QL: Missing argument for %%%c in template", verb)
+		}
+		arg := args[next]
+		next++
+
+		switch verb {
+		case 'i':
+			ident, err := templateIdentifier(arg)
+			if err != nil {
+				return "", nil, fmt.Errorf("N1QL: Argument %d of template: %w", next, err)
+			}
+			stmt.WriteString(ident)
+		case 'v':
+			stmt.WriteByte('?')
+			values = append(values, arg)
+		default:
+			return "", nil, fmt.Errorf("N1QL: Unknown verb %%%c in template", verb)
+		}
+	}
+	if next != len(args) {
+		return "", nil, fmt.Errorf("N1QL: Template takes %d arguments, got %d", next, len(args))
+	}
+	return stmt.String(), values, nil
+}
+
+// The escaped identifier or path of identifiers.
+func templateIdentifier(arg interface{}) (string, error) {
+	var names []string
+	switch arg := arg.(type) {
+	case string:
+		names = []string{arg}
+	case Path:
+		names = arg
+	default:
+		return "", fmt.Errorf("%%i needs a string or a Path, got %T", arg)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("Empty path")
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		if name == "" {
+			return "", fmt.Errorf("Empty identifier")
+		}
+		quoted[i] = quoteIdentifier(name)
+	}
+	return strings.Join(quoted, "."), nil
+}
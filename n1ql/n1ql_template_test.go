@@ -0,0 +1,38 @@
+package n1ql
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	stmt, args, err := Template("SELECT %i, 100%% FROM %i WHERE city = %v AND n > %v",
+		"na`me", Path{"app", "inventory", "hotels"}, "Paris'; DROP", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt != "SELECT `na``me`, 100% FROM `app`.`inventory`.`hotels` WHERE city = ? AND n > ?" {
+		t.Errorf("Unexpected statement %s", stmt)
+	}
+	if fmt.Sprint(args) != "[Paris'; DROP 3]" {
+		t.Errorf("Unexpected args %v", args)
+	}
+
+	for _, c := range []struct {
+		template string
+		args     []interface{}
+	}{
+		{"SELECT %v, %v", []interface{}{1}},
+		{"SELECT %v", []interface{}{1, 2}},
+		{"SELECT %d", []interface{}{1}},
+		{"SELECT 1 %", nil},
+		{"SELECT * FROM %i", []interface{}{1}},
+		{"SELECT * FROM %i", []interface{}{""}},
+		{"SELECT * FROM %i", []interface{}{Path{"app", ""}}},
+		{"SELECT * FROM %i", []interface{}{Path{}}},
+	} {
+		if _, _, err := Template(c.template, c.args...); err == nil {
+			t.Errorf("Expected %q with %v to fail", c.template, c.args)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Layouts of the date strings Scan accepts into a *time.Time, tried in
+// order. They cover the ISO-8601 forms the date functions of N1QL return.
+var DefaultTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+var timeLayouts = DefaultTimeLayouts
+
+// Replace the layouts of the date strings Scan accepts into a *time.Time.
+// Strings without a time zone are taken as UTC. Numbers are always taken
+// as milliseconds since the epoch. Passing no layout restores the defaults.
+func SetTimeLayouts(layouts ...string) {
+	if len(layouts) == 0 {
+		layouts = DefaultTimeLayouts
+	}
+	timeLayouts = layouts
+}
+
+// The time a JSON value stands for: a date string in one of the layouts,
+// or a number of milliseconds since the epoch.
+func parseTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("N1QL: Unrecognized date %q", v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return parseTime(f)
+		}
+	case float64:
+		if math.IsNaN(v) || math.Abs(v) > 1<<62 {
+			break
+		}
+		ms := math.Floor(v)
+		nsec := int64((v - ms) * 1e6)
+		return time.Unix(int64(ms)/1000, int64(ms)%1000*1e6+nsec).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("N1QL: Not a date: %v", value)
+}
@@ -0,0 +1,148 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http/httptrace"
+	"time"
+)
+
+// Timings of a request, measured by the client. Together with the
+// executionTime reported by the server they tell network and server
+// latency apart.
+type RequestTimings struct {
+	Node      string        // query API the request was sent to
+	QueueWait time.Duration // waiting for an idle or new connection, not counting Dial
+	Dial      time.Duration // DNS lookup, connect and TLS handshake, if a new connection was needed
+	TTFB      time.Duration // from the request being written to the first byte of the response
+	Stream    time.Duration // from the first byte of the response until it was closed
+	Decode    time.Duration // spent decoding the response
+	Total     time.Duration // from sending the request until the response was closed
+
+	// Trace and span the request was made in, as returned by the TraceHook,
+	// to attach to the latency observations as exemplars or labels.
+	TraceID string
+	SpanID  string
+}
+
+// Called with the timings of every request, once its response is closed.
+type MetricsHook func(timings RequestTimings)
+
+var metricsHook MetricsHook
+
+// Set the hook receiving the timings of each request. Pass nil to stop
+// measuring them.
+func SetMetricsHook(hook MetricsHook) {
+	metricsHook = hook
+}
+
+// Returns the IDs of the trace and span of ctx, empty if it has none. For
+// OpenTelemetry, e.g.
+//
+//	n1ql.SetTraceHook(func(ctx context.Context) (string, string) {
+//		sc := trace.SpanContextFromContext(ctx)
+//		if !sc.IsValid() {
+//			return "", ""
+//		}
+//		return sc.TraceID().String(), sc.SpanID().String()
+//	})
+type TraceHook func(ctx context.Context) (traceID, spanID string)
+
+var traceHook TraceHook
+
+// Set the hook identifying the trace each request is made in, so that the
+// timings passed to the MetricsHook carry its IDs. Pass nil to stop.
+func SetTraceHook(hook TraceHook) {
+	traceHook = hook
+}
+
+// Collects the timings of a single request.
+type requestTracer struct {
+	node         string
+	traceID      string
+	spanID       string
+	start        time.Time
+	getConn      time.Time
+	gotConn      time.Time
+	dialStart    time.Time
+	dialDone     time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	decode       time.Duration
+}
+
+func newRequestTracer(ctx context.Context, node string) *requestTracer {
+	tr := &requestTracer{node: node, start: time.Now()}
+	if hook := traceHook; hook != nil {
+		tr.traceID, tr.spanID = hook(ctx)
+	}
+	return tr
+}
+
+// Attach the tracer to the request context.
+func (tr *requestTracer) withContext(ctx context.Context) context.Context {
+	dialStart := func() {
+		if tr.dialStart.IsZero() {
+			tr.dialStart = time.Now()
+		}
+	}
+	dialDone := func() {
+		tr.dialDone = time.Now()
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:              func(string) { tr.getConn = time.Now() },
+		GotConn:              func(httptrace.GotConnInfo) { tr.gotConn = time.Now() },
+		DNSStart:             func(httptrace.DNSStartInfo) { dialStart() },
+		ConnectStart:         func(string, string) { dialStart() },
+		ConnectDone:          func(string, string, error) { dialDone() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { dialDone() },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { tr.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() { tr.firstByte = time.Now() },
+	})
+}
+
+// Account for time spent decoding the response since start.
+func (tr *requestTracer) addDecode(start time.Time) {
+	if tr != nil {
+		tr.decode += time.Since(start)
+	}
+}
+
+func (tr *requestTracer) timings(end time.Time) RequestTimings {
+	t := RequestTimings{Node: tr.node, Decode: tr.decode, Total: end.Sub(tr.start),
+		TraceID: tr.traceID, SpanID: tr.spanID}
+	if !tr.dialStart.IsZero() && !tr.dialDone.IsZero() {
+		t.Dial = tr.dialDone.Sub(tr.dialStart)
+	}
+	if !tr.getConn.IsZero() && !tr.gotConn.IsZero() {
+		t.QueueWait = tr.gotConn.Sub(tr.getConn) - t.Dial
+		if t.QueueWait < 0 {
+			t.QueueWait = 0
+		}
+	}
+	if !tr.wroteRequest.IsZero() && !tr.firstByte.IsZero() {
+		t.TTFB = tr.firstByte.Sub(tr.wroteRequest)
+	}
+	if !tr.firstByte.IsZero() {
+		t.Stream = end.Sub(tr.firstByte)
+	}
+	return t
+}
+
+// Return the tracer of the request the response body belongs to, if any.
+func tracerOf(body io.ReadCloser) *requestTracer {
+	if rb, ok := body.(*responseBody); ok {
+		return rb.tracer
+	}
+	return nil
+}
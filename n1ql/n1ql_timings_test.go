@@ -0,0 +1,81 @@
+package n1ql
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetricsHookTimings(t *testing.T) {
+	timings := make(chan RequestTimings, 1)
+	SetMetricsHook(func(rt RequestTimings) {
+		timings <- rt
+	})
+	defer SetMetricsHook(nil)
+
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"signature":{"a":"number"},"results":[{"a":1},{"a":2}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	rows, err := conn.Query("SELECT a FROM default")
+	if err != nil {
+		t.Fatal("Query failed.", err.Error())
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+
+	rt := <-timings
+	if rt.Node != srv.URL {
+		t.Errorf("Expected node %s, got %s", srv.URL, rt.Node)
+	}
+	if rt.TTFB < 10*time.Millisecond {
+		t.Errorf("Expected the server delay to show in TTFB, got %v", rt.TTFB)
+	}
+	if rt.Decode <= 0 || rt.Total < rt.TTFB+rt.Stream {
+		t.Errorf("Inconsistent timings %+v", rt)
+	}
+}
+
+type spanKey struct{}
+
+func TestMetricsHookTraceIDs(t *testing.T) {
+	timings := make(chan RequestTimings, 1)
+	SetMetricsHook(func(rt RequestTimings) {
+		timings <- rt
+	})
+	defer SetMetricsHook(nil)
+	SetTraceHook(func(ctx context.Context) (string, string) {
+		span, _ := ctx.Value(spanKey{}).(string)
+		if span == "" {
+			return "", ""
+		}
+		return "trace-1", span
+	})
+	defer SetTraceHook(nil)
+
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"a":1}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	for _, span := range []string{"span-1", ""} {
+		ctx := context.WithValue(context.Background(), spanKey{}, span)
+		rows, err := conn.QueryContext(ctx, "SELECT a FROM default")
+		if err != nil {
+			t.Fatal("Query failed.", err.Error())
+		}
+		rows.Close()
+
+		rt := <-timings
+		if span != "" && (rt.TraceID != "trace-1" || rt.SpanID != span) {
+			t.Errorf("Expected the IDs of the trace, got %q, %q", rt.TraceID, rt.SpanID)
+		}
+		if span == "" && (rt.TraceID != "" || rt.SpanID != "") {
+			t.Errorf("Expected no trace, got %q, %q", rt.TraceID, rt.SpanID)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"strings"
+)
+
+// Transformation of the rows of a query, applied to each of them as it is
+// decoded, before Scan, see Transform. The row is a JSON object decoded as a
+// map[string]interface{}, which the transformation may change in place, or
+// any other JSON value for SELECT RAW. It returns the row to hand over, or
+// false to drop it.
+type RowTransform func(row interface{}) (interface{}, bool)
+
+// Apply the given transformations, in order, to each row of the query, e.g.
+// to flatten the rows of SELECT *, which come wrapped in the name of their
+// keyspace:
+//
+//	rows, err := db.Query("SELECT * FROM `beer-sample` WHERE type = 'beer'",
+//		n1ql.Transform(n1ql.UnwrapField("beer-sample")))
+//
+// The columns of the rows remain the ones of the signature of the
+// statement. Not applied in passthrough mode.
+func Transform(transforms ...RowTransform) QueryOption {
+	return func(opts *queryOptions) {
+		opts.transforms = append(opts.transforms[:len(opts.transforms):len(opts.transforms)], transforms...)
+	}
+}
+
+// Keep the rows for which keep is true. Rows that are not objects are kept.
+func FilterRows(keep func(row map[string]interface{}) bool) RowTransform {
+	return func(row interface{}) (interface{}, bool) {
+		if object, ok := row.(map[string]interface{}); ok {
+			return row, keep(object)
+		}
+		return row, true
+	}
+}
+
+// Rename the field from of the rows to, replacing the field to if they have
+// one.
+func RenameField(from, to string) RowTransform {
+	return func(row interface{}) (interface{}, bool) {
+		if object, ok := row.(map[string]interface{}); ok {
+			if value, found := object[from]; found {
+				delete(object, from)
+				object[to] = value
+			}
+		}
+		return row, true
+	}
+}
+
+// Replace the object at path in the rows, its field names separated by
+// dots, with its own fields, which replace the fields of the row with the
+// same names. Rows without such an object are left as they are.
+func UnwrapField(path string) RowTransform {
+	names := strings.Split(path, ".")
+	return func(row interface{}) (interface{}, bool) {
+		object, ok := row.(map[string]interface{})
+		if !ok {
+			return row, true
+		}
+		parent := object
+		for _, name := range names[:len(names)-1] {
+			if parent, ok = parent[name].(map[string]interface{}); !ok {
+				return row, true
+			}
+		}
+		last := names[len(names)-1]
+		wrapped, ok := parent[last].(map[string]interface{})
+		if !ok {
+			return row, true
+		}
+		delete(parent, last)
+		for name, value := range wrapped {
+			parent[name] = value
+		}
+		return row, true
+	}
+}
+
+// Apply the transformations of a query to row, telling whether it is kept.
+func applyTransforms(transforms []RowTransform, row interface{}) (interface{}, bool) {
+	for _, transform := range transforms {
+		var keep bool
+		if row, keep = transform(row); !keep {
+			return nil, false
+		}
+	}
+	return row, true
+}
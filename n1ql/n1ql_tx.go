@@ -0,0 +1,295 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package n1ql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/couchbase/godbc"
+)
+
+// The transaction a request belongs to. It is carried by the options of the
+// request rather than by the connection, so that the other requests of the
+// connection stay out of it.
+type txState struct {
+	id   string // set once the transaction is started
+	node string // query API the transaction runs on
+}
+
+// Run the request in the transaction, or start it if it has no ID yet.
+func inTransaction(tx *txState) QueryOption {
+	return func(opts *queryOptions) {
+		opts.tx = tx
+	}
+}
+
+// Options of a transaction begun with BeginWithOptions, for the whole of it.
+type TxOptions struct {
+	// How long the transaction may last before the server rolls it back.
+	// Zero means the timeout set with SetTxTimeout, if any, or else the
+	// default of the server.
+	Timeout time.Duration
+
+	// Durability of the mutations of the transaction: "none", "majority",
+	// "majorityAndPersistActive" or "persistToMajority". Empty means the
+	// default of the server.
+	DurabilityLevel string
+
+	// Scan consistency of the statements of the transaction, "not_bounded"
+	// or "request_plus". Empty means the default of the server.
+	ScanConsistency string
+}
+
+var durabilityLevels = map[string]bool{
+	"none":                     true,
+	"majority":                 true,
+	"majorityAndPersistActive": true,
+	"persistToMajority":        true,
+}
+
+// The parameters of START TRANSACTION setting the options.
+func (opts *TxOptions) params() (map[string]string, error) {
+	params := make(map[string]string)
+	if opts == nil {
+		return params, nil
+	}
+	if opts.Timeout < 0 {
+		return nil, fmt.Errorf("N1QL: Invalid transaction timeout %v", opts.Timeout)
+	}
+	if opts.Timeout > 0 {
+		params["txtimeout"] = opts.Timeout.String()
+	}
+	if opts.DurabilityLevel != "" {
+		if !durabilityLevels[opts.DurabilityLevel] {
+			return nil, fmt.Errorf("N1QL: Invalid durability level %q", opts.DurabilityLevel)
+		}
+		params["durability_level"] = opts.DurabilityLevel
+	}
+	if opts.ScanConsistency != "" {
+		if consistencyRank[opts.ScanConsistency] == 0 {
+			return nil, fmt.Errorf("N1QL: Invalid scan consistency %q", opts.ScanConsistency)
+		}
+		params["scan_consistency"] = opts.ScanConsistency
+	}
+	return params, nil
+}
+
+// Transaction begun on a N1qlDB, with the savepoints of N1QL transactions.
+//
+//	tx, err := db.Begin()
+//	...
+//	if err := tx.(n1ql.N1qlTx).Savepoint("items"); err != nil {
+//	...
+//	if _, err := tx.Exec("UPDATE orders SET ..."); err != nil {
+//		err = tx.(n1ql.N1qlTx).RollbackToSavepoint("items")
+//	}
+type N1qlTx interface {
+	godbc.Tx
+
+	// Mark the current state of the transaction with a savepoint, replacing
+	// the one of the same name, if any.
+	Savepoint(name string) error
+
+	// Undo what the transaction did since the savepoint, which it keeps,
+	// as do the earlier savepoints. The transaction goes on.
+	RollbackToSavepoint(name string) error
+}
+
+// Implements N1qlTx. The statements run through the transaction go to the
+// query node it was started on, with its ID; the other requests of the
+// handle are not part of it.
+type n1qlTx struct {
+	// shares the connection of the handle the transaction was begun on,
+	// with the transaction among its default options
+	db    *n1qlDB
+	state *txState
+
+	// the context the transaction was begun with, which its statements run
+	// with, and closed once it is over, for the rollback on cancel
+	ctx      context.Context
+	finished chan struct{}
+
+	lock sync.Mutex
+	done bool
+}
+
+// Start a transaction with START TRANSACTION on one of the query nodes.
+func (db *n1qlDB) begin(ctx context.Context, txOpts *TxOptions) (godbc.Tx, error) {
+	if db.conn == nil {
+		return nil, errorNoConnection
+	}
+	params, err := txOpts.params()
+	if err != nil {
+		return nil, err
+	}
+	state := &txState{}
+	defaults := make([]QueryOption, 0, len(db.defaults)+1)
+	defaults = append(defaults, db.defaults...)
+	defaults = append(defaults, inTransaction(state))
+	tx := &n1qlTx{db: &n1qlDB{conn: db.conn, defaults: defaults, derived: true}, state: state, ctx: ctx}
+
+	opts, _ := splitQueryOptions(withDefaultOptions(defaults, []interface{}{TxStatement(TX_START)}))
+	for key, value := range params {
+		opts.setParam(key, value)
+	}
+	if _, err := db.conn.performExec(ctx, "START TRANSACTION", nil, opts); err != nil {
+		return nil, fmt.Errorf("N1QL: Cannot start a transaction: %w", err)
+	}
+	if state.id == "" {
+		return nil, fmt.Errorf("N1QL: No transaction ID returned by the server")
+	}
+	if ctx.Done() != nil {
+		tx.finished = make(chan struct{})
+		go tx.rollbackOnCancel()
+	}
+	return tx, nil
+}
+
+// Roll the transaction back as soon as its context is done, unless it is
+// over by then, so that it does not linger on its query node until it
+// times out.
+func (tx *n1qlTx) rollbackOnCancel() {
+	select {
+	case <-tx.ctx.Done():
+		if err := tx.end("ROLLBACK TRANSACTION", TX_ROLLBACK); err != nil && err != ErrTxDone {
+			logger.Printf("N1QL: Cannot roll back transaction %s after its context ended: %v", tx.state.id, err)
+		}
+	case <-tx.finished:
+	}
+}
+
+func (tx *n1qlTx) Commit() error {
+	return tx.end("COMMIT TRANSACTION", TX_COMMIT)
+}
+
+func (tx *n1qlTx) Rollback() error {
+	return tx.end("ROLLBACK TRANSACTION", TX_ROLLBACK)
+}
+
+// Commit or roll back. The transaction is over either way.
+func (tx *n1qlTx) end(statement string, kind int) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if tx.finished != nil {
+		close(tx.finished)
+	}
+	opts, _ := splitQueryOptions(withDefaultOptions(tx.db.defaults, []interface{}{TxStatement(kind)}))
+	if _, err := tx.db.conn.performExec(context.Background(), statement, nil, opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (tx *n1qlTx) Savepoint(name string) error {
+	return tx.savepoint("SAVEPOINT ", name)
+}
+
+func (tx *n1qlTx) RollbackToSavepoint(name string) error {
+	return tx.savepoint("ROLLBACK TRANSACTION TO SAVEPOINT ", name)
+}
+
+// Run a savepoint statement on the node of the transaction.
+func (tx *n1qlTx) savepoint(statement, name string) error {
+	if name == "" {
+		return fmt.Errorf("N1QL: Empty savepoint name")
+	}
+	if err := tx.active(); err != nil {
+		return err
+	}
+	opts, _ := splitQueryOptions(withDefaultOptions(tx.db.defaults, []interface{}{TxStatement(TX_NONE)}))
+	_, err := tx.db.conn.performExec(tx.ctx, statement+quoteIdentifier(name), nil, opts)
+	return err
+}
+
+func (tx *n1qlTx) active() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	return nil
+}
+
+func (tx *n1qlTx) prepare(ctx context.Context, query string) (*n1qlStmt, error) {
+	if err := tx.active(); err != nil {
+		return nil, err
+	}
+	return tx.db.prepare(ctx, query)
+}
+
+func (tx *n1qlTx) Exec(query string, args ...interface{}) (godbc.Result, error) {
+	stmt, err := tx.prepare(tx.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(tx.ctx, args...)
+}
+
+func (tx *n1qlTx) Prepare(query string) (godbc.Stmt, error) {
+	return tx.prepare(tx.ctx, query)
+}
+
+func (tx *n1qlTx) Query(query string, args ...interface{}) (godbc.Rows, error) {
+	stmt, err := tx.prepare(tx.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(tx.ctx, args...)
+}
+
+func (tx *n1qlTx) QueryRow(query string, args ...interface{}) godbc.Row {
+	rows, err := tx.Query(query, args...)
+	return firstRow(rows, err, tx.db.conn != nil && tx.db.conn.noRowsError)
+}
+
+// A statement of the handle running in the transaction.
+func (tx *n1qlTx) Stmt(stmt godbc.Stmt) godbc.Stmt {
+	s, ok := stmt.(*n1qlStmt)
+	if !ok {
+		return stmt
+	}
+	txStmt := *s
+	txStmt.defaults = make([]QueryOption, 0, len(s.defaults)+1)
+	txStmt.defaults = append(txStmt.defaults, s.defaults...)
+	txStmt.defaults = append(txStmt.defaults, inTransaction(tx.state))
+	return &txStmt
+}
+
+// Implements driver.Tx for the transaction of a connection started with
+// Begin, which the requests of the connection belong to.
+type connTx struct {
+	conn *n1qlConn
+	done bool
+}
+
+func (tx *connTx) Commit() error {
+	return tx.end("COMMIT TRANSACTION", TX_COMMIT)
+}
+
+func (tx *connTx) Rollback() error {
+	return tx.end("ROLLBACK TRANSACTION", TX_ROLLBACK)
+}
+
+func (tx *connTx) end(statement string, kind int) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	opts := &queryOptions{txStmt: kind, hasTxStmt: true}
+	_, err := tx.conn.performExec(context.Background(), statement, nil, opts)
+	return err
+}
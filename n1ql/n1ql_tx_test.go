@@ -0,0 +1,250 @@
+package n1ql
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	type request struct {
+		node, statement, txid string
+	}
+	var lock sync.Mutex
+	var requests []request
+	handler := func(node string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			statement := r.PostForm.Get("statement")
+			if statement == "" {
+				statement = "EXECUTE " + r.PostForm.Get("prepared")
+			}
+			lock.Lock()
+			requests = append(requests, request{node, statement, r.PostForm.Get("txid")})
+			lock.Unlock()
+			switch {
+			case statement == "START TRANSACTION":
+				w.Write([]byte(`{"results":[{"txid":"tx1"}],"status":"success"}`))
+			case strings.HasPrefix(statement, "PREPARE DELETE FROM other"):
+				w.Write([]byte(`{"results":[{"name":"other"}],"status":"success"}`))
+			case strings.HasPrefix(statement, "PREPARE"):
+				w.Write([]byte(`{"results":[{"name":"p1"}],"status":"success"}`))
+			default:
+				w.Write([]byte(`{"signature":{"a":"number"},"results":[],"metrics":{"mutationCount":1},"status":"success"}`))
+			}
+		}
+	}
+	a := httptest.NewServer(handler("a"))
+	defer a.Close()
+	b := httptest.NewServer(handler("b"))
+	defer b.Close()
+	db := &n1qlDB{conn: &n1qlConn{client: HTTPClient, queryAPIs: []string{a.URL, b.URL}}}
+	stmt, err := db.Prepare("UPDATE default SET a = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, commit := range []bool{true, false} {
+		requests = nil
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal("Begin failed.", err)
+		}
+		if _, err := tx.Exec("DELETE FROM default"); err != nil {
+			t.Fatal("Exec in the transaction failed.", err)
+		}
+		if _, err := tx.Stmt(stmt).Exec(1); err != nil {
+			t.Fatal("Stmt in the transaction failed.", err)
+		}
+		// the handle itself is not in the transaction
+		if _, err := db.Exec("DELETE FROM other"); err != nil {
+			t.Fatal("Exec failed.", err)
+		}
+		end, name := tx.Rollback, "ROLLBACK TRANSACTION"
+		if commit {
+			end, name = tx.Commit, "COMMIT TRANSACTION"
+		}
+		if err := end(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("Expected ErrTxDone, got %v", err)
+		}
+		if _, err := tx.Exec("DELETE FROM default"); !errors.Is(err, ErrTxDone) {
+			t.Errorf("Expected ErrTxDone, got %v", err)
+		}
+
+		txNode := requests[0].node
+		for _, r := range requests[1:] {
+			inTx := !strings.Contains(r.statement, "other")
+			if inTx && (r.node != txNode || r.txid != "tx1") || !inTx && r.txid != "" {
+				t.Errorf("Unexpected request %+v, the transaction runs on %s", r, txNode)
+			}
+		}
+		if last := requests[len(requests)-1]; last.statement != name {
+			t.Errorf("Expected %s, got %+v", name, last)
+		}
+	}
+}
+
+func TestBeginWithOptions(t *testing.T) {
+	SetTxTimeout("2m")
+	defer SetTxTimeout("")
+	starts := make(chan url.Values, 2)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("statement") == "START TRANSACTION" {
+			starts <- r.PostForm
+			w.Write([]byte(`{"results":[{"txid":"tx1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	tx, err := db.BeginWithOptions(TxOptions{Timeout: 10 * time.Second, DurabilityLevel: "majority",
+		ScanConsistency: "not_bounded"})
+	if err != nil {
+		t.Fatal("Begin failed.", err)
+	}
+	tx.Rollback()
+	start := <-starts
+	if start.Get("txtimeout") != "10s" || start.Get("durability_level") != "majority" ||
+		start.Get("scan_consistency") != "not_bounded" {
+		t.Errorf("Unexpected parameters %v", start)
+	}
+
+	// the package level timeout, unless the transaction has its own
+	tx, err = db.BeginWithOptions(TxOptions{})
+	if err != nil {
+		t.Fatal("Begin failed.", err)
+	}
+	tx.Rollback()
+	if start := <-starts; start.Get("txtimeout") != "2m" || start.Get("durability_level") != "" {
+		t.Errorf("Unexpected parameters %v", start)
+	}
+
+	for _, opts := range []TxOptions{{DurabilityLevel: "all"}, {ScanConsistency: "at_plus"}, {Timeout: -1}} {
+		if _, err := db.BeginWithOptions(opts); err == nil {
+			t.Errorf("Expected %+v to be rejected", opts)
+		}
+	}
+}
+
+func TestBeginTxRollbackOnCancel(t *testing.T) {
+	statements := make(chan string, 10)
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statement := r.PostForm.Get("statement")
+		statements <- statement + " " + r.PostForm.Get("txid")
+		if statement == "START TRANSACTION" {
+			w.Write([]byte(`{"results":[{"txid":"tx1"}],"status":"success"}`))
+			return
+		}
+		w.Write([]byte(`{"results":[],"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal("Begin failed.", err)
+	}
+	<-statements
+	cancel()
+	if s := <-statements; s != "ROLLBACK TRANSACTION tx1" {
+		t.Errorf("Expected the transaction to be rolled back, got %s", s)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	// nothing to roll back once committed
+	ctx, cancel = context.WithCancel(context.Background())
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal("Begin failed.", err)
+	}
+	<-statements
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Commit failed.", err)
+	}
+	<-statements
+	cancel()
+	select {
+	case s := <-statements:
+		t.Errorf("Unexpected statement %s", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTxSniffing(t *testing.T) {
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"txid":"tx1"}],"status":"success"}`))
+	})
+	defer srv.Close()
+
+	if _, err := conn.Exec("BEGIN WORK"); err != nil || conn.txid != "tx1" {
+		t.Fatalf("Expected the transaction to be started, got %q, %v", conn.txid, err)
+	}
+	if _, err := conn.Exec("COMMIT", TxStatement(TX_NONE)); err != nil || conn.txid != "tx1" {
+		t.Errorf("Expected the transaction to go on, got %q, %v", conn.txid, err)
+	}
+	conn.SetTxValues("", "")
+
+	conn.noTxSniffing = true
+	if _, err := conn.Exec("BEGIN WORK"); err != nil || conn.txid != "" {
+		t.Errorf("Expected no transaction, got %q, %v", conn.txid, err)
+	}
+	if _, err := conn.Exec("BEGIN WORK", TxStatement(TX_START)); err != nil || conn.txid != "tx1" {
+		t.Errorf("Expected the transaction to be started, got %q, %v", conn.txid, err)
+	}
+	if _, err := conn.Exec("COMMIT WORK", TxStatement(TX_COMMIT)); err != nil || conn.txid != "" {
+		t.Errorf("Expected the transaction to be over, got %q, %v", conn.txid, err)
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	var statements []string
+	conn, srv := newTestConn(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		statements = append(statements, r.PostForm.Get("statement")+" "+r.PostForm.Get("txid"))
+		w.Write([]byte(`{"results":[{"txid":"tx1"}],"status":"success"}`))
+	})
+	defer srv.Close()
+	db := &n1qlDB{conn: conn}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal("Begin failed.", err)
+	}
+	if err := tx.(N1qlTx).Savepoint("s`1"); err != nil {
+		t.Fatal("Savepoint failed.", err)
+	}
+	if err := tx.(N1qlTx).RollbackToSavepoint("s`1"); err != nil {
+		t.Fatal("Rollback to savepoint failed.", err)
+	}
+	if err := tx.(N1qlTx).Savepoint(""); err == nil {
+		t.Error("Expected an empty name to be rejected")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal("Commit failed.", err)
+	}
+	if err := tx.(N1qlTx).Savepoint("s2"); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	expected := []string{"START TRANSACTION ", "SAVEPOINT `s``1` tx1",
+		"ROLLBACK TRANSACTION TO SAVEPOINT `s``1` tx1", "COMMIT TRANSACTION tx1"}
+	if strings.Join(statements, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected statements %q", statements)
+	}
+}
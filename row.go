@@ -9,6 +9,32 @@
 
 package godbc
 
+import "errors"
+
+// Reported by Scan of the row of a QueryRow that found no rows, by the
+// drivers set to, as database/sql does.
+var ErrNoRows = errors.New("godbc: no rows in result set")
+
 type Row interface {
 	Scan(dest ...interface{}) error
 }
+
+// A Row whose Scan reports err. QueryRow implementations return it when the
+// query fails, so that callers can chain QueryRow(...).Scan(...) without
+// checking for a nil Row.
+func ErrRow(err error) Row {
+	return errRow{err}
+}
+
+type errRow struct {
+	err error
+}
+
+func (row errRow) Scan(dest ...interface{}) error {
+	return row.err
+}
+
+// The error of the query.
+func (row errRow) Err() error {
+	return row.err
+}
@@ -9,9 +9,15 @@
 
 package godbc
 
+import (
+	"context"
+)
+
 type Stmt interface {
 	Close() error
 	Exec(args ...interface{}) (Result, error)
+	ExecContext(ctx context.Context, args ...interface{}) (Result, error)
 	Query(args ...interface{}) (Rows, error)
+	QueryContext(ctx context.Context, args ...interface{}) (Rows, error)
 	QueryRow(args ...interface{}) Row
 }